@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	activityPush         = "push"
+	activityBranchCreate = "branch.create"
+	activityBranchDelete = "branch.delete"
+	activityTagCreate    = "tag.create"
+	activityTagDelete    = "tag.delete"
+	activityTagUpdate    = "tag.update"
+	activityRepoCreate   = "repo.create"
+	activityRepoUpdate   = "repo.update"
+	activityRepoTransfer = "repo.transfer"
+	activityRepoDelete   = "repo.delete"
+	activityRepoUndelete = "repo.undelete"
+	activityRefRestore   = "ref.restore"
+)
+
+type activityEvent struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Repo   string    `json:"repo"`
+	Actor  string    `json:"actor"`
+	Type   string    `json:"type"`
+	Ref    string    `json:"ref,omitempty"`
+	OldRev string    `json:"old_rev,omitempty"`
+	NewRev string    `json:"new_rev,omitempty"`
+}
+
+// refEvents turns the difference between two ref snapshots into activity
+// events: branch and tag creations and deletions, moved tags, and a push event
+// for every updated branch.
+func refEvents(repo, actor string, before, after map[string]string) []activityEvent {
+	now := time.Now()
+	var events []activityEvent
+	add := func(ref, oldRev, newRev string) {
+		var kind string
+		switch {
+		case strings.HasPrefix(ref, "refs/tags/") && oldRev == "":
+			kind = activityTagCreate
+		case strings.HasPrefix(ref, "refs/tags/") && newRev == "":
+			kind = activityTagDelete
+		case strings.HasPrefix(ref, "refs/tags/"):
+			kind = activityTagUpdate
+		case strings.HasPrefix(ref, "refs/heads/") && oldRev == "":
+			kind = activityBranchCreate
+		case strings.HasPrefix(ref, "refs/heads/") && newRev == "":
+			kind = activityBranchDelete
+		case strings.HasPrefix(ref, "refs/heads/"):
+			kind = activityPush
+		default:
+			return
+		}
+		events = append(events, activityEvent{Time: now, Repo: repo, Actor: actor, Type: kind, Ref: ref, OldRev: oldRev, NewRev: newRev})
+	}
+	for ref, sha := range after {
+		if before[ref] != sha {
+			add(ref, before[ref], sha)
+		}
+	}
+	for ref, sha := range before {
+		if _, ok := after[ref]; !ok {
+			add(ref, sha, "")
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Ref < events[j].Ref })
+	return events
+}
+
+// recordActivity stores events for the activity feed, logging rather than
+// returning failures like audit does.
+func recordActivity(events ...activityEvent) {
+	if store == nil || len(events) == 0 {
+		return
+	}
+	if err := store.AddActivity(events); err != nil {
+		log.Error("Failed to record activity", "repo", events[0].Repo, "error", err)
+	}
+}
+
+func repoActivity(repo, actor, kind string) activityEvent {
+	return activityEvent{Time: time.Now(), Repo: repo, Actor: actor, Type: kind}
+}
@@ -0,0 +1,848 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+func newAdminServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/aliases", listAliasesHandler)
+	mux.HandleFunc("PUT /api/aliases/{alias}", putAliasHandler)
+	mux.HandleFunc("DELETE /api/aliases/{alias}", deleteAliasHandler)
+	mux.HandleFunc("GET /api/repos", listReposHandler)
+	mux.HandleFunc("POST /api/repos", createRepoHandler)
+	mux.HandleFunc("GET /api/repos/collisions", repoCollisionsHandler)
+	mux.HandleFunc("GET /api/repos/duplicates", repoDuplicatesHandler)
+	mux.HandleFunc("GET /api/repos/orphans", listOrphansHandler)
+	mux.HandleFunc("DELETE /api/repos/orphans", pruneOrphansHandler)
+	mux.HandleFunc("GET /api/repos/{name}", getRepoHandler)
+	mux.HandleFunc("PATCH /api/repos/{name}", updateRepoHandler)
+	mux.HandleFunc("DELETE /api/repos/{name}", deleteRepoHandler)
+	mux.HandleFunc("POST /api/repos/{name}/transfer", transferRepoHandler)
+	mux.HandleFunc("GET /api/repos/{name}/config", repoConfigHandler)
+	mux.HandleFunc("GET /api/repos/{name}/ref-backups", listRefBackupsHandler)
+	mux.HandleFunc("POST /api/repos/{name}/ref-backups/restore", restoreRefBackupHandler)
+	mux.HandleFunc("GET /api/repos/{name}/maintenance", getMaintenanceHandler)
+	mux.HandleFunc("PUT /api/repos/{name}/maintenance", putMaintenanceHandler)
+	mux.HandleFunc("DELETE /api/repos/{name}/maintenance", deleteMaintenanceHandler)
+	mux.HandleFunc("GET /api/repos/{name}/webhooks", listWebhooksHandler)
+	mux.HandleFunc("POST /api/repos/{name}/webhooks", addWebhookHandler)
+	mux.HandleFunc("DELETE /api/repos/{name}/webhooks/{id}", deleteWebhookHandler)
+	mux.HandleFunc("GET /api/mirrors", listAllMirrorsHandler)
+	mux.HandleFunc("GET /api/repos/{name}/mirrors", listMirrorsHandler)
+	mux.HandleFunc("POST /api/repos/{name}/mirrors", addMirrorHandler)
+	mux.HandleFunc("DELETE /api/repos/{name}/mirrors/{id}", deleteMirrorHandler)
+	mux.HandleFunc("POST /api/repos/{name}/mirrors/{id}/sync", syncMirrorHandler)
+	mux.HandleFunc("GET /api/repos/{name}/statuses/{sha}", getStatusHandler)
+	mux.HandleFunc("POST /api/repos/{name}/statuses/{sha}", addStatusHandler)
+	mux.HandleFunc("GET /api/repos/{name}/protected-branches", listProtectedBranchesHandler)
+	mux.HandleFunc("PUT /api/repos/{name}/protected-branches/{pattern...}", putProtectedBranchHandler)
+	mux.HandleFunc("DELETE /api/repos/{name}/protected-branches/{pattern...}", deleteProtectedBranchHandler)
+	mux.HandleFunc("GET /api/repos/{name}/guests", listGuestGrantsHandler)
+	mux.HandleFunc("POST /api/repos/{name}/guests", createGuestGrantHandler)
+	mux.HandleFunc("DELETE /api/repos/{name}/guests/{id}", deleteGuestGrantHandler)
+	mux.HandleFunc("GET /api/key-revocations", listKeyRevocationsHandler)
+	mux.HandleFunc("PUT /api/key-revocations/{fingerprint...}", putKeyRevocationHandler)
+	mux.HandleFunc("DELETE /api/key-revocations/{fingerprint...}", deleteKeyRevocationHandler)
+	mux.HandleFunc("GET /api/tenants", listTenantsHandler)
+	mux.HandleFunc("GET /api/search", searchHandler)
+	mux.HandleFunc("POST /api/repos/{name}/search-index", reindexRepoHandler)
+	mux.HandleFunc("GET /api/repos/{name}/receipts", listReceiptsHandler)
+	mux.HandleFunc("GET /api/tokens", listTokensHandler)
+	mux.HandleFunc("POST /api/tokens", createTokenHandler)
+	mux.HandleFunc("DELETE /api/tokens/{id}", deleteTokenHandler)
+	mux.HandleFunc("GET /api/audit", auditHandler)
+	mux.HandleFunc("GET /api/audit/verify", verifyAuditHandler)
+	mux.HandleFunc("GET /api/activity", activityHandler)
+	mux.HandleFunc("GET /api/repos/{name}/activity", activityHandler)
+	mux.HandleFunc("POST /api/backups/reconcile", reconcileBackupsHandler)
+	mux.HandleFunc("GET /api/traffic", trafficHandler)
+	mux.HandleFunc("GET /api/repo-requests", listRepoRequestsHandler)
+	mux.HandleFunc("POST /api/repo-requests/{name}/approve", approveRepoRequestHandler)
+	mux.HandleFunc("DELETE /api/repo-requests/{name}", rejectRepoRequestHandler)
+	mux.HandleFunc("GET /api/hostkeys", hostKeysHandler)
+	mux.HandleFunc("GET /api/storage", storageReportHandler)
+	mux.HandleFunc("GET /api/trash", listTrashHandler)
+	mux.HandleFunc("POST /api/trash/{id}/restore", restoreTrashHandler)
+	mux.HandleFunc("DELETE /api/trash/{id}", purgeTrashHandler)
+	mux.HandleFunc("GET /api/maintenance", listMaintenanceHandler)
+	mux.HandleFunc("PUT /api/maintenance", putMaintenanceHandler)
+	mux.HandleFunc("DELETE /api/maintenance", deleteMaintenanceHandler)
+	mux.HandleFunc("GET /metrics", metricsHandler)
+
+	return &http.Server{
+		Addr:    config.AdminAddr,
+		Handler: requireAdmin(mux),
+	}
+}
+
+func adminAPIEnabled() bool {
+	return config.AdminToken != "" || config.OIDCIssuer != ""
+}
+
+var oidc *oidcVerifier
+
+type adminActorKey struct{}
+
+// adminActor names whoever authenticated the request, for the audit log.
+func adminActor(r *http.Request) string {
+	actor, _ := r.Context().Value(adminActorKey{}).(string)
+	return actor
+}
+
+func withActor(r *http.Request, actor string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor))
+}
+
+// requireAdmin accepts the static admin token, an API token from the metadata
+// store or, when OIDC is configured, a JWT from the identity provider. Read-only
+// API tokens and OIDC tokens carrying one of the viewer roles may only make
+// read requests.
+func requireAdmin(next http.Handler) http.Handler {
+	if config.OIDCIssuer != "" {
+		oidc = newOIDCVerifier(config.OIDCIssuer, config.OIDCAudience)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1 {
+			next.ServeHTTP(w, withActor(r, "admin-token"))
+			return
+		}
+		if t, err := store.TokenByHash(hashToken(token)); err == nil {
+			if t.ReadOnly && r.Method != http.MethodGet {
+				writeError(w, http.StatusForbidden, "forbidden")
+				return
+			}
+			next.ServeHTTP(w, withActor(r, "token:"+t.Name))
+			return
+		} else if !errors.Is(err, errNotFound) {
+			authLog.Error("Failed to look up API token", "error", err)
+		}
+		if oidc == nil {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		claims, err := oidc.Verify(token)
+		if err != nil {
+			authLog.Warn("Rejected admin API token", "error", err)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		subject, _ := claims["sub"].(string)
+		roles := claimStrings(claims, config.OIDCRolesClaim)
+		isAdmin := hasAnyRole(roles, config.OIDCAdminRoles)
+		isViewer := hasAnyRole(roles, config.OIDCViewerRoles)
+		if !isAdmin && !(isViewer && r.Method == http.MethodGet) {
+			authLog.Warn("Admin API request denied", "subject", subject, "method", r.Method, "path", r.URL.Path)
+			writeError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		if r.Method != http.MethodGet {
+			authLog.Info("Admin API request", "subject", subject, "method", r.Method, "path", r.URL.Path)
+		}
+		next.ServeHTTP(w, withActor(r, "oidc:"+subject))
+	})
+}
+
+func hasAnyRole(roles, wanted []string) bool {
+	for _, role := range roles {
+		if slices.Contains(wanted, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func listAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, aliases.List())
+}
+
+func putAliasHandler(w http.ResponseWriter, r *http.Request) {
+	alias := r.PathValue("alias")
+	var body struct {
+		Repo string `json:"repo"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if !isValidRepoName(alias) || !isValidRepoName(body.Repo) {
+		writeError(w, http.StatusBadRequest, "invalid repository name")
+		return
+	}
+
+	if err := aliases.Set(alias, body.Repo); err != nil {
+		if errors.Is(err, errAliasExists) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		log.Error("Failed to set alias", "alias", alias, "repo", body.Repo, "error", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Info("Alias set", "alias", alias, "repo", aliases.Resolve(alias))
+	audit(adminActor(r), "alias.set", aliases.Resolve(alias), "alias="+alias)
+	writeJSON(w, http.StatusOK, map[string]string{"alias": alias, "repo": aliases.Resolve(alias)})
+}
+
+func deleteAliasHandler(w http.ResponseWriter, r *http.Request) {
+	alias := r.PathValue("alias")
+	if err := aliases.Delete(alias); err != nil {
+		if errors.Is(err, errAliasNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Error("Failed to delete alias", "alias", alias, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete alias")
+		return
+	}
+	log.Info("Alias deleted", "alias", alias)
+	audit(adminActor(r), "alias.delete", "", "alias="+alias)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func createRepoHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name     string `json:"name"`
+		Owner    string `json:"owner"`
+		Template string `json:"template"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	repo, err := createRepo(body.Name, body.Owner, body.Template, adminActor(r))
+	switch {
+	case errors.Is(err, errInvalidRepo), errors.Is(err, errUnknownTemplate):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errRepoExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		log.Error("Repository creation failed", "repo", repo, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to create repository")
+	default:
+		writeJSON(w, http.StatusCreated, map[string]string{"name": repo})
+	}
+}
+
+func repoCollisionsHandler(w http.ResponseWriter, r *http.Request) {
+	collisions, err := repoNameCollisions()
+	if err != nil {
+		log.Error("Failed to check repository names", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list repositories")
+		return
+	}
+	if collisions == nil {
+		collisions = [][]string{}
+	}
+	writeJSON(w, http.StatusOK, collisions)
+}
+
+func repoDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	duplicates, err := repoSuffixDuplicates()
+	if err != nil {
+		log.Error("Failed to check repository names", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to compare repositories")
+		return
+	}
+	if duplicates == nil {
+		duplicates = []duplicateRepo{}
+	}
+	writeJSON(w, http.StatusOK, duplicates)
+}
+
+func listOrphansHandler(w http.ResponseWriter, r *http.Request) {
+	orphans, err := store.orphanedRepos()
+	if err != nil {
+		log.Error("Failed to list orphaned repository records", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list repositories")
+		return
+	}
+	if orphans == nil {
+		orphans = []string{}
+	}
+	writeJSON(w, http.StatusOK, orphans)
+}
+
+// pruneOrphansHandler deletes the records of repositories that are missing on
+// disk, together with their aliases, webhooks, protection and history.
+func pruneOrphansHandler(w http.ResponseWriter, r *http.Request) {
+	orphans, err := store.orphanedRepos()
+	if err != nil {
+		log.Error("Failed to list orphaned repository records", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list repositories")
+		return
+	}
+	pruned := []string{}
+	for _, name := range orphans {
+		if err := store.DeleteRepo(name); err != nil {
+			log.Error("Failed to prune repository record", "repo", name, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to prune repository records")
+			return
+		}
+		log.Info("Pruned repository record", "repo", name)
+		audit(adminActor(r), "repo.prune", name, "")
+		pruned = append(pruned, name)
+	}
+	if err := aliases.reload(); err != nil {
+		log.Error("Failed to reload aliases", "error", err)
+	}
+	writeJSON(w, http.StatusOK, pruned)
+}
+
+func listReposHandler(w http.ResponseWriter, r *http.Request) {
+	repos, err := store.Repos(r.URL.Query().Get("owner"), r.URL.Query().Get("visibility"))
+	if err != nil {
+		log.Error("Failed to list repositories", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list repositories")
+		return
+	}
+	writeJSON(w, http.StatusOK, repos)
+}
+
+func getRepoHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if ok {
+		writeJSON(w, http.StatusOK, repo)
+	}
+}
+
+func updateRepoHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Owner      *string `json:"owner"`
+		Visibility *string `json:"visibility"`
+		QuotaBytes *int64  `json:"quota_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	var changes []string
+	if body.Owner != nil {
+		repo.Owner = *body.Owner
+		changes = append(changes, "owner="+repo.Owner)
+	}
+	if body.Visibility != nil {
+		if *body.Visibility != visibilityPrivate && *body.Visibility != visibilityPublic {
+			writeError(w, http.StatusBadRequest, "visibility must be private or public")
+			return
+		}
+		repo.Visibility = *body.Visibility
+		changes = append(changes, "visibility="+repo.Visibility)
+	}
+	if body.QuotaBytes != nil {
+		if *body.QuotaBytes < 0 {
+			writeError(w, http.StatusBadRequest, "quota_bytes must not be negative")
+			return
+		}
+		repo.QuotaBytes = *body.QuotaBytes
+		changes = append(changes, "quota_bytes="+strconv.FormatInt(repo.QuotaBytes, 10))
+	}
+	if err := store.UpdateRepo(repo); err != nil {
+		log.Error("Failed to update repository", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to update repository")
+		return
+	}
+	log.Info("Repository updated", "repo", repo.Name, "changes", strings.Join(changes, " "))
+	audit(adminActor(r), "repo.update", repo.Name, strings.Join(changes, " "))
+	recordActivity(repoActivity(repo.Name, adminActor(r), activityRepoUpdate))
+	writeJSON(w, http.StatusOK, repo)
+}
+
+func transferRepoHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Owner string `json:"owner"`
+		Name  string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.Owner == "" && body.Name == "" {
+		writeError(w, http.StatusBadRequest, "owner or name is required")
+		return
+	}
+	repo, err := transferRepo(r.PathValue("name"), body.Name, body.Owner, adminActor(r))
+	switch {
+	case errors.Is(err, errNotFound):
+		writeError(w, http.StatusNotFound, "repository not found")
+	case errors.Is(err, errInvalidRepo):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errRepoExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		log.Error("Repository transfer failed", "repo", r.PathValue("name"), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to transfer repository")
+	default:
+		writeJSON(w, http.StatusOK, repo)
+	}
+}
+
+// repoConfigHandler shows the settings read from the repository's
+// configuration file and why the file is ignored, if it is.
+func repoConfigHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	cfg, err := readRepoConfig(repoDirPath(repo.Name))
+	resp := struct {
+		Path   string     `json:"path"`
+		Config repoConfig `json:"config"`
+		Error  string     `json:"error,omitempty"`
+	}{Path: repoConfigPath, Config: cfg}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func listRefBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	backups, err := liveRefBackups(repo.Name)
+	if err != nil {
+		log.Error("Failed to list ref backups", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list ref backups")
+		return
+	}
+	writeJSON(w, http.StatusOK, backups)
+}
+
+func restoreRefBackupHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Backup string `json:"backup"`
+		Ref    string `json:"ref"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Backup == "" {
+		writeError(w, http.StatusBadRequest, "backup is required")
+		return
+	}
+	backup, ref, err := restoreRefBackup(repo.Name, body.Backup, body.Ref, adminActor(r))
+	switch {
+	case errors.Is(err, errRefBackupNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errInvalidRef):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errRefExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		log.Error("Ref restore failed", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to restore ref")
+	default:
+		writeJSON(w, http.StatusCreated, map[string]string{"ref": ref, "sha": backup.SHA, "backup": backup.ID})
+	}
+}
+
+// lookupRepoRecord resolves the {name} path value, including aliases, and
+// writes a 404 when the repository is unknown.
+func lookupRepoRecord(w http.ResponseWriter, r *http.Request) (repoRecord, bool) {
+	repo, err := store.Repo(resolveRepo(r.PathValue("name")))
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, "repository not found")
+		return repo, false
+	}
+	if err != nil {
+		log.Error("Failed to load repository", "repo", r.PathValue("name"), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load repository")
+		return repo, false
+	}
+	return repo, true
+}
+
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	hooks, err := store.Webhooks(repo.Name)
+	if err != nil {
+		log.Error("Failed to list webhooks", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list webhooks")
+		return
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+func addWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		URL    string `json:"url"`
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if u, err := url.Parse(body.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, http.StatusBadRequest, "url must be an absolute http or https URL")
+		return
+	}
+	hook, err := store.AddWebhook(repo.Name, body.URL, body.Secret)
+	if err != nil {
+		log.Error("Failed to add webhook", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to add webhook")
+		return
+	}
+	audit(adminActor(r), "webhook.add", repo.Name, "url="+hook.URL)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+	err = store.DeleteWebhook(repo.Name, id)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, "webhook not found")
+		return
+	}
+	if err != nil {
+		log.Error("Failed to delete webhook", "repo", repo.Name, "id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete webhook")
+		return
+	}
+	audit(adminActor(r), "webhook.delete", repo.Name, "id="+r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getStatusHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	sha := strings.ToLower(r.PathValue("sha"))
+	statuses, err := store.CommitStatuses(repo.Name, sha)
+	if err != nil {
+		log.Error("Failed to read commit statuses", "repo", repo.Name, "sha", sha, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to read commit statuses")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"sha":      sha,
+		"state":    combinedState(statuses, nil),
+		"statuses": latestStatuses(statuses),
+	})
+}
+
+func addStatusHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	sha := strings.ToLower(r.PathValue("sha"))
+	if !shaRegex.MatchString(sha) {
+		writeError(w, http.StatusBadRequest, "sha must be a full commit id")
+		return
+	}
+	var body struct {
+		State       string `json:"state"`
+		Context     string `json:"context"`
+		Description string `json:"description"`
+		TargetURL   string `json:"target_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if !isValidStatusState(body.State) {
+		writeError(w, http.StatusBadRequest, "state must be pending, success, failure or error")
+		return
+	}
+	if body.Context == "" {
+		body.Context = "default"
+	}
+	cs, err := store.AddCommitStatus(commitStatus{
+		Repo:        repo.Name,
+		SHA:         sha,
+		Context:     body.Context,
+		State:       body.State,
+		Description: body.Description,
+		TargetURL:   body.TargetURL,
+		Actor:       adminActor(r),
+	})
+	if err != nil {
+		log.Error("Failed to store commit status", "repo", repo.Name, "sha", sha, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to store commit status")
+		return
+	}
+	writeJSON(w, http.StatusCreated, cs)
+}
+
+func listProtectedBranchesHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	rules, err := store.ProtectedBranches(repo.Name)
+	if err != nil {
+		log.Error("Failed to list protected branches", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list protected branches")
+		return
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+func putProtectedBranchHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	rule := protectedBranch{Repo: repo.Name, Pattern: r.PathValue("pattern")}
+	if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+		writeError(w, http.StatusBadRequest, "invalid branch pattern")
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	rule.Pattern = r.PathValue("pattern")
+	if rule.RequiredContexts == nil {
+		rule.RequiredContexts = []string{}
+	}
+	if err := store.SetProtectedBranch(rule); err != nil {
+		log.Error("Failed to protect branch", "repo", repo.Name, "pattern", rule.Pattern, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to protect branch")
+		return
+	}
+	audit(adminActor(r), "branch.protect", repo.Name, fmt.Sprintf("pattern=%s require_status=%t contexts=%s",
+		rule.Pattern, rule.RequireStatus, strings.Join(rule.RequiredContexts, ",")))
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func deleteProtectedBranchHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	pattern := r.PathValue("pattern")
+	err := store.DeleteProtectedBranch(repo.Name, pattern)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, "protected branch not found")
+		return
+	}
+	if err != nil {
+		log.Error("Failed to unprotect branch", "repo", repo.Name, "pattern", pattern, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to unprotect branch")
+		return
+	}
+	audit(adminActor(r), "branch.unprotect", repo.Name, "pattern="+pattern)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := store.Tokens()
+	if err != nil {
+		log.Error("Failed to list API tokens", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list tokens")
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// createTokenHandler mints an API token. The token itself is only returned in
+// this response; the store keeps a hash.
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name      string `json:"name"`
+		ReadOnly  bool   `json:"read_only"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" {
+		writeError(w, http.StatusBadRequest, "a token name is required")
+		return
+	}
+	t := apiToken{Name: body.Name, ReadOnly: body.ReadOnly}
+	if body.ExpiresIn != "" {
+		d, err := time.ParseDuration(body.ExpiresIn)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid expires_in duration")
+			return
+		}
+		expires := time.Now().Add(d).UTC()
+		t.ExpiresAt = &expires
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+	token := hex.EncodeToString(secret)
+	t, err := store.AddToken(t, hashToken(token))
+	if err != nil {
+		log.Error("Failed to store API token", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to create token")
+		return
+	}
+	audit(adminActor(r), "token.create", "", "name="+t.Name)
+	writeJSON(w, http.StatusCreated, struct {
+		apiToken
+		Token string `json:"token"`
+	}{t, token})
+}
+
+func deleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid token id")
+		return
+	}
+	err = store.DeleteToken(id)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	if err != nil {
+		log.Error("Failed to delete API token", "id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete token")
+		return
+	}
+	audit(adminActor(r), "token.delete", "", "id="+r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	limit, before, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	repo := r.URL.Query().Get("repo")
+	if repo != "" {
+		repo = resolveRepo(repo)
+	}
+	entries, err := store.AuditEntries(repo, r.URL.Query().Get("action"), before, limit)
+	if err != nil {
+		log.Error("Failed to read audit log", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to read audit log")
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// activityHandler serves the server-wide feed, or one repository's feed when
+// the route has a {name}.
+func activityHandler(w http.ResponseWriter, r *http.Request) {
+	var repo string
+	if r.PathValue("name") != "" {
+		record, ok := lookupRepoRecord(w, r)
+		if !ok {
+			return
+		}
+		repo = record.Name
+	}
+	limit, before, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+			return
+		}
+		since = t
+	}
+	events, err := store.Activity(repo, since, before, limit)
+	if err != nil {
+		log.Error("Failed to read activity", "repo", repo, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to read activity")
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func reconcileBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	results, err := reconcileBackups()
+	if err != nil {
+		log.Error("Failed to reconcile backups", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to reconcile backups")
+		return
+	}
+	audit(adminActor(r), "backups.reconcile", "", "")
+	if results == nil {
+		results = []backupReconcileResult{}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// pageParams parses the limit and before query parameters shared by the
+// paginated endpoints.
+func pageParams(w http.ResponseWriter, r *http.Request) (limit int, before int64, ok bool) {
+	q := r.URL.Query()
+	limit = 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid before id")
+			return 0, 0, false
+		}
+		before = n
+	}
+	return limit, before, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+var (
+	errAliasExists   = errors.New("a repository with that name already exists")
+	errAliasNotFound = errors.New("alias not found")
+)
+
+type aliasStore struct {
+	mu      sync.RWMutex
+	db      *metadataStore
+	aliases map[string]string
+}
+
+var aliases = &aliasStore{aliases: map[string]string{}}
+
+// loadAliases reads aliases from the metadata store, first importing the
+// aliases.json file used by earlier versions if it is still present.
+func loadAliases(db *metadataStore, legacyPath string) (*aliasStore, error) {
+	if err := importLegacyAliases(db, legacyPath); err != nil {
+		return nil, err
+	}
+	list, err := db.Aliases()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aliases: %w", err)
+	}
+	return &aliasStore{db: db, aliases: list}, nil
+}
+
+func importLegacyAliases(db *metadataStore, path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var legacy map[string]string
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for alias, repo := range legacy {
+		if !repoExists(repo) {
+			log.Warn("Skipping alias for missing repository", "alias", alias, "repo", repo)
+			continue
+		}
+		if err := db.SetAlias(alias, repo); err != nil {
+			return fmt.Errorf("failed to import alias %s: %w", alias, err)
+		}
+	}
+	log.Info("Imported aliases into the database", "count", len(legacy), "file", path)
+	return os.Rename(path, path+".imported")
+}
+
+// reload replaces the cached aliases with the ones in the database.
+func (s *aliasStore) reload() error {
+	list, err := s.db.Aliases()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.aliases = list
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *aliasStore) Lookup(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	repo, ok := s.aliases[aliasKey(name)]
+	return repo, ok
+}
+
+func (s *aliasStore) Resolve(name string) string {
+	if repo, ok := s.Lookup(name); ok {
+		return repo
+	}
+	return name
+}
+
+func (s *aliasStore) List() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make(map[string]string, len(s.aliases))
+	for alias, repo := range s.aliases {
+		list[alias] = repo
+	}
+	return list
+}
+
+func (s *aliasStore) Set(alias, repo string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alias = aliasKey(alias)
+	repo = normalizeRepoName(repo)
+	if canonical, ok := s.aliases[aliasKey(repo)]; ok {
+		repo = canonical
+	}
+	if alias == repo || repoExists(alias) {
+		return errAliasExists
+	}
+	if !repoExists(repo) {
+		return fmt.Errorf("repository %q does not exist", repo)
+	}
+
+	if err := s.db.SetAlias(alias, repo); err != nil {
+		return err
+	}
+	s.aliases[alias] = repo
+	return nil
+}
+
+func (s *aliasStore) Delete(alias string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alias = aliasKey(alias)
+	if _, ok := s.aliases[alias]; !ok {
+		return errAliasNotFound
+	}
+	if err := s.db.DeleteAlias(alias); err != nil {
+		return err
+	}
+	delete(s.aliases, alias)
+	return nil
+}
+
+func aliasKey(name string) string {
+	if config.RepoNameCase == repoNameCaseInsensitive {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+func repoExists(repo string) bool {
+	info, err := os.Stat(repoDirPath(repo))
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// With GIT_SERVER_CREATE_APPROVAL set, a push to an unknown repository
+// records a creation request and is rejected until an admin approves it.
+
+var errNoRepoRequest = errors.New("no pending creation request for that repository")
+
+// requestRepoCreation records a creation request for repo on behalf of key
+// and returns the message shown to the pusher.
+func requestRepoCreation(repo string, key ssh.PublicKey) string {
+	fingerprint := gossh.FingerprintSHA256(key)
+	authKey, _ := lookupKey(repo, key)
+	req := repoRequest{Name: repo, Owner: authKey.ID, RequestedBy: fingerprint, RequestedAt: time.Now()}
+	created, err := store.AddRepoRequest(req)
+	if err != nil {
+		sshLog.Error("Failed to record creation request", "repo", repo, "error", err)
+		return "failed to request repository creation"
+	}
+	if created {
+		sshLog.Info("Repository creation awaiting approval", "repo", repo, "owner", req.Owner, "fingerprint", fingerprint)
+		audit(fingerprint, "repo.request", repo, "owner="+req.Owner)
+	}
+	return fmt.Sprintf("creation of %s is awaiting approval; push again once an admin has approved it", repo)
+}
+
+// approveRepoRequest creates the requested repository, optionally under
+// another name or owner. The repository is created empty unless a template
+// is given, so the requester's push applies cleanly.
+func approveRepoRequest(name, newName, owner, template, actor string) (string, error) {
+	req, err := store.RepoRequest(normalizeRepoName(name))
+	if errors.Is(err, errNotFound) {
+		return "", errNoRepoRequest
+	}
+	if err != nil {
+		return "", err
+	}
+	if newName == "" {
+		newName = req.Name
+	}
+	if owner == "" {
+		owner = req.Owner
+	}
+	repo, err := initRepo(newName, owner, template, actor)
+	if err != nil {
+		return repo, err
+	}
+	if repo != req.Name {
+		if err := store.DeleteRepoRequest(req.Name); err != nil && !errors.Is(err, errNotFound) {
+			log.Error("Failed to remove creation request", "repo", req.Name, "error", err)
+		}
+	}
+	log.Info("Repository creation approved", "repo", repo, "requested", req.Name, "owner", owner)
+	audit(actor, "repo.approve", repo, fmt.Sprintf("requested=%s requested_by=%s owner=%s", req.Name, req.RequestedBy, owner))
+	return repo, nil
+}
+
+func rejectRepoRequest(name, actor string) error {
+	repo := normalizeRepoName(name)
+	err := store.DeleteRepoRequest(repo)
+	if errors.Is(err, errNotFound) {
+		return errNoRepoRequest
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("Repository creation rejected", "repo", repo)
+	audit(actor, "repo.reject", repo, "")
+	return nil
+}
+
+func approveCommand(sess ssh.Session, args []string) {
+	if !isAdminKey(sess.PublicKey()) {
+		wish.Fatalln(sess, "approve is restricted to admin keys")
+		return
+	}
+	if len(args) > 3 {
+		wish.Fatalln(sess, "usage: approve [<repo> [owner [new-name]]]")
+		return
+	}
+	if len(args) == 0 {
+		requests, err := store.RepoRequests()
+		if err != nil {
+			sshLog.Error("Failed to list creation requests", "error", err)
+			wish.Fatalln(sess, "failed to list creation requests")
+			return
+		}
+		if len(requests) == 0 {
+			fmt.Fprintln(sess, "No repositories are awaiting approval")
+			return
+		}
+		for _, req := range requests {
+			fmt.Fprintf(sess, "%-30s owner %s, requested %s by %s\n", req.Name, req.Owner, req.RequestedAt.Format(time.RFC3339), req.RequestedBy)
+		}
+		return
+	}
+	owner, newName := "", ""
+	if len(args) >= 2 {
+		owner = args[1]
+	}
+	if len(args) == 3 {
+		newName = args[2]
+	}
+	repo, err := approveRepoRequest(args[0], newName, owner, "", gossh.FingerprintSHA256(sess.PublicKey()))
+	if err != nil {
+		if !errors.Is(err, errNoRepoRequest) && !errors.Is(err, errInvalidRepo) && !errors.Is(err, errRepoExists) {
+			sshLog.Error("Repository approval failed", "repo", args[0], "error", err)
+			err = errors.New("failed to create repository")
+		}
+		wish.Fatalln(sess, err)
+		return
+	}
+	fmt.Fprintf(sess, "Created %s\ngit clone ssh://%s/%s\n", repo, cloneHost(), repo)
+}
+
+func rejectCommand(sess ssh.Session, args []string) {
+	if !isAdminKey(sess.PublicKey()) {
+		wish.Fatalln(sess, "reject is restricted to admin keys")
+		return
+	}
+	if len(args) != 1 {
+		wish.Fatalln(sess, "usage: reject <repo>")
+		return
+	}
+	if err := rejectRepoRequest(args[0], gossh.FingerprintSHA256(sess.PublicKey())); err != nil {
+		if !errors.Is(err, errNoRepoRequest) {
+			sshLog.Error("Repository rejection failed", "repo", args[0], "error", err)
+			err = errors.New("failed to reject creation request")
+		}
+		wish.Fatalln(sess, err)
+		return
+	}
+	fmt.Fprintf(sess, "Rejected %s\n", normalizeRepoName(args[0]))
+}
+
+func listRepoRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	requests, err := store.RepoRequests()
+	if err != nil {
+		log.Error("Failed to list creation requests", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list creation requests")
+		return
+	}
+	writeJSON(w, http.StatusOK, requests)
+}
+
+func approveRepoRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name     string `json:"name"`
+		Owner    string `json:"owner"`
+		Template string `json:"template"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	repo, err := approveRepoRequest(r.PathValue("name"), body.Name, body.Owner, body.Template, adminActor(r))
+	switch {
+	case errors.Is(err, errNoRepoRequest):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errInvalidRepo), errors.Is(err, errUnknownTemplate):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errRepoExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		log.Error("Repository approval failed", "repo", r.PathValue("name"), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to create repository")
+	default:
+		writeJSON(w, http.StatusCreated, map[string]string{"name": repo})
+	}
+}
+
+func rejectRepoRequestHandler(w http.ResponseWriter, r *http.Request) {
+	err := rejectRepoRequest(r.PathValue("name"), adminActor(r))
+	switch {
+	case errors.Is(err, errNoRepoRequest):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		log.Error("Repository rejection failed", "repo", r.PathValue("name"), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to reject creation request")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
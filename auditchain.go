@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/charmbracelet/log"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Every audit entry stores a hash over its fields and the previous entry's
+// hash, so editing, removing or reordering an entry breaks the chain from
+// that point on. With GIT_SERVER_AUDIT_SIGNING_KEY set, the head of the chain
+// is signed periodically; a rewritten chain can't be signed again without
+// the key.
+
+// auditSigner signs the audit chain, or is nil when signing is disabled.
+var auditSigner gossh.Signer
+
+// auditHash returns the chain hash of e following prev.
+func auditHash(prev string, e auditEntry) string {
+	data, _ := json.Marshal([]string{prev, e.Time.UTC().Format(time.RFC3339Nano), e.Actor, e.Action, e.Repo, e.Details})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditSignedMessage is what a signature covers: the chain up to lastID.
+func auditSignedMessage(lastID int64, hash string) []byte {
+	return fmt.Appendf(nil, "git-server audit chain\n%d\n%s\n", lastID, hash)
+}
+
+func loadAuditSigner(path string) (gossh.Signer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit signing key: %w", err)
+	}
+	signer, err := gossh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse audit signing key: %w", err)
+	}
+	return signer, nil
+}
+
+// signAuditLog signs the chain head if entries were added since the last
+// signature.
+func signAuditLog() error {
+	last, err := store.LastAudit()
+	if errors.Is(err, errNotFound) || (err == nil && last.Hash == "") {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	signed, err := store.LastAuditSignedID()
+	if err != nil {
+		return err
+	}
+	if last.ID <= signed {
+		return nil
+	}
+	sig, err := auditSigner.Sign(rand.Reader, auditSignedMessage(last.ID, last.Hash))
+	if err != nil {
+		return fmt.Errorf("failed to sign audit log: %w", err)
+	}
+	err = store.AddAuditSignature(auditSignature{
+		LastID:    last.ID,
+		Hash:      last.Hash,
+		Key:       gossh.FingerprintSHA256(auditSigner.PublicKey()),
+		Signature: base64.StdEncoding.EncodeToString(gossh.Marshal(sig)),
+		SignedAt:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store audit signature: %w", err)
+	}
+	log.Debug("Signed audit log", "last_id", last.ID, "entries", last.ID-signed)
+	return nil
+}
+
+func runAuditSigner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := signAuditLog(); err != nil {
+			log.Error("Failed to sign audit log", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// auditVerification is the outcome of checking the audit chain and its
+// signatures.
+type auditVerification struct {
+	OK      bool  `json:"ok"`
+	Entries int64 `json:"entries"`
+	// Entries written before chaining was introduced carry no hash.
+	Unchained    int64    `json:"unchained"`
+	Signatures   int      `json:"signatures"`
+	LastSignedID int64    `json:"last_signed_id"`
+	Unsigned     int64    `json:"unsigned"`
+	Problems     []string `json:"problems"`
+}
+
+// verifyAuditLog recomputes the audit chain and checks every signature
+// against key. With a nil key the signatures are only matched to the chain.
+func verifyAuditLog(key gossh.PublicKey) (auditVerification, error) {
+	v := auditVerification{Problems: []string{}}
+	sigs, err := store.AuditSignatures()
+	if err != nil {
+		return v, fmt.Errorf("failed to read audit signatures: %w", err)
+	}
+	v.Signatures = len(sigs)
+	byLastID := map[int64][]auditSignature{}
+	for _, sig := range sigs {
+		byLastID[sig.LastID] = append(byLastID[sig.LastID], sig)
+	}
+
+	prev, chained := "", false
+	err = store.AuditChain(func(e auditEntry) error {
+		v.Entries++
+		if e.Hash == "" && !chained {
+			v.Unchained++
+			return nil
+		}
+		chained = true
+		if e.Hash != auditHash(prev, e) {
+			v.problem("entry %d does not match the chain: it was modified, or the entry before it was removed", e.ID)
+		}
+		// Continue from the stored hash so that one edit is reported once.
+		// A chain rewritten from there on is caught by the signatures.
+		prev = e.Hash
+		v.Unsigned++
+		for _, sig := range byLastID[e.ID] {
+			v.checkSignature(sig, e.Hash, key)
+			v.LastSignedID = e.ID
+			v.Unsigned = 0
+		}
+		delete(byLastID, e.ID)
+		return nil
+	})
+	if err != nil {
+		return v, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	for id := range byLastID {
+		v.problem("signature covers entry %d, which is missing from the audit log", id)
+	}
+	v.OK = len(v.Problems) == 0
+	return v, nil
+}
+
+func (v *auditVerification) problem(format string, args ...any) {
+	v.Problems = append(v.Problems, fmt.Sprintf(format, args...))
+}
+
+func (v *auditVerification) checkSignature(sig auditSignature, hash string, key gossh.PublicKey) {
+	if sig.Hash != hash {
+		v.problem("signature %d does not match the chain at entry %d", sig.ID, sig.LastID)
+		return
+	}
+	if key == nil {
+		return
+	}
+	if sig.Key != gossh.FingerprintSHA256(key) {
+		v.problem("signature %d was made by %s, not by the verification key", sig.ID, sig.Key)
+		return
+	}
+	blob, err := base64.StdEncoding.DecodeString(sig.Signature)
+	var s gossh.Signature
+	if err == nil {
+		err = gossh.Unmarshal(blob, &s)
+	}
+	if err == nil {
+		err = key.Verify(auditSignedMessage(sig.LastID, sig.Hash), &s)
+	}
+	if err != nil {
+		v.problem("signature %d over entry %d is invalid: %v", sig.ID, sig.LastID, err)
+	}
+}
+
+// runVerifyAudit implements `git-server verify-audit [public-key-file]`. The
+// public key defaults to that of GIT_SERVER_AUDIT_SIGNING_KEY.
+func runVerifyAudit(args []string) error {
+	var key gossh.PublicKey
+	switch {
+	case len(args) > 1:
+		return errors.New("usage: git-server verify-audit [public-key-file]")
+	case len(args) == 1:
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to read public key: %w", err)
+		}
+		if key, _, _, _, err = gossh.ParseAuthorizedKey(data); err != nil {
+			return fmt.Errorf("failed to parse public key: %w", err)
+		}
+	default:
+		signer, err := loadAuditSigner(config.AuditSigningKey)
+		if err != nil {
+			return err
+		}
+		if signer != nil {
+			key = signer.PublicKey()
+		}
+	}
+	if key == nil {
+		log.Warn("No verification key; signatures are matched to the chain but not checked")
+	}
+
+	v, err := verifyAuditLog(key)
+	if err != nil {
+		return err
+	}
+	for _, p := range v.Problems {
+		log.Error("Audit log: " + p)
+	}
+	log.Info("Audit log verified", "ok", v.OK, "entries", v.Entries, "unchained", v.Unchained,
+		"signatures", v.Signatures, "last_signed_id", v.LastSignedID, "unsigned", v.Unsigned)
+	if !v.OK {
+		return errors.New("the audit log has been tampered with")
+	}
+	return nil
+}
+
+func verifyAuditHandler(w http.ResponseWriter, r *http.Request) {
+	var key gossh.PublicKey
+	if auditSigner != nil {
+		key = auditSigner.PublicKey()
+	}
+	v, err := verifyAuditLog(key)
+	if err != nil {
+		log.Error("Failed to verify audit log", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to verify audit log")
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
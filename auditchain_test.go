@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestAuditHash(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	e := auditEntry{Time: at, Actor: "admin", Action: "repo.delete", Repo: "demo", Details: "trash=demo-1"}
+	h := auditHash("", e)
+	if len(h) != 64 {
+		t.Fatalf("hash %q is not hex SHA-256", h)
+	}
+	if auditHash("", e) != h {
+		t.Fatal("hash is not deterministic")
+	}
+
+	local := e
+	local.Time = at.In(time.FixedZone("CET", 3600))
+	if auditHash("", local) != h {
+		t.Error("hash depends on the time zone of the entry")
+	}
+	if auditHash(h, e) == h {
+		t.Error("hash ignores the previous hash")
+	}
+	changes := map[string]func(*auditEntry){
+		"time":    func(e *auditEntry) { e.Time = e.Time.Add(time.Nanosecond) },
+		"actor":   func(e *auditEntry) { e.Actor = "someone" },
+		"action":  func(e *auditEntry) { e.Action = "repo.create" },
+		"repo":    func(e *auditEntry) { e.Repo = "other" },
+		"details": func(e *auditEntry) { e.Details = "" },
+	}
+	for field, change := range changes {
+		changed := e
+		change(&changed)
+		if auditHash("", changed) == h {
+			t.Errorf("hash ignores the %s", field)
+		}
+	}
+	// Fields must not run into each other.
+	a := auditEntry{Time: at, Actor: "ab", Action: "c"}
+	b := auditEntry{Time: at, Actor: "a", Action: "bc"}
+	if auditHash("", a) == auditHash("", b) {
+		t.Error("hash does not separate fields")
+	}
+}
+
+func addTestAudit(t *testing.T, n int) {
+	t.Helper()
+	for i := range n {
+		if err := store.AddAudit(auditEntry{Time: time.Now(), Actor: "admin", Action: "repo.create", Repo: "demo", Details: strings.Repeat("x", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newAuditTestSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	useTestStore(t)
+	addTestAudit(t, 3)
+	v, err := verifyAuditLog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.OK || v.Entries != 3 || v.Unsigned != 3 {
+		t.Fatalf("intact chain: %+v", v)
+	}
+
+	if _, err := store.db.Exec(`UPDATE audit_log SET details = 'edited' WHERE id = 2`); err != nil {
+		t.Fatal(err)
+	}
+	v, err = verifyAuditLog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.OK || len(v.Problems) != 1 || !strings.Contains(v.Problems[0], "entry 2 ") {
+		t.Fatalf("edited entry: %+v", v)
+	}
+}
+
+func TestVerifyAuditLogRemovedEntry(t *testing.T) {
+	useTestStore(t)
+	addTestAudit(t, 3)
+	if _, err := store.db.Exec(`DELETE FROM audit_log WHERE id = 2`); err != nil {
+		t.Fatal(err)
+	}
+	v, err := verifyAuditLog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.OK || len(v.Problems) != 1 || !strings.Contains(v.Problems[0], "entry 3 ") {
+		t.Fatalf("removed entry: %+v", v)
+	}
+}
+
+func TestVerifyAuditLogSignatures(t *testing.T) {
+	useTestStore(t)
+	saved := auditSigner
+	t.Cleanup(func() { auditSigner = saved })
+	auditSigner = newAuditTestSigner(t)
+
+	addTestAudit(t, 2)
+	if err := signAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	addTestAudit(t, 1)
+	v, err := verifyAuditLog(auditSigner.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.OK || v.Signatures != 1 || v.LastSignedID != 2 || v.Unsigned != 1 {
+		t.Fatalf("signed chain: %+v", v)
+	}
+
+	v, err = verifyAuditLog(newAuditTestSigner(t).PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.OK {
+		t.Fatalf("signature by another key was accepted: %+v", v)
+	}
+
+	// Rewriting the chain from the signed entry on leaves every hash
+	// consistent, but no longer matches the signature.
+	var prev string
+	if err := store.db.QueryRow(`SELECT hash FROM audit_log WHERE id = 1`).Scan(&prev); err != nil {
+		t.Fatal(err)
+	}
+	var at time.Time
+	if err := store.db.QueryRow(`SELECT time FROM audit_log WHERE id = 2`).Scan(&at); err != nil {
+		t.Fatal(err)
+	}
+	forged := auditEntry{Time: at, Actor: "admin", Action: "repo.create", Repo: "demo", Details: "forged"}
+	hash := auditHash(prev, forged)
+	if _, err := store.db.Exec(`UPDATE audit_log SET details = ?, hash = ? WHERE id = 2`, forged.Details, hash); err != nil {
+		t.Fatal(err)
+	}
+	v, err = verifyAuditLog(auditSigner.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.OK {
+		t.Fatalf("rewritten chain was accepted: %+v", v)
+	}
+}
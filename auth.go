@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish/git"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Authorizer decides which access a key has to a repository and identifies
+// the key for logging and self-service commands.
+type Authorizer interface {
+	Authorize(repo string, key ssh.PublicKey) (authorizedKey, git.AccessLevel)
+}
+
+var authorizer Authorizer = httpAuthorizer{}
+
+func newAuthorizer() (Authorizer, error) {
+	switch config.AuthBackend {
+	case "http":
+		return httpAuthorizer{}, nil
+	case "ldap":
+		return newLDAPAuthorizer()
+	default:
+		return nil, fmt.Errorf("unknown authorization backend %q, expected http or ldap", config.AuthBackend)
+	}
+}
+
+// lookupKey asks the authorizer for the key's access, granting read access to
+// public repositories regardless of the answer.
+func lookupKey(repo string, key ssh.PublicKey) (authorizedKey, git.AccessLevel) {
+	if keyRevoked(gossh.FingerprintSHA256(key)) {
+		authLog.Debug("Authorization decision", "repo", repo, "fingerprint", gossh.FingerprintSHA256(key), "access", accessLevelName(git.NoAccess), "revoked", true)
+		return authorizedKey{}, git.NoAccess
+	}
+	if authKey, access, ok := guestAccess(repo, key); ok {
+		authLog.Debug("Authorization decision", "repo", repo, "fingerprint", gossh.FingerprintSHA256(key), "key_id", authKey.ID, "access", accessLevelName(access), "guest", true)
+		rememberKeyID(gossh.FingerprintSHA256(key), authKey.ID)
+		return authKey, access
+	}
+	authKey, access := authorizer.Authorize(repo, key)
+	if access == git.NoAccess && isPublicRepo(repo) {
+		authLog.Debug("Granting read access to public repository", "repo", repo)
+		access = git.ReadOnlyAccess
+	}
+	authLog.Debug("Authorization decision", "repo", repo, "fingerprint", gossh.FingerprintSHA256(key), "key_id", authKey.ID, "access", accessLevelName(access))
+	rememberKeyID(gossh.FingerprintSHA256(key), authKey.ID)
+	return authKey, access
+}
+
+func isKeyAuthorized(repo string, key ssh.PublicKey) bool {
+	_, access := lookupKey(repo, key)
+	return access > git.NoAccess
+}
+
+func parseAccessLevel(name string) (git.AccessLevel, error) {
+	switch name {
+	case "read-only":
+		return git.ReadOnlyAccess, nil
+	case "read-write":
+		return git.ReadWriteAccess, nil
+	case "admin":
+		return git.AdminAccess, nil
+	case "none":
+		return git.NoAccess, nil
+	default:
+		return git.NoAccess, fmt.Errorf("unknown access level %q", name)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	authRequestDuration = newHistogramVec("git_server_auth_request_duration_seconds", "Latency of calls to the authorization backend.", authBuckets, "backend", "result")
+	authRequestsTotal   = newCounterVec("git_server_auth_requests_total", "Calls to the authorization backend by result.", "backend", "result")
+	authErrorsTotal     = newCounterVec("git_server_auth_errors_total", "Failed calls to the authorization backend by error class.", "backend", "class")
+	authErrorRatio      = newGaugeVec("git_server_auth_error_ratio", "Share of failed authorization calls in the last summary interval.", "backend")
+)
+
+var authBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// authAlertMinRequests keeps a single failure on an idle server from raising
+// an alert, and a quiet interval from clearing one.
+const authAlertMinRequests = 5
+
+const (
+	authResultOK     = "ok"
+	authResultDenied = "denied"
+	authResultError  = "error"
+)
+
+// authWindow aggregates calls to one backend since the last summary.
+type authWindow struct {
+	requests int
+	errors   int
+	total    time.Duration
+	max      time.Duration
+	classes  map[string]int
+}
+
+type authSummary struct {
+	mu       sync.Mutex
+	windows  map[string]*authWindow
+	alerting map[string]bool
+}
+
+var authStats = &authSummary{windows: map[string]*authWindow{}, alerting: map[string]bool{}}
+
+// observeAuth records one call to an authorization backend. class names the
+// failure and is only used when result is authResultError.
+func observeAuth(backend string, start time.Time, result, class string) {
+	elapsed := time.Since(start)
+	authRequestDuration.Observe(elapsed.Seconds(), backend, result)
+	authRequestsTotal.Inc(backend, result)
+	if result == authResultError {
+		authErrorsTotal.Inc(backend, class)
+	}
+
+	authStats.mu.Lock()
+	defer authStats.mu.Unlock()
+	w := authStats.windows[backend]
+	if w == nil {
+		w = &authWindow{classes: map[string]int{}}
+		authStats.windows[backend] = w
+	}
+	w.requests++
+	w.total += elapsed
+	w.max = max(w.max, elapsed)
+	if result == authResultError {
+		w.errors++
+		w.classes[class]++
+	}
+}
+
+// authErrorClass tells timeouts apart from other failures; fallback names
+// everything else.
+func authErrorClass(err error, fallback string) string {
+	var netErr net.Error
+	var proxyErr *proxyError
+	if errors.As(err, &proxyErr) {
+		return "proxy"
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return fallback
+}
+
+func runAuthSummary(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			authStats.summarize()
+		}
+	}
+}
+
+// summarize logs one line per backend that saw traffic, raises an alert when
+// the error ratio crosses GIT_SERVER_AUTH_ALERT_ERROR_RATIO and clears it once
+// the ratio drops again.
+func (s *authSummary) summarize() {
+	s.mu.Lock()
+	windows := s.windows
+	s.windows = map[string]*authWindow{}
+	backends := map[string]bool{}
+	for backend := range windows {
+		backends[backend] = true
+	}
+	for backend := range s.alerting {
+		backends[backend] = true
+	}
+	s.mu.Unlock()
+
+	for _, backend := range sortedKeys(backends) {
+		w := windows[backend]
+		if w == nil {
+			w = &authWindow{classes: map[string]int{}}
+		}
+		ratio := 0.0
+		if w.requests > 0 {
+			ratio = float64(w.errors) / float64(w.requests)
+			authLog.Info("Authorization backend summary",
+				"backend", backend,
+				"requests", w.requests,
+				"errors", w.errors,
+				"error_ratio", fmt.Sprintf("%.3f", ratio),
+				"avg", (w.total / time.Duration(w.requests)).Round(time.Millisecond),
+				"max", w.max.Round(time.Millisecond),
+				"classes", w.classes,
+			)
+		}
+		authErrorRatio.Set(ratio, backend)
+
+		s.mu.Lock()
+		wasAlerting := s.alerting[backend]
+		isAlerting := wasAlerting
+		if w.requests >= authAlertMinRequests {
+			isAlerting = ratio >= config.AuthAlertErrorRatio
+		}
+		if isAlerting {
+			s.alerting[backend] = true
+		} else {
+			delete(s.alerting, backend)
+		}
+		s.mu.Unlock()
+
+		switch {
+		case isAlerting && !wasAlerting:
+			authLog.Warn("Authorization backend error ratio above threshold", "backend", backend, "error_ratio", fmt.Sprintf("%.3f", ratio), "threshold", config.AuthAlertErrorRatio, "classes", w.classes)
+			sendAuthAlert(backend, "firing", ratio, w)
+		case wasAlerting && !isAlerting:
+			authLog.Info("Authorization backend error ratio recovered", "backend", backend, "error_ratio", fmt.Sprintf("%.3f", ratio))
+			sendAuthAlert(backend, "resolved", ratio, w)
+		}
+	}
+}
+
+type authAlert struct {
+	Backend    string         `json:"backend"`
+	Status     string         `json:"status"`
+	ErrorRatio float64        `json:"error_ratio"`
+	Threshold  float64        `json:"threshold"`
+	Requests   int            `json:"requests"`
+	Errors     int            `json:"errors"`
+	Classes    map[string]int `json:"classes"`
+	Time       time.Time      `json:"time"`
+}
+
+// sendAuthAlert posts the alert to GIT_SERVER_AUTH_ALERT_URL, if configured.
+func sendAuthAlert(backend, status string, ratio float64, w *authWindow) {
+	if config.AuthAlertURL == "" {
+		return
+	}
+	body, err := json.Marshal(authAlert{
+		Backend:    backend,
+		Status:     status,
+		ErrorRatio: ratio,
+		Threshold:  config.AuthAlertErrorRatio,
+		Requests:   w.requests,
+		Errors:     w.errors,
+		Classes:    w.classes,
+		Time:       time.Now().UTC(),
+	})
+	if err != nil {
+		authLog.Error("Failed to encode authorization alert", "error", err)
+		return
+	}
+	client := newHTTPClient(egressAuth, config.HTTPTimeout)
+	resp, err := client.Post(config.AuthAlertURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		authLog.Warn("Failed to send authorization alert", "url", config.AuthAlertURL, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		authLog.Warn("Authorization alert rejected", "url", config.AuthAlertURL, "status", resp.Status)
+	}
+}
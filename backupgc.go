@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var backupReconciledTotal = newCounterVec("git_server_backup_reconciled_total", "Backup artifacts handled by the reconciler, by action.", "action")
+
+// backupSettleTime leaves artifacts without an upload record alone while the
+// post-receive hook may still be uploading them.
+const backupSettleTime = 10 * time.Minute
+
+// backupUploadTimeout matches the hook's curl --max-time.
+const backupUploadTimeout = 30 * time.Second
+
+type backupReconcileResult struct {
+	Repo       string   `json:"repo"`
+	Reuploaded []string `json:"reuploaded,omitempty"`
+	Failed     []string `json:"failed,omitempty"`
+	Deleted    []string `json:"deleted,omitempty"`
+}
+
+var reconcileMu sync.Mutex
+
+func runBackupReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := reconcileBackups(); err != nil {
+				backupLog.Error("Backup reconciliation failed", "error", err)
+			}
+		}
+	}
+}
+
+// reconcileBackups compares the artifacts in every backup directory with the
+// upload records. Artifacts that were never delivered are uploaded again,
+// failed uploads whose artifact is gone are rebuilt from the repository, and
+// delivered artifacts are deleted once GIT_SERVER_BACKUP_RETENTION has passed.
+func reconcileBackups() ([]backupReconcileResult, error) {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+
+	entries, err := os.ReadDir(config.BackupDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var results []backupReconcileResult
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		result, err := reconcileRepoBackups(entry.Name())
+		if err != nil {
+			backupLog.Error("Failed to reconcile backups", "repo", entry.Name(), "error", err)
+			continue
+		}
+		if len(result.Reuploaded)+len(result.Failed)+len(result.Deleted) > 0 {
+			backupLog.Info("Reconciled backups", "repo", result.Repo, "reuploaded", len(result.Reuploaded), "failed", len(result.Failed), "deleted", len(result.Deleted))
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func reconcileRepoBackups(repo string) (backupReconcileResult, error) {
+	result := backupReconcileResult{Repo: repo}
+	records, err := readUploadLog(repo)
+	if err != nil {
+		return result, err
+	}
+	dir := filepath.Join(config.BackupDir, repo)
+	artifacts, err := filepath.Glob(filepath.Join(dir, "*.zip"))
+	if err != nil {
+		return result, err
+	}
+
+	onDisk := map[string]bool{}
+	for _, artifact := range artifacts {
+		commit := strings.TrimSuffix(filepath.Base(artifact), ".zip")
+		onDisk[commit] = true
+		record, ok := records[commit]
+		switch {
+		case ok && record.Status == "ok":
+			if config.BackupRetention > 0 && time.Since(record.Time) > config.BackupRetention {
+				if err := os.Remove(artifact); err != nil {
+					backupLog.Warn("Failed to delete delivered backup", "repo", repo, "commit", commit, "error", err)
+					continue
+				}
+				backupReconciledTotal.Inc("deleted")
+				result.Deleted = append(result.Deleted, commit)
+			}
+		case !ok:
+			info, err := os.Stat(artifact)
+			if err != nil || time.Since(info.ModTime()) < backupSettleTime {
+				continue
+			}
+			reuploadBackup(&result, repo, commit, artifact)
+		default:
+			reuploadBackup(&result, repo, commit, artifact)
+		}
+	}
+
+	for commit, record := range records {
+		if record.Status == "ok" || onDisk[commit] {
+			continue
+		}
+		artifact, err := filepath.Abs(filepath.Join(dir, commit+".zip"))
+		if err != nil {
+			return result, err
+		}
+		if err := exec.Command("git", "-C", repoDirPath(repo), "archive", commit, "--format=zip", "-o", artifact).Run(); err != nil {
+			backupLog.Debug("Cannot rebuild backup artifact", "repo", repo, "commit", commit, "error", err)
+			continue
+		}
+		reuploadBackup(&result, repo, commit, artifact)
+	}
+	return result, nil
+}
+
+func reuploadBackup(result *backupReconcileResult, repo, commit, artifact string) {
+	status := "ok"
+	if err := uploadBackup(repo, commit, artifact); err != nil {
+		status = "failed"
+		backupLog.Warn("Backup re-upload failed", "repo", repo, "commit", commit, "error", err)
+		backupReconciledTotal.Inc("reupload_failed")
+		result.Failed = append(result.Failed, commit)
+	} else {
+		backupReconciledTotal.Inc("reuploaded")
+		result.Reuploaded = append(result.Reuploaded, commit)
+	}
+	if err := appendUploadRecord(repo, commit, status); err != nil {
+		backupLog.Error("Failed to record upload", "repo", repo, "commit", commit, "error", err)
+	}
+}
+
+// uploadBackup sends an artifact the same way the post-receive hook does.
+func uploadBackup(repo, commit, artifact string) error {
+	f, err := os.Open(artifact)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		form.WriteField("repo", repo)
+		form.WriteField("commit", commit)
+		part, err := form.CreateFormFile("file", filepath.Base(artifact))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	client := newHTTPClient(egressBackup, backupUploadTimeout)
+	resp, err := client.Post(backupServer(repo)+"/upload", form.FormDataContentType(), pr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func appendUploadRecord(repo, commit, status string) error {
+	f, err := os.OpenFile(filepath.Join(config.BackupDir, repo, "uploads.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%d %s %s\n", time.Now().Unix(), commit, status)
+	return err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type uploadRecord struct {
+	Time   time.Time
+	Commit string
+	Status string
+}
+
+type backupSummary struct {
+	Repo           string
+	Artifacts      int
+	Pending        int
+	FailedUploads  []uploadRecord
+	LastUploadTime time.Time
+}
+
+// readUploadLog returns the latest upload record per commit from the
+// uploads.log written by the post-receive hook.
+func readUploadLog(repo string) (map[string]uploadRecord, error) {
+	records := map[string]uploadRecord{}
+	f, err := os.Open(filepath.Join(config.BackupDir, repo, "uploads.log"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		ts, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		records[fields[1]] = uploadRecord{Time: time.Unix(ts, 0), Commit: fields[1], Status: fields[2]}
+	}
+	return records, scanner.Err()
+}
+
+// logBackupResults reports the uploads the post-receive hook recorded since
+// the push started.
+func logBackupResults(repo string, since time.Time) {
+	records, err := readUploadLog(repo)
+	if err != nil {
+		backupLog.Error("Failed to read upload log", "repo", repo, "error", err)
+		return
+	}
+	since = since.Truncate(time.Second)
+	for _, record := range records {
+		if record.Time.Before(since) {
+			continue
+		}
+		if record.Status == "ok" {
+			backupLog.Debug("Backup uploaded", "repo", repo, "commit", record.Commit)
+		} else if class, ok := strings.CutPrefix(record.Status, "proxy_"); ok {
+			proxyErrorsTotal.Inc(egressBackup, class)
+			backupLog.Warn("Backup upload failed at the egress proxy", "repo", repo, "commit", record.Commit, "class", class)
+		} else {
+			backupLog.Warn("Backup upload failed", "repo", repo, "commit", record.Commit, "status", record.Status)
+		}
+	}
+}
+
+func backupSummaries() ([]backupSummary, error) {
+	entries, err := os.ReadDir(config.BackupDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var summaries []backupSummary
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		repo := entry.Name()
+		records, err := readUploadLog(repo)
+		if err != nil {
+			return nil, err
+		}
+		summary := backupSummary{Repo: repo}
+		for _, record := range records {
+			if record.Status != "ok" {
+				summary.FailedUploads = append(summary.FailedUploads, record)
+			} else if record.Time.After(summary.LastUploadTime) {
+				summary.LastUploadTime = record.Time
+			}
+		}
+		sort.Slice(summary.FailedUploads, func(i, j int) bool {
+			return summary.FailedUploads[i].Time.After(summary.FailedUploads[j].Time)
+		})
+
+		artifacts, _ := filepath.Glob(filepath.Join(config.BackupDir, repo, "*.zip"))
+		summary.Artifacts = len(artifacts)
+		for _, artifact := range artifacts {
+			commit := strings.TrimSuffix(filepath.Base(artifact), ".zip")
+			if records[commit].Status != "ok" {
+				summary.Pending++
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/charmbracelet/wish/git"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type sshCommand func(sess ssh.Session, args []string)
+
+var sshCommands = map[string]sshCommand{
+	"whoami":    whoamiCommand,
+	"info":      infoCommand,
+	"log":       logCommand,
+	"show":      showCommand,
+	"create":    createCommand,
+	"transfer":  transferCommand,
+	"restore":   restoreCommand,
+	"delete":    deleteCommand,
+	"approve":   approveCommand,
+	"hostkeys":  hostkeysCommand,
+	"storage":   storageCommand,
+	"reject":    rejectCommand,
+	"undelete":  undeleteCommand,
+	"revoke":    revokeCommand,
+	"search":    searchCommand,
+	"dashboard": dashboardCommand,
+}
+
+// terminalCommands may run on a PTY: the dashboard and the paged history
+// views. Everything else, including git, is refused one.
+var terminalCommands = map[string]bool{
+	"dashboard": true,
+	"log":       true,
+	"show":      true,
+}
+
+var commandsRejectedTotal = newCounterVec("git_server_commands_rejected_total", "SSH sessions rejected before running a command, by reason.", "reason")
+
+// commandFilterMiddleware only lets git transfers and the server's own
+// commands through. A session without a command gets the repository menu
+// and never a shell.
+func commandFilterMiddleware(next ssh.Handler) ssh.Handler {
+	return func(sess ssh.Session) {
+		cmd := sess.Command()
+		_, _, isPty := sess.Pty()
+		reject := func(reason, msg string) {
+			commandsRejectedTotal.Inc(reason)
+			fingerprint := ""
+			if key := sess.PublicKey(); key != nil {
+				fingerprint = gossh.FingerprintSHA256(key)
+			}
+			sshLog.Warn("Rejected SSH command", "reason", reason, "command", sess.RawCommand(), "fingerprint", fingerprint, "remote", sess.RemoteAddr().String())
+			wish.Fatalln(sess, msg)
+		}
+
+		switch {
+		case len(cmd) == 0:
+		case isGitCommand(cmd[0]):
+			if len(cmd) != 2 {
+				reject("invalid", fmt.Sprintf("usage: %s <repo>", cmd[0]))
+				return
+			}
+			if isPty {
+				reject("pty", "git commands cannot run on a terminal; connect without -t")
+				return
+			}
+		case sshCommands[cmd[0]] != nil:
+			if isPty && !terminalCommands[cmd[0]] {
+				reject("pty", fmt.Sprintf("%s does not run on a terminal; connect without -t", cmd[0]))
+				return
+			}
+		default:
+			reject("unknown", fmt.Sprintf("unknown command %q; available commands: %s", cmd[0], strings.Join(availableCommands(), ", ")))
+			return
+		}
+		next(sess)
+	}
+}
+
+func availableCommands() []string {
+	names := make([]string, 0, len(sshCommands))
+	for name := range sshCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func commandMiddleware(next ssh.Handler) ssh.Handler {
+	return func(sess ssh.Session) {
+		cmd := sess.Command()
+		if len(cmd) == 0 {
+			next(sess)
+			return
+		}
+		handler, ok := sshCommands[cmd[0]]
+		if !ok {
+			next(sess)
+			return
+		}
+		handler(sess, cmd[1:])
+	}
+}
+
+// whoamiPageSize bounds the repositories whose access whoami checks per
+// call, each check being a call to the authorization backend.
+const whoamiPageSize = 100
+
+// whoamiCommand shows the key and its access to a page of repositories:
+//
+//	whoami [--after <repo>]
+func whoamiCommand(sess ssh.Session, args []string) {
+	after := ""
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && args[0] == "--after":
+		after = args[1]
+	default:
+		wish.Fatalln(sess, "usage: whoami [--after <repo>]")
+		return
+	}
+	key := sess.PublicKey()
+	repos, err := store.RepoNames(after, "", whoamiPageSize)
+	if err != nil {
+		sshLog.Error("Failed to list repositories", "error", err)
+		wish.Fatalln(sess, "failed to list repositories")
+		return
+	}
+
+	keyID := ""
+	var accessible []string
+	levels := map[string]git.AccessLevel{}
+	for _, repo := range repos {
+		authKey, access := lookupKey(repo, key)
+		if access == git.NoAccess {
+			continue
+		}
+		if keyID == "" {
+			keyID = authKey.ID
+		}
+		accessible = append(accessible, repo)
+		levels[repo] = access
+	}
+	if keyID == "" {
+		keyID = "unknown (key is not authorized for any of these repositories)"
+	}
+
+	fmt.Fprintf(sess, "Key ID:      %s\n", keyID)
+	fmt.Fprintf(sess, "Key type:    %s\n", key.Type())
+	fmt.Fprintf(sess, "Fingerprint: %s\n", gossh.FingerprintSHA256(key))
+	if isAdminKey(key) {
+		fmt.Fprintf(sess, "Admin:       yes\n")
+	}
+	if len(repos) == 0 {
+		fmt.Fprintf(sess, "\nNo repositories to check\n")
+		return
+	}
+	fmt.Fprintf(sess, "\nAccess to %d of %d repositories (%s to %s):\n", len(accessible), len(repos), repos[0], repos[len(repos)-1])
+	for _, repo := range accessible {
+		fmt.Fprintf(sess, "• %-40s %s\n", repo, accessLevelName(levels[repo]))
+	}
+	if len(repos) == whoamiPageSize {
+		fmt.Fprintf(sess, "\nMore repositories: whoami --after %s\n", repos[len(repos)-1])
+	}
+}
+
+func infoCommand(sess ssh.Session, args []string) {
+	if len(args) != 1 {
+		wish.Fatalln(sess, "usage: info <repo>")
+		return
+	}
+	repo := resolveRepo(args[0])
+	if !isValidRepoName(repo) {
+		wish.Fatalln(sess, "invalid repository name")
+		return
+	}
+
+	repoPath := repoDirPath(repo)
+	authKey, access := lookupKey(repo, sess.PublicKey())
+	if _, err := os.Stat(repoPath); access == git.NoAccess || err != nil {
+		wish.Fatalln(sess, "repository not found or access denied")
+		return
+	}
+
+	branches, err := repoBranches(repoPath)
+	if err != nil {
+		sshLog.Error("Failed to list branches", "repo", repo, "error", err)
+		wish.Fatalln(sess, "failed to read repository")
+		return
+	}
+	size, err := dirSize(repoPath)
+	if err != nil {
+		sshLog.Error("Failed to compute repository size", "repo", repo, "error", err)
+	}
+
+	fmt.Fprintf(sess, "Repository:   %s\n", repo)
+	fmt.Fprintf(sess, "Clone URL:    ssh://%s/%s\n", cloneHost(), repo)
+	fmt.Fprintf(sess, "Size:         %s\n", formatBytes(size))
+	fmt.Fprintf(sess, "Last push:    %s\n", formatLastPush(repoPath))
+	if meta, err := store.Repo(repo); err == nil {
+		if meta.Owner != "" {
+			fmt.Fprintf(sess, "Owner:        %s\n", meta.Owner)
+		}
+		fmt.Fprintf(sess, "Visibility:   %s\n", repoVisibility(repo))
+		if meta.QuotaBytes > 0 {
+			fmt.Fprintf(sess, "Quota:        %s\n", formatBytes(meta.QuotaBytes))
+		}
+	}
+	fmt.Fprintf(sess, "Your access:  %s (key %s)\n", accessLevelName(access), authKey.ID)
+	fmt.Fprintf(sess, "\nBranches (%d):\n", len(branches))
+	for _, branch := range branches {
+		fmt.Fprintf(sess, "• %s\n", branch)
+	}
+}
+
+func createCommand(sess ssh.Session, args []string) {
+	if !isAdminKey(sess.PublicKey()) {
+		wish.Fatalln(sess, "create is restricted to admin keys")
+		return
+	}
+	if len(args) < 1 || len(args) > 3 {
+		wish.Fatalln(sess, "usage: create <repo> [owner [template]]")
+		return
+	}
+	owner, template := "", ""
+	if len(args) >= 2 {
+		owner = args[1]
+	}
+	if len(args) == 3 {
+		template = args[2]
+	}
+	repo, err := createRepo(args[0], owner, template, gossh.FingerprintSHA256(sess.PublicKey()))
+	if err != nil {
+		if !errors.Is(err, errInvalidRepo) && !errors.Is(err, errRepoExists) && !errors.Is(err, errUnknownTemplate) {
+			sshLog.Error("Repository creation failed", "repo", repo, "error", err)
+			err = errors.New("failed to create repository")
+		}
+		wish.Fatalln(sess, err)
+		return
+	}
+	fmt.Fprintf(sess, "Created %s\ngit clone ssh://%s/%s\n", repo, cloneHost(), repo)
+}
+
+func transferCommand(sess ssh.Session, args []string) {
+	if !isAdminKey(sess.PublicKey()) {
+		wish.Fatalln(sess, "transfer is restricted to admin keys")
+		return
+	}
+	if len(args) < 2 || len(args) > 3 {
+		wish.Fatalln(sess, "usage: transfer <repo> <owner> [new-name]")
+		return
+	}
+	newName := ""
+	if len(args) == 3 {
+		newName = args[2]
+	}
+	repo, err := transferRepo(args[0], newName, args[1], gossh.FingerprintSHA256(sess.PublicKey()))
+	if err != nil {
+		switch {
+		case errors.Is(err, errNotFound):
+			err = errors.New("repository not found")
+		case !errors.Is(err, errInvalidRepo) && !errors.Is(err, errRepoExists):
+			sshLog.Error("Repository transfer failed", "repo", args[0], "error", err)
+			err = errors.New("failed to transfer repository")
+		}
+		wish.Fatalln(sess, err)
+		return
+	}
+	fmt.Fprintf(sess, "Transferred %s to %s\ngit clone ssh://%s/%s\n", repo.Name, repo.Owner, cloneHost(), repo.Name)
+}
+
+// restoreCommand lists a repository's ref backups or restores one of them.
+// Keys with write access to the repository may use it.
+func restoreCommand(sess ssh.Session, args []string) {
+	if len(args) < 1 || len(args) > 3 {
+		wish.Fatalln(sess, "usage: restore <repo> [<branch>|<backup-id> [<new-branch>]]")
+		return
+	}
+	repo := resolveRepo(args[0])
+	if !isValidRepoName(repo) {
+		wish.Fatalln(sess, "invalid repository name")
+		return
+	}
+	_, access := lookupKey(repo, sess.PublicKey())
+	if !repoExists(repo) || (access < git.ReadWriteAccess && !isAdminKey(sess.PublicKey())) {
+		wish.Fatalln(sess, "repository not found or access denied")
+		return
+	}
+
+	if len(args) == 1 {
+		backups, err := liveRefBackups(repo)
+		if err != nil {
+			sshLog.Error("Failed to list ref backups", "repo", repo, "error", err)
+			wish.Fatalln(sess, "failed to read repository")
+			return
+		}
+		if len(backups) == 0 {
+			fmt.Fprintln(sess, "No ref backups.")
+			return
+		}
+		for _, b := range backups {
+			fmt.Fprintf(sess, "%-50s %s %s\n", b.ID, b.SHA[:7], b.Time.Format(time.RFC3339))
+		}
+		return
+	}
+
+	target := ""
+	if len(args) == 3 {
+		target = args[2]
+	}
+	backup, ref, err := restoreRefBackup(repo, args[1], target, gossh.FingerprintSHA256(sess.PublicKey()))
+	if err != nil {
+		if !errors.Is(err, errRefBackupNotFound) && !errors.Is(err, errRefExists) && !errors.Is(err, errInvalidRef) {
+			sshLog.Error("Ref restore failed", "repo", repo, "error", err)
+			err = errors.New("failed to restore ref")
+		}
+		wish.Fatalln(sess, err)
+		return
+	}
+	fmt.Fprintf(sess, "Restored %s at %s (backup %s)\n", ref, backup.SHA[:7], backup.ID)
+}
+
+func repoBranches(repoPath string) ([]string, error) {
+	out, err := exec.Command("git", "-C", repoPath, "for-each-ref",
+		"--sort=-committerdate",
+		"--format=%(refname:short) %(objectname:short) %(committerdate:relative)",
+		"refs/heads").Output()
+	if err != nil {
+		return nil, err
+	}
+	var branches []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			branches = append(branches, line)
+		}
+	}
+	return branches, nil
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// git-receive-pack is always followed by update-server-info, which rewrites
+// info/refs, so its mtime is the time of the last successful push.
+func formatLastPush(repoPath string) string {
+	info, err := os.Stat(filepath.Join(repoPath, "info", "refs"))
+	if err != nil {
+		return "never"
+	}
+	return info.ModTime().Format(time.RFC3339)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func accessLevelName(level git.AccessLevel) string {
+	switch level {
+	case git.ReadOnlyAccess:
+		return "read-only"
+	case git.ReadWriteAccess:
+		return "read-write"
+	case git.AdminAccess:
+		return "admin"
+	default:
+		return "no access"
+	}
+}
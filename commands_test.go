@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// fakeSession is the part of an ssh.Session that commandFilterMiddleware
+// uses.
+type fakeSession struct {
+	ssh.Session
+	cmd    []string
+	pty    bool
+	stderr bytes.Buffer
+	exit   int
+}
+
+func (s *fakeSession) Command() []string        { return s.cmd }
+func (s *fakeSession) RawCommand() string       { return strings.Join(s.cmd, " ") }
+func (s *fakeSession) PublicKey() ssh.PublicKey { return nil }
+func (s *fakeSession) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+func (s *fakeSession) Stderr() io.ReadWriter { return &s.stderr }
+func (s *fakeSession) Exit(code int) error   { s.exit = code; return nil }
+func (s *fakeSession) Close() error          { return nil }
+func (s *fakeSession) Pty() (ssh.Pty, <-chan ssh.Window, bool) {
+	return ssh.Pty{}, nil, s.pty
+}
+
+func TestCommandFilterMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     []string
+		pty     bool
+		allowed bool
+		message string
+	}{
+		{"no command opens the menu", nil, false, true, ""},
+		{"no command on a terminal", nil, true, true, ""},
+		{"git-upload-pack", []string{"git-upload-pack", "demo"}, false, true, ""},
+		{"git-receive-pack", []string{"git-receive-pack", "demo"}, false, true, ""},
+		{"git-upload-archive", []string{"git-upload-archive", "demo"}, false, true, ""},
+		{"git without a repository", []string{"git-upload-pack"}, false, false, "usage: git-upload-pack <repo>"},
+		{"git with extra arguments", []string{"git-receive-pack", "demo", "--evil"}, false, false, "usage: git-receive-pack <repo>"},
+		{"git on a terminal", []string{"git-upload-pack", "demo"}, true, false, "connect without -t"},
+		{"server command", []string{"whoami"}, false, true, ""},
+		{"terminal command on a terminal", []string{"dashboard"}, true, true, ""},
+		{"other command on a terminal", []string{"whoami"}, true, false, "whoami does not run on a terminal"},
+		{"shell", []string{"sh", "-c", "id"}, false, false, `unknown command "sh"`},
+		{"git with a path", []string{"/usr/bin/git-upload-pack", "demo"}, false, false, "unknown command"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := &fakeSession{cmd: tt.cmd, pty: tt.pty}
+			called := false
+			commandFilterMiddleware(func(ssh.Session) { called = true })(sess)
+			if called != tt.allowed {
+				t.Fatalf("next handler called = %v, want %v; stderr: %s", called, tt.allowed, sess.stderr.String())
+			}
+			if tt.allowed {
+				return
+			}
+			if sess.exit != 1 {
+				t.Errorf("exit status %d, want 1", sess.exit)
+			}
+			if !strings.Contains(sess.stderr.String(), tt.message) {
+				t.Errorf("stderr %q does not contain %q", sess.stderr.String(), tt.message)
+			}
+		})
+	}
+}
@@ -1,33 +1,201 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	Port           string
-	Host           string
-	RepoDir        string
-	BackupDir      string
-	InternalServer string
-	HTTPTimeout    time.Duration
-	SSHKeyPath     string
+	Port              string
+	Host              string
+	RepoDir           string
+	BackupDir         string
+	InternalServer    string
+	HTTPTimeout       time.Duration
+	SSHKeyPath        string
+	MaxFileSize       int64
+	AllowLFSTracked   bool
+	DataDir           string
+	AdminAddr         string
+	AdminToken        string
+	RepoNameCase      string
+	BandwidthLimit    int64
+	KeyBandwidthLimit int64
+	MinFreeSpace      int64
+	DiskCheckInterval time.Duration
+	AutoCreate        bool
+	CreateApproval    bool
+	AdminKeys         []string
+	DBDriver          string
+	DBDSN             string
+	DrainTimeout      time.Duration
+	IdleTimeout       time.Duration
+	HookTimeout       time.Duration
+	TransferTimeout   time.Duration
+	PIDFile           string
+	LogLevel          string
+
+	BackupReconcileInterval time.Duration
+	BackupRetention         time.Duration
+	RefBackupRetention      time.Duration
+	TrafficRetention        time.Duration
+	TrashDir                string
+	TrashRetention          time.Duration
+	AuditSigningKey         string
+	Hostnames               []string
+	RepoMenu                bool
+	AuditSignInterval       time.Duration
+	GuestDefaultTTL         time.Duration
+	GuestMaxTTL             time.Duration
+	PushReceipts            bool
+	ReceiptSigningKey       string
+	AuthProxy               string
+	WebhookProxy            string
+	BackupProxy             string
+	MirrorProxy             string
+	TenantsFile             string
+	SearchIndex             bool
+	Umask                   string
+	RepoDirMode             string
+	RepoFileMode            string
+	RepoOwner               string
+	RepoGroup               string
+	RepoFixPermissions      bool
+	RepoRestorecon          bool
+	RepoConfig              bool
+	TemplateDir             string
+	InitTemplate            string
+	MaintenanceMessage      string
+
+	AuthSummaryInterval time.Duration
+	AuthAlertErrorRatio float64
+	AuthAlertURL        string
+
+	MirrorInterval   time.Duration
+	MirrorStaleAfter time.Duration
+	MirrorAlertURL   string
+
+	AuthBackend         string
+	LDAPURL             string
+	LDAPBindDN          string
+	LDAPBindPassword    string
+	LDAPBaseDN          string
+	LDAPUserFilter      string
+	LDAPKeyAttribute    string
+	LDAPIDAttribute     string
+	LDAPGroupAttribute  string
+	LDAPPermissionsFile string
+
+	OIDCIssuer      string
+	OIDCAudience    string
+	OIDCRolesClaim  string
+	OIDCAdminRoles  []string
+	OIDCViewerRoles []string
 }
 
 func loadConfig() Config {
 	return Config{
-		Port:           getEnvOrDefault("GIT_SERVER_PORT", "2222"),
-		Host:           getEnvOrDefault("GIT_SERVER_HOST", "0.0.0.0"),
-		RepoDir:        getEnvOrDefault("GIT_SERVER_REPO_DIR", "repos"),
-		BackupDir:      getEnvOrDefault("GIT_SERVER_BACKUP_DIR", "repo_backups"),
-		InternalServer: getEnvOrDefault("GIT_SERVER_AUTHORIZATION_SERVER_URL", "http://0.0.0.0:3000"),
-		HTTPTimeout:    getDurationEnvOrDefault("GIT_SERVER_HTTP_TIMEOUT", 10*time.Second),
-		SSHKeyPath:     getEnvOrDefault("GIT_SERVER_SSH_KEY_PATH", ".ssh/id_ed25519"),
+		Port:              getEnvOrDefault("GIT_SERVER_PORT", "2222"),
+		Host:              getEnvOrDefault("GIT_SERVER_HOST", "0.0.0.0"),
+		RepoDir:           getEnvOrDefault("GIT_SERVER_REPO_DIR", "repos"),
+		BackupDir:         getEnvOrDefault("GIT_SERVER_BACKUP_DIR", "repo_backups"),
+		InternalServer:    getEnvOrDefault("GIT_SERVER_AUTHORIZATION_SERVER_URL", "http://0.0.0.0:3000"),
+		HTTPTimeout:       getDurationEnvOrDefault("GIT_SERVER_HTTP_TIMEOUT", 10*time.Second),
+		SSHKeyPath:        getEnvOrDefault("GIT_SERVER_SSH_KEY_PATH", ".ssh/id_ed25519"),
+		MaxFileSize:       getInt64EnvOrDefault("GIT_SERVER_MAX_FILE_SIZE", 0),
+		AllowLFSTracked:   getBoolEnvOrDefault("GIT_SERVER_ALLOW_LFS_TRACKED", true),
+		DataDir:           getEnvOrDefault("GIT_SERVER_DATA_DIR", "data"),
+		AdminAddr:         getEnvOrDefault("GIT_SERVER_ADMIN_ADDR", "127.0.0.1:8080"),
+		AdminToken:        os.Getenv("GIT_SERVER_ADMIN_TOKEN"),
+		RepoNameCase:      getEnvOrDefault("GIT_SERVER_REPO_NAME_CASE", "sensitive"),
+		BandwidthLimit:    getInt64EnvOrDefault("GIT_SERVER_BANDWIDTH_LIMIT", 0),
+		KeyBandwidthLimit: getInt64EnvOrDefault("GIT_SERVER_KEY_BANDWIDTH_LIMIT", 0),
+		MinFreeSpace:      getInt64EnvOrDefault("GIT_SERVER_MIN_FREE_SPACE", 0),
+		DiskCheckInterval: getDurationEnvOrDefault("GIT_SERVER_DISK_CHECK_INTERVAL", 30*time.Second),
+		AutoCreate:        getBoolEnvOrDefault("GIT_SERVER_AUTO_CREATE", true),
+		CreateApproval:    getBoolEnvOrDefault("GIT_SERVER_CREATE_APPROVAL", false),
+		AdminKeys:         getListEnvOrDefault("GIT_SERVER_ADMIN_KEYS", nil),
+		DBDriver:          getEnvOrDefault("GIT_SERVER_DB_DRIVER", "sqlite"),
+		DBDSN:             os.Getenv("GIT_SERVER_DB_DSN"),
+		DrainTimeout:      getDurationEnvOrDefault("GIT_SERVER_DRAIN_TIMEOUT", time.Hour),
+		IdleTimeout:       getDurationEnvOrDefault("GIT_SERVER_IDLE_TIMEOUT", 0),
+		HookTimeout:       getDurationEnvOrDefault("GIT_SERVER_HOOK_TIMEOUT", 0),
+		TransferTimeout:   getDurationEnvOrDefault("GIT_SERVER_TRANSFER_TIMEOUT", 0),
+		PIDFile:           os.Getenv("GIT_SERVER_PID_FILE"),
+		LogLevel:          getEnvOrDefault("GIT_SERVER_LOG_LEVEL", "info"),
+
+		BackupReconcileInterval: getDurationEnvOrDefault("GIT_SERVER_BACKUP_RECONCILE_INTERVAL", time.Hour),
+		BackupRetention:         getDurationEnvOrDefault("GIT_SERVER_BACKUP_RETENTION", 7*24*time.Hour),
+		RefBackupRetention:      getDurationEnvOrDefault("GIT_SERVER_REF_BACKUP_RETENTION", 30*24*time.Hour),
+		TrafficRetention:        getDurationEnvOrDefault("GIT_SERVER_TRAFFIC_RETENTION", 90*24*time.Hour),
+		TrashDir:                getEnvOrDefault("GIT_SERVER_TRASH_DIR", "trash"),
+		TrashRetention:          getDurationEnvOrDefault("GIT_SERVER_TRASH_RETENTION", 30*24*time.Hour),
+		AuditSigningKey:         getEnvOrDefault("GIT_SERVER_AUDIT_SIGNING_KEY", ""),
+		Hostnames:               getListEnvOrDefault("GIT_SERVER_HOSTNAMES", nil),
+		RepoMenu:                getBoolEnvOrDefault("GIT_SERVER_REPO_MENU", false),
+		AuditSignInterval:       getDurationEnvOrDefault("GIT_SERVER_AUDIT_SIGN_INTERVAL", 10*time.Minute),
+		GuestDefaultTTL:         getDurationEnvOrDefault("GIT_SERVER_GUEST_DEFAULT_TTL", 7*24*time.Hour),
+		GuestMaxTTL:             getDurationEnvOrDefault("GIT_SERVER_GUEST_MAX_TTL", 30*24*time.Hour),
+		PushReceipts:            getBoolEnvOrDefault("GIT_SERVER_PUSH_RECEIPTS", false),
+		ReceiptSigningKey:       os.Getenv("GIT_SERVER_RECEIPT_SIGNING_KEY"),
+		AuthProxy:               os.Getenv("GIT_SERVER_AUTH_PROXY"),
+		WebhookProxy:            os.Getenv("GIT_SERVER_WEBHOOK_PROXY"),
+		BackupProxy:             os.Getenv("GIT_SERVER_BACKUP_PROXY"),
+		MirrorProxy:             os.Getenv("GIT_SERVER_MIRROR_PROXY"),
+		TenantsFile:             os.Getenv("GIT_SERVER_TENANTS_FILE"),
+		SearchIndex:             getBoolEnvOrDefault("GIT_SERVER_SEARCH_INDEX", true),
+		Umask:                   os.Getenv("GIT_SERVER_UMASK"),
+		RepoDirMode:             os.Getenv("GIT_SERVER_REPO_DIR_MODE"),
+		RepoFileMode:            os.Getenv("GIT_SERVER_REPO_FILE_MODE"),
+		RepoOwner:               os.Getenv("GIT_SERVER_REPO_OWNER"),
+		RepoGroup:               os.Getenv("GIT_SERVER_REPO_GROUP"),
+		RepoFixPermissions:      getBoolEnvOrDefault("GIT_SERVER_REPO_FIX_PERMISSIONS", false),
+		RepoRestorecon:          getBoolEnvOrDefault("GIT_SERVER_REPO_RESTORECON", false),
+		RepoConfig:              getBoolEnvOrDefault("GIT_SERVER_REPO_CONFIG", true),
+		TemplateDir:             getEnvOrDefault("GIT_SERVER_TEMPLATE_DIR", "templates"),
+		InitTemplate:            os.Getenv("GIT_SERVER_INIT_TEMPLATE"),
+		MaintenanceMessage:      getEnvOrDefault("GIT_SERVER_MAINTENANCE_MESSAGE", "down for maintenance"),
+
+		AuthSummaryInterval: getDurationEnvOrDefault("GIT_SERVER_AUTH_SUMMARY_INTERVAL", 5*time.Minute),
+		AuthAlertErrorRatio: getFloatEnvOrDefault("GIT_SERVER_AUTH_ALERT_ERROR_RATIO", 0.25),
+		AuthAlertURL:        os.Getenv("GIT_SERVER_AUTH_ALERT_URL"),
+
+		MirrorInterval:   getDurationEnvOrDefault("GIT_SERVER_MIRROR_INTERVAL", 5*time.Minute),
+		MirrorStaleAfter: getDurationEnvOrDefault("GIT_SERVER_MIRROR_STALE_AFTER", time.Hour),
+		MirrorAlertURL:   os.Getenv("GIT_SERVER_MIRROR_ALERT_URL"),
+
+		AuthBackend:         getEnvOrDefault("GIT_SERVER_AUTH_BACKEND", "http"),
+		LDAPURL:             os.Getenv("GIT_SERVER_LDAP_URL"),
+		LDAPBindDN:          os.Getenv("GIT_SERVER_LDAP_BIND_DN"),
+		LDAPBindPassword:    os.Getenv("GIT_SERVER_LDAP_BIND_PASSWORD"),
+		LDAPBaseDN:          os.Getenv("GIT_SERVER_LDAP_BASE_DN"),
+		LDAPUserFilter:      getEnvOrDefault("GIT_SERVER_LDAP_USER_FILTER", "(objectClass=person)"),
+		LDAPKeyAttribute:    getEnvOrDefault("GIT_SERVER_LDAP_KEY_ATTRIBUTE", "sshPublicKey"),
+		LDAPIDAttribute:     getEnvOrDefault("GIT_SERVER_LDAP_ID_ATTRIBUTE", "uid"),
+		LDAPGroupAttribute:  getEnvOrDefault("GIT_SERVER_LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		LDAPPermissionsFile: getEnvOrDefault("GIT_SERVER_LDAP_PERMISSIONS_FILE", "ldap_permissions.json"),
+
+		OIDCIssuer:      os.Getenv("GIT_SERVER_OIDC_ISSUER"),
+		OIDCAudience:    getEnvOrDefault("GIT_SERVER_OIDC_AUDIENCE", "git-server"),
+		OIDCRolesClaim:  getEnvOrDefault("GIT_SERVER_OIDC_ROLES_CLAIM", "groups"),
+		OIDCAdminRoles:  getListEnvOrDefault("GIT_SERVER_OIDC_ADMIN_ROLES", []string{"git-server-admin"}),
+		OIDCViewerRoles: getListEnvOrDefault("GIT_SERVER_OIDC_VIEWER_ROLES", nil),
 	}
 }
 
+// invalidEnv lists the variables whose values could not be parsed, with the
+// default used instead. The config is loaded before logging is set up, so
+// the self-check reports them.
+var invalidEnv []string
+
+func rejectEnv(key, value string, defaultValue any) {
+	invalidEnv = append(invalidEnv, fmt.Sprintf("%s=%q (using %v)", key, value, defaultValue))
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -35,11 +203,83 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getDurationEnvOrDefault accepts a Go duration such as "500ms" or "2h", a
+// number of days such as "7d", or a bare number of seconds.
 func getDurationEnvOrDefault(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
-		if seconds, err := strconv.Atoi(value); err == nil {
-			return time.Duration(seconds) * time.Second
+		d, err := parseDuration(value)
+		if err == nil {
+			return d
+		}
+		rejectEnv(key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		value = strconv.Itoa(seconds) + "s"
+	} else if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		value = strconv.Itoa(n*24) + "h"
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.New("duration must not be negative")
+	}
+	return d, nil
+}
+
+func getInt64EnvOrDefault(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+		rejectEnv(key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func getFloatEnvOrDefault(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+		rejectEnv(key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func getBoolEnvOrDefault(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
 		}
+		rejectEnv(key, value, defaultValue)
 	}
 	return defaultValue
 }
+
+func getListEnvOrDefault(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return splitList(value)
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	bm "github.com/charmbracelet/wish/bubbletea"
+)
+
+const dashboardRefresh = 2 * time.Second
+
+type dashboardPanel int
+
+const (
+	panelSessions dashboardPanel = iota
+	panelPushes
+	panelBackups
+	panelWebhooks
+	panelDisk
+	panelCount
+)
+
+var panelNames = [panelCount]string{"Sessions", "Pushes", "Backups", "Webhooks", "Disk"}
+
+type diskInfo struct {
+	Dir   string
+	Free  uint64
+	Total uint64
+	Err   error
+}
+
+type dashboardTickMsg time.Time
+
+type maintenanceDoneMsg struct {
+	repo string
+	err  error
+}
+
+type dashboardModel struct {
+	sess   ssh.Session
+	styles dashboardStyles
+
+	panel  dashboardPanel
+	cursor int
+	width  int
+	height int
+
+	sessions []activeSession
+	pushes   []transferStats
+	backups  []backupSummary
+	webhooks []webhookFailure
+	disks    []diskInfo
+	updated  time.Time
+	status   string
+}
+
+type dashboardStyles struct {
+	title    lipgloss.Style
+	tab      lipgloss.Style
+	active   lipgloss.Style
+	selected lipgloss.Style
+	warning  lipgloss.Style
+	help     lipgloss.Style
+}
+
+func dashboardCommand(sess ssh.Session, args []string) {
+	if !isAdminKey(sess.PublicKey()) {
+		wish.Fatalln(sess, "dashboard is restricted to admin keys")
+		return
+	}
+	pty, windowChanges, ok := sess.Pty()
+	if !ok {
+		wish.Fatalln(sess, "the dashboard needs a terminal, connect with ssh -t")
+		return
+	}
+
+	renderer := bm.MakeRenderer(sess)
+	model := &dashboardModel{
+		sess:   sess,
+		width:  pty.Window.Width,
+		height: pty.Window.Height,
+		styles: dashboardStyles{
+			title:    renderer.NewStyle().Bold(true),
+			tab:      renderer.NewStyle().Padding(0, 1),
+			active:   renderer.NewStyle().Padding(0, 1).Reverse(true),
+			selected: renderer.NewStyle().Reverse(true),
+			warning:  renderer.NewStyle().Foreground(lipgloss.Color("1")),
+			help:     renderer.NewStyle().Faint(true),
+		},
+	}
+	model.refresh()
+
+	program := tea.NewProgram(model, append(bm.MakeOptions(sess), tea.WithAltScreen())...)
+	ctx, cancel := context.WithCancel(sess.Context())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				program.Quit()
+				return
+			case w := <-windowChanges:
+				program.Send(tea.WindowSizeMsg{Width: w.Width, Height: w.Height})
+			}
+		}
+	}()
+	if _, err := program.Run(); err != nil {
+		sshLog.Error("Dashboard exited with error", "error", err)
+	}
+	program.Kill()
+}
+
+func dashboardTick() tea.Cmd {
+	return tea.Tick(dashboardRefresh, func(t time.Time) tea.Msg { return dashboardTickMsg(t) })
+}
+
+func (m *dashboardModel) Init() tea.Cmd {
+	return dashboardTick()
+}
+
+func (m *dashboardModel) refresh() {
+	m.sessions = sessions.List()
+	m.pushes = recentPushes()
+	backups, err := backupSummaries()
+	if err != nil {
+		m.status = "failed to read backups: " + err.Error()
+	}
+	m.backups = backups
+	m.webhooks = recentWebhookFailures()
+	m.disks = nil
+	for _, dir := range append(repoRoots(), config.BackupDir) {
+		free, total, err := diskUsage(dir)
+		m.disks = append(m.disks, diskInfo{Dir: dir, Free: free, Total: total, Err: err})
+	}
+	m.updated = time.Now()
+	m.cursor = min(m.cursor, max(m.rows()-1, 0))
+}
+
+func (m *dashboardModel) rows() int {
+	switch m.panel {
+	case panelSessions:
+		return len(m.sessions)
+	case panelPushes:
+		return len(m.pushes)
+	case panelBackups:
+		return len(m.backups)
+	case panelWebhooks:
+		return len(m.webhooks)
+	default:
+		return len(m.disks)
+	}
+}
+
+func (m *dashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case dashboardTickMsg:
+		m.refresh()
+		return m, dashboardTick()
+	case maintenanceDoneMsg:
+		if msg.err != nil {
+			m.status = fmt.Sprintf("maintenance of %s failed: %v", msg.repo, msg.err)
+		} else {
+			m.status = fmt.Sprintf("maintenance of %s finished", msg.repo)
+		}
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c", "esc":
+			return m, tea.Quit
+		case "tab", "right", "l":
+			m.panel = (m.panel + 1) % panelCount
+			m.cursor = 0
+		case "shift+tab", "left", "h":
+			m.panel = (m.panel + panelCount - 1) % panelCount
+			m.cursor = 0
+		case "up", "k":
+			m.cursor = max(m.cursor-1, 0)
+		case "down", "j":
+			m.cursor = min(m.cursor+1, max(m.rows()-1, 0))
+		case "r":
+			m.refresh()
+		case "x":
+			return m, m.killSelected()
+		case "m":
+			return m, m.maintainSelected()
+		}
+	}
+	return m, nil
+}
+
+func (m *dashboardModel) killSelected() tea.Cmd {
+	if m.panel != panelSessions || m.cursor >= len(m.sessions) {
+		return nil
+	}
+	target := m.sessions[m.cursor]
+	if target.sess == m.sess {
+		m.status = "refusing to kill the dashboard's own session"
+		return nil
+	}
+	if sessions.Kill(target.ID) {
+		sshLog.Info("Session killed from dashboard", "session", target.ID, "fingerprint", target.Fingerprint, "command", target.Command)
+		m.status = fmt.Sprintf("killed session %d (%s)", target.ID, target.RemoteAddr)
+	}
+	m.refresh()
+	return nil
+}
+
+func (m *dashboardModel) maintainSelected() tea.Cmd {
+	var repo string
+	switch {
+	case m.panel == panelPushes && m.cursor < len(m.pushes):
+		repo = m.pushes[m.cursor].Repo
+	case m.panel == panelBackups && m.cursor < len(m.backups):
+		repo = m.backups[m.cursor].Repo
+	case m.panel == panelWebhooks && m.cursor < len(m.webhooks):
+		repo = m.webhooks[m.cursor].Repo
+	default:
+		return nil
+	}
+	if !repoExists(repo) {
+		m.status = fmt.Sprintf("repository %s no longer exists", repo)
+		return nil
+	}
+	m.status = fmt.Sprintf("running maintenance on %s...", repo)
+	return func() tea.Msg {
+		return maintenanceDoneMsg{repo: repo, err: runMaintenance(repo)}
+	}
+}
+
+func (m *dashboardModel) View() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s  %s\n\n", m.styles.title.Render("git-server dashboard"), m.styles.help.Render("updated "+m.updated.Format(time.TimeOnly)))
+
+	var tabs []string
+	for i, name := range panelNames {
+		if dashboardPanel(i) == m.panel {
+			tabs = append(tabs, m.styles.active.Render(name))
+		} else {
+			tabs = append(tabs, m.styles.tab.Render(name))
+		}
+	}
+	b.WriteString(lipgloss.JoinHorizontal(lipgloss.Top, tabs...) + "\n\n")
+
+	var header string
+	var lines []string
+	switch m.panel {
+	case panelSessions:
+		header = fmt.Sprintf("%-5s %-22s %-12s %-10s %s", "ID", "REMOTE", "USER", "AGE", "COMMAND")
+		for _, s := range m.sessions {
+			lines = append(lines, fmt.Sprintf("%-5d %-22s %-12s %-10s %s", s.ID, s.RemoteAddr, s.User, time.Since(s.Started).Round(time.Second), s.Command))
+		}
+	case panelPushes:
+		header = fmt.Sprintf("%-9s %-30s %-6s %-8s %-10s %-10s %s", "TIME", "REPO", "REFS", "OBJECTS", "SIZE", "DURATION", "RESULT")
+		for _, p := range m.pushes {
+			result := "ok"
+			if p.Error != "" {
+				result = m.styles.warning.Render("failed")
+			}
+			lines = append(lines, fmt.Sprintf("%-9s %-30s %-6d %-8d %-10s %-10s %s", p.Time.Format(time.TimeOnly), p.Repo, p.RefsUpdated, p.Objects, formatBytes(p.BytesIn), p.Duration.Round(time.Millisecond), result))
+		}
+	case panelBackups:
+		header = fmt.Sprintf("%-30s %-10s %-8s %-8s %s", "REPO", "ARTIFACTS", "QUEUED", "FAILED", "LAST UPLOAD")
+		for _, s := range m.backups {
+			last := "never"
+			if !s.LastUploadTime.IsZero() {
+				last = s.LastUploadTime.Format(time.DateTime)
+			}
+			failed := fmt.Sprintf("%-8d", len(s.FailedUploads))
+			if len(s.FailedUploads) > 0 {
+				failed = m.styles.warning.Render(failed)
+			}
+			lines = append(lines, fmt.Sprintf("%-30s %-10d %-8d %s %s", s.Repo, s.Artifacts, s.Pending, failed, last))
+		}
+	case panelWebhooks:
+		header = fmt.Sprintf("%-19s %-30s %-8s %-40s %s", "TIME", "REPO", "EVENT", "URL", "ERROR")
+		for _, f := range m.webhooks {
+			lines = append(lines, fmt.Sprintf("%-19s %-30s %-8s %-40s %s", f.Time.Format(time.DateTime), f.Repo, f.Event, f.URL, m.styles.warning.Render(f.Error)))
+		}
+	case panelDisk:
+		header = fmt.Sprintf("%-30s %-12s %-12s %s", "DIRECTORY", "FREE", "TOTAL", "USED")
+		for _, d := range m.disks {
+			if d.Err != nil {
+				lines = append(lines, fmt.Sprintf("%-30s %s", d.Dir, m.styles.warning.Render(d.Err.Error())))
+				continue
+			}
+			used := 0.0
+			if d.Total > 0 {
+				used = 100 * float64(d.Total-d.Free) / float64(d.Total)
+			}
+			line := fmt.Sprintf("%-30s %-12s %-12s %.1f%%", d.Dir, formatBytes(int64(d.Free)), formatBytes(int64(d.Total)), used)
+			if config.MinFreeSpace > 0 && d.Free < uint64(config.MinFreeSpace) {
+				line = m.styles.warning.Render(line + "  below threshold, pushes rejected")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	b.WriteString(m.styles.title.Render(header) + "\n")
+	visible := max(m.height-9, 1)
+	offset := max(m.cursor-visible+1, 0)
+	for i := offset; i < len(lines) && i < offset+visible; i++ {
+		if i == m.cursor && m.panel != panelDisk {
+			b.WriteString(m.styles.selected.Render(lines[i]) + "\n")
+		} else {
+			b.WriteString(lines[i] + "\n")
+		}
+	}
+	if len(lines) == 0 {
+		b.WriteString(m.styles.help.Render("nothing to show") + "\n")
+	}
+
+	b.WriteString("\n" + m.styles.help.Render("tab: switch panel • ↑/↓: select • x: kill session • m: run maintenance • r: refresh • q: quit") + "\n")
+	if m.status != "" {
+		b.WriteString(m.status + "\n")
+	}
+	return b.String()
+}
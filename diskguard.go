@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+var (
+	diskFreeBytes       = newGaugeVec("git_server_disk_free_bytes", "Free space on the filesystem holding each data directory.", "dir")
+	diskLowSpace        = newGaugeVec("git_server_disk_low_space", "1 when free space is below GIT_SERVER_MIN_FREE_SPACE.", "dir")
+	pushesRejectedTotal = newCounterVec("git_server_pushes_rejected_total", "Pushes rejected before reaching git, by reason.", "reason")
+)
+
+type diskGuard struct {
+	mu  sync.RWMutex
+	low map[string]uint64
+}
+
+var disks = &diskGuard{low: map[string]uint64{}}
+
+func (g *diskGuard) run(ctx context.Context, interval time.Duration) {
+	g.check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.check()
+		}
+	}
+}
+
+func (g *diskGuard) check() {
+	for _, dir := range append(repoRoots(), config.BackupDir) {
+		free, _, err := diskUsage(dir)
+		if err != nil {
+			log.Error("Failed to check free disk space", "dir", dir, "error", err)
+			continue
+		}
+		diskFreeBytes.Set(float64(free), dir)
+
+		g.mu.Lock()
+		_, wasLow := g.low[dir]
+		isLow := free < uint64(config.MinFreeSpace)
+		if isLow {
+			g.low[dir] = free
+		} else {
+			delete(g.low, dir)
+		}
+		g.mu.Unlock()
+
+		switch {
+		case isLow:
+			diskLowSpace.Set(1, dir)
+			if !wasLow {
+				log.Error("Free disk space below threshold, rejecting pushes", "dir", dir, "free", formatBytes(int64(free)), "threshold", formatBytes(config.MinFreeSpace))
+			}
+		case wasLow:
+			diskLowSpace.Set(0, dir)
+			log.Info("Free disk space recovered, accepting pushes", "dir", dir, "free", formatBytes(int64(free)))
+		default:
+			diskLowSpace.Set(0, dir)
+		}
+	}
+}
+
+// pushError returns a message for clients when any data directory is short
+// on space, or "" when pushes can proceed. The directory is only logged, as
+// clients have no business knowing the server's layout.
+func (g *diskGuard) pushError() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for dir, free := range g.low {
+		log.Warn("Push rejected for low disk space", "dir", dir, "free", formatBytes(int64(free)))
+		return "push rejected: the server is low on disk space; please contact an administrator"
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Outbound HTTP requests go through the proxy named by HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY, unless the subsystem making them has a proxy of
+// its own in GIT_SERVER_<SUBSYSTEM>_PROXY: a proxy URL, or "direct" to bypass
+// any proxy. Failures at the proxy are logged and counted apart from failures
+// of the destination.
+
+const (
+	// egressAuth covers the authorization server, OIDC discovery and
+	// authorization alerts.
+	egressAuth    = "auth"
+	egressWebhook = "webhook"
+	egressBackup  = "backup"
+	// egressMirror covers mirror pushes and fetches over http(s) and
+	// mirror alerts.
+	egressMirror = "mirror"
+)
+
+var proxyErrorsTotal = newCounterVec("git_server_proxy_errors_total", "Outbound HTTP requests that failed at the egress proxy, by subsystem and class.", "subsystem", "class")
+
+// proxyError is a request that failed at the proxy rather than at its
+// destination. Class is connect (the proxy could not be reached), auth (the
+// proxy wants credentials) or refused (the proxy would not forward the
+// request).
+type proxyError struct {
+	Proxy string
+	Class string
+	Err   error
+}
+
+func (e *proxyError) Error() string {
+	return fmt.Sprintf("egress proxy %s: %v", e.Proxy, e.Err)
+}
+
+func (e *proxyError) Unwrap() error {
+	return e.Err
+}
+
+func subsystemProxy(subsystem string) string {
+	switch subsystem {
+	case egressAuth:
+		return config.AuthProxy
+	case egressWebhook:
+		return config.WebhookProxy
+	case egressBackup:
+		return config.BackupProxy
+	case egressMirror:
+		return config.MirrorProxy
+	}
+	return ""
+}
+
+// parseProxySetting turns a GIT_SERVER_*_PROXY value into a proxy function
+// for http.Transport.
+func parseProxySetting(setting string) (func(*http.Request) (*url.URL, error), error) {
+	switch setting {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return nil, nil
+	}
+	u, err := url.Parse(setting)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("%q is not an http or https proxy URL, or direct", setting)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// newHTTPClient returns a client for the subsystem's outbound requests. An
+// invalid proxy setting, which the startup self-check reports, falls back to
+// the environment.
+func newHTTPClient(subsystem string, timeout time.Duration) *http.Client {
+	proxy, err := parseProxySetting(subsystemProxy(subsystem))
+	if err != nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.OnProxyConnectResponse = func(ctx context.Context, proxyURL *url.URL, req *http.Request, resp *http.Response) error {
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		return &proxyError{Proxy: proxyURL.Redacted(), Class: proxyStatusClass(resp.StatusCode), Err: errors.New(resp.Status)}
+	}
+	return &http.Client{Timeout: timeout, Transport: &egressTransport{subsystem: subsystem, base: transport}}
+}
+
+func proxyStatusClass(status int) string {
+	if status == http.StatusProxyAuthRequired {
+		return "auth"
+	}
+	return "refused"
+}
+
+// egressTransport marks and counts the failures that happened at the proxy.
+type egressTransport struct {
+	subsystem string
+	base      *http.Transport
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	var proxyURL *url.URL
+	if t.base.Proxy != nil {
+		proxyURL, _ = t.base.Proxy(req)
+	}
+	if proxyURL == nil {
+		return resp, err
+	}
+
+	var pe *proxyError
+	var opErr *net.OpError
+	switch {
+	case err == nil && resp.StatusCode == http.StatusProxyAuthRequired:
+		// Plain http requests are forwarded without a tunnel, so the
+		// proxy answers them directly.
+		resp.Body.Close()
+		pe = &proxyError{Proxy: proxyURL.Redacted(), Class: "auth", Err: errors.New(resp.Status)}
+	case errors.As(err, &pe):
+	case errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+		pe = &proxyError{Proxy: proxyURL.Redacted(), Class: "connect", Err: err}
+	default:
+		return resp, err
+	}
+	proxyErrorsTotal.Inc(t.subsystem, pe.Class)
+	log.Warn("Egress proxy error", "subsystem", t.subsystem, "proxy", pe.Proxy, "class", pe.Class, "url", req.URL.Redacted(), "error", pe.Err)
+	return nil, pe
+}
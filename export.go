@@ -0,0 +1,488 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// exportFormatVersion 2 added commit statuses, guest grants, key
+// revocations, maintenance windows, repository requests and mirrors.
+const exportFormatVersion = 2
+
+// serverState is the manifest.json of an export archive. Custom repository
+// hooks and the LDAP permissions file travel alongside it as separate archive
+// entries.
+type serverState struct {
+	Version      int                 `json:"version"`
+	ExportedAt   time.Time           `json:"exported_at"`
+	Repos        []repoRecord        `json:"repos"`
+	Aliases      map[string]string   `json:"aliases"`
+	Webhooks     []exportedWebhook   `json:"webhooks"`
+	Tokens       []exportedToken     `json:"tokens"`
+	Protected    []exportedRule      `json:"protected_branches"`
+	Statuses     []exportedStatus    `json:"commit_statuses"`
+	GuestGrants  []guestGrant        `json:"guest_grants"`
+	Revocations  []keyRevocation     `json:"key_revocations"`
+	Maintenance  []maintenanceWindow `json:"maintenance"`
+	RepoRequests []repoRequest       `json:"repo_requests"`
+	Mirrors      []exportedMirror    `json:"mirrors"`
+	HookConfig   hookConfig          `json:"hook_config"`
+}
+
+type exportedWebhook struct {
+	Repo      string    `json:"repo"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportedRule struct {
+	Repo string `json:"repo"`
+	protectedBranch
+}
+
+type exportedStatus struct {
+	Repo string `json:"repo"`
+	commitStatus
+}
+
+// exportedMirror leaves out the mirror's health, which the new server
+// measures afresh.
+type exportedMirror struct {
+	Repo      string    `json:"repo"`
+	URL       string    `json:"url"`
+	Direction string    `json:"direction"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportedToken struct {
+	apiToken
+	Hash string `json:"token_hash"`
+}
+
+// hookConfig records the settings baked into the generated hooks. They come
+// from the environment, so import only warns when they differ.
+type hookConfig struct {
+	MaxFileSize     int64  `json:"max_file_size"`
+	AllowLFSTracked bool   `json:"allow_lfs_tracked"`
+	BackupUploadURL string `json:"backup_upload_url"`
+}
+
+const (
+	manifestEntry    = "manifest.json"
+	permissionsEntry = "permissions/ldap_permissions.json"
+	hooksPrefix      = "hooks/"
+)
+
+// managedHooks are regenerated by the server and therefore never exported.
+var managedHooks = map[string]bool{"pre-receive": true, "post-receive": true}
+
+// runCLI handles the export, import and hook subcommands. It reports whether
+// args named a subcommand.
+func runCLI(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "export", "import", "verify-audit":
+	case "hook":
+		os.Exit(runHook(args[1:]))
+	case "check":
+		if !reportSelfCheck(selfCheck()) {
+			os.Exit(1)
+		}
+		return true
+	default:
+		return false
+	}
+
+	var err error
+	store, err = openStore(config.DBDriver, config.DBDSN)
+	if err != nil {
+		log.Fatal("could not open metadata database", "error", err)
+	}
+	defer store.Close()
+	missingRoots := missingRepoRoots()
+	if err := store.checkRepoRoots(missingRoots); err != nil {
+		log.Fatal("refusing to run, mount the repository directory or fix its setting", "error", err)
+	}
+	for _, dir := range missingRoots {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Fatal("could not create the repository directory", "dir", dir, "error", err)
+		}
+	}
+	if err := store.syncRepos(); err != nil {
+		log.Fatal("could not sync repositories with the database", "error", err)
+	}
+
+	switch args[0] {
+	case "export":
+		out := os.Stdout
+		if len(args) > 1 && args[1] != "-" {
+			f, err := os.Create(args[1])
+			if err != nil {
+				log.Fatal("could not create export file", "error", err)
+			}
+			defer f.Close()
+			out = f
+		}
+		err = exportState(out)
+	case "import":
+		if len(args) != 2 {
+			log.Fatal("usage: git-server import <file|->")
+		}
+		in := os.Stdin
+		if args[1] != "-" {
+			f, err := os.Open(args[1])
+			if err != nil {
+				log.Fatal("could not open export file", "error", err)
+			}
+			defer f.Close()
+			in = f
+		}
+		err = importState(in)
+	case "verify-audit":
+		err = runVerifyAudit(args[1:])
+	}
+	if err != nil {
+		log.Fatal(args[0]+" failed", "error", err)
+	}
+	return true
+}
+
+func exportState(w io.Writer) error {
+	state := serverState{
+		Version:    exportFormatVersion,
+		ExportedAt: time.Now().UTC(),
+		HookConfig: hookConfig{
+			MaxFileSize:     config.MaxFileSize,
+			AllowLFSTracked: config.AllowLFSTracked,
+			BackupUploadURL: config.InternalServer,
+		},
+	}
+	var err error
+	if state.Repos, err = store.Repos("", ""); err != nil {
+		return fmt.Errorf("failed to list repositories: %w", err)
+	}
+	if state.Aliases, err = store.Aliases(); err != nil {
+		return fmt.Errorf("failed to list aliases: %w", err)
+	}
+	hooks, err := store.Webhooks("")
+	if err != nil {
+		return fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	for _, h := range hooks {
+		state.Webhooks = append(state.Webhooks, exportedWebhook{Repo: h.Repo, URL: h.URL, Secret: h.Secret, CreatedAt: h.CreatedAt})
+	}
+	tokens, hashes, err := store.tokensWithHashes()
+	if err != nil {
+		return fmt.Errorf("failed to list tokens: %w", err)
+	}
+	for i, t := range tokens {
+		state.Tokens = append(state.Tokens, exportedToken{apiToken: t, Hash: hashes[i]})
+	}
+	for _, repo := range state.Repos {
+		rules, err := store.ProtectedBranches(repo.Name)
+		if err != nil {
+			return fmt.Errorf("failed to list protected branches of %s: %w", repo.Name, err)
+		}
+		for _, rule := range rules {
+			state.Protected = append(state.Protected, exportedRule{Repo: repo.Name, protectedBranch: rule})
+		}
+	}
+	statuses, err := store.RepoCommitStatuses("")
+	if err != nil {
+		return fmt.Errorf("failed to list commit statuses: %w", err)
+	}
+	for _, cs := range statuses {
+		state.Statuses = append(state.Statuses, exportedStatus{Repo: cs.Repo, commitStatus: cs})
+	}
+	if state.GuestGrants, err = store.GuestGrants(""); err != nil {
+		return fmt.Errorf("failed to list guest grants: %w", err)
+	}
+	if state.Revocations, err = store.KeyRevocations(); err != nil {
+		return fmt.Errorf("failed to list key revocations: %w", err)
+	}
+	if state.Maintenance, err = store.MaintenanceWindows(); err != nil {
+		return fmt.Errorf("failed to list maintenance windows: %w", err)
+	}
+	if state.RepoRequests, err = store.RepoRequests(); err != nil {
+		return fmt.Errorf("failed to list repository requests: %w", err)
+	}
+	mirrors, err := store.Mirrors("")
+	if err != nil {
+		return fmt.Errorf("failed to list mirrors: %w", err)
+	}
+	for _, m := range mirrors {
+		state.Mirrors = append(state.Mirrors, exportedMirror{Repo: m.Repo, URL: m.URL, Direction: m.Direction, CreatedAt: m.CreatedAt})
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, manifestEntry, manifest, 0644); err != nil {
+		return err
+	}
+
+	if config.AuthBackend == "ldap" {
+		data, err := os.ReadFile(config.LDAPPermissionsFile)
+		if err != nil {
+			return fmt.Errorf("failed to read LDAP permissions: %w", err)
+		}
+		if err := writeTarFile(tw, permissionsEntry, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	hookCount := 0
+	for _, repo := range state.Repos {
+		dir := filepath.Join(repoDirPath(repo.Name), "hooks")
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("failed to read hooks of %s: %w", repo.Name, err)
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || managedHooks[name] || strings.HasSuffix(name, ".sample") {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return fmt.Errorf("failed to read hook %s of %s: %w", name, repo.Name, err)
+			}
+			if err := writeTarFile(tw, hooksPrefix+repo.Name+"/"+name, data, 0755); err != nil {
+				return err
+			}
+			hookCount++
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	log.Info("Exported server state", "repos", len(state.Repos), "aliases", len(state.Aliases),
+		"webhooks", len(state.Webhooks), "tokens", len(state.Tokens), "statuses", len(state.Statuses),
+		"guest_grants", len(state.GuestGrants), "revocations", len(state.Revocations), "mirrors", len(state.Mirrors), "hooks", hookCount)
+	return nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, mode int64) error {
+	hdr := &tar.Header{Name: name, Mode: mode, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// importState applies an export archive on top of the current state.
+// Repositories must already have been copied into the repo directory; records
+// for repositories that are missing on disk are skipped with a warning.
+func importState(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	var state *serverState
+	var permissions []byte
+	customHooks := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", hdr.Name, err)
+		}
+		switch {
+		case hdr.Name == manifestEntry:
+			state = &serverState{}
+			if err := json.Unmarshal(data, state); err != nil {
+				return fmt.Errorf("failed to parse manifest: %w", err)
+			}
+		case hdr.Name == permissionsEntry:
+			permissions = data
+		case strings.HasPrefix(hdr.Name, hooksPrefix):
+			customHooks[strings.TrimPrefix(hdr.Name, hooksPrefix)] = data
+		default:
+			log.Warn("Ignoring unknown archive entry", "name", hdr.Name)
+		}
+	}
+	if state == nil {
+		return errors.New("archive has no manifest.json")
+	}
+	if state.Version > exportFormatVersion {
+		return fmt.Errorf("archive format version %d is newer than this server supports", state.Version)
+	}
+
+	imported := map[string]bool{}
+	for _, repo := range state.Repos {
+		if !repoExists(repo.Name) {
+			log.Warn("Skipping repository missing on disk; copy it into the repo directory and import again", "repo", repo.Name)
+			continue
+		}
+		if err := store.ImportRepo(repo); err != nil {
+			return fmt.Errorf("failed to import repository %s: %w", repo.Name, err)
+		}
+		imported[repo.Name] = true
+	}
+	for alias, repo := range state.Aliases {
+		if !imported[repo] {
+			continue
+		}
+		if err := store.SetAlias(alias, repo); err != nil {
+			return fmt.Errorf("failed to import alias %s: %w", alias, err)
+		}
+	}
+	for _, h := range state.Webhooks {
+		if !imported[h.Repo] {
+			continue
+		}
+		if err := store.ImportWebhook(webhook{Repo: h.Repo, URL: h.URL, Secret: h.Secret, CreatedAt: h.CreatedAt}); err != nil {
+			return fmt.Errorf("failed to import webhook for %s: %w", h.Repo, err)
+		}
+	}
+	for _, rule := range state.Protected {
+		if !imported[rule.Repo] {
+			continue
+		}
+		rule.protectedBranch.Repo = rule.Repo
+		if err := store.SetProtectedBranch(rule.protectedBranch); err != nil {
+			return fmt.Errorf("failed to import protected branch %s of %s: %w", rule.Pattern, rule.Repo, err)
+		}
+	}
+	for _, t := range state.Tokens {
+		if err := store.ImportToken(t.apiToken, t.Hash); err != nil {
+			return fmt.Errorf("failed to import token %s: %w", t.Name, err)
+		}
+	}
+	for _, cs := range state.Statuses {
+		if !imported[cs.Repo] {
+			continue
+		}
+		cs.commitStatus.Repo = cs.Repo
+		if err := store.ImportCommitStatus(cs.commitStatus); err != nil {
+			return fmt.Errorf("failed to import commit status %s of %s: %w", cs.Context, cs.Repo, err)
+		}
+	}
+	for _, g := range state.GuestGrants {
+		if !imported[g.Repo] {
+			continue
+		}
+		if err := store.ImportGuestGrant(g); err != nil {
+			return fmt.Errorf("failed to import guest grant for %s: %w", g.Repo, err)
+		}
+	}
+	for _, k := range state.Revocations {
+		if err := store.ImportKeyRevocation(k); err != nil {
+			return fmt.Errorf("failed to import revocation of %s: %w", k.Fingerprint, err)
+		}
+	}
+	for _, m := range state.Maintenance {
+		if m.Repo != "" && !imported[m.Repo] {
+			continue
+		}
+		if err := store.SetMaintenance(m); err != nil {
+			return fmt.Errorf("failed to import maintenance window: %w", err)
+		}
+		if m.Repo == "" {
+			log.Warn("Imported a server-wide maintenance window; clear it with DELETE /api/maintenance once the migration is done", "message", m.Message)
+		}
+	}
+	for _, req := range state.RepoRequests {
+		if repoExists(req.Name) {
+			continue
+		}
+		if _, err := store.AddRepoRequest(req); err != nil {
+			return fmt.Errorf("failed to import repository request %s: %w", req.Name, err)
+		}
+	}
+	for _, m := range state.Mirrors {
+		if !imported[m.Repo] {
+			continue
+		}
+		if err := store.ImportMirror(mirror{Repo: m.Repo, URL: m.URL, Direction: m.Direction, CreatedAt: m.CreatedAt}); err != nil {
+			return fmt.Errorf("failed to import mirror of %s: %w", m.Repo, err)
+		}
+	}
+
+	for name, data := range customHooks {
+		repo, hook := path.Split(name)
+		repo = strings.TrimSuffix(repo, "/")
+		if !imported[repo] || managedHooks[hook] || !isValidRepoName(hook) {
+			continue
+		}
+		if err := writeHookFile(filepath.Join(repoDirPath(repo), "hooks", hook), data); err != nil {
+			return fmt.Errorf("failed to write hook %s of %s: %w", hook, repo, err)
+		}
+	}
+
+	if permissions != nil {
+		if err := importPermissions(permissions); err != nil {
+			return err
+		}
+	}
+	if state.HookConfig.MaxFileSize != config.MaxFileSize {
+		log.Warn("GIT_SERVER_MAX_FILE_SIZE differs from the exported server", "exported", state.HookConfig.MaxFileSize, "current", config.MaxFileSize)
+	}
+	if state.HookConfig.AllowLFSTracked != config.AllowLFSTracked {
+		log.Warn("GIT_SERVER_ALLOW_LFS_TRACKED differs from the exported server", "exported", state.HookConfig.AllowLFSTracked, "current", config.AllowLFSTracked)
+	}
+	if state.HookConfig.BackupUploadURL != config.InternalServer {
+		log.Warn("GIT_SERVER_AUTHORIZATION_SERVER_URL differs from the exported server", "exported", state.HookConfig.BackupUploadURL, "current", config.InternalServer)
+	}
+
+	audit("cli", "server.import", "", fmt.Sprintf("repos=%d exported_at=%s", len(imported), state.ExportedAt.Format(time.RFC3339)))
+	log.Info("Imported server state", "repos", len(imported), "skipped", len(state.Repos)-len(imported),
+		"aliases", len(state.Aliases), "webhooks", len(state.Webhooks), "tokens", len(state.Tokens), "statuses", len(state.Statuses),
+		"guest_grants", len(state.GuestGrants), "revocations", len(state.Revocations), "mirrors", len(state.Mirrors), "hooks", len(customHooks))
+	return nil
+}
+
+// importPermissions writes the LDAP permissions file unless a different one is
+// already in place.
+func importPermissions(data []byte) error {
+	existing, err := os.ReadFile(config.LDAPPermissionsFile)
+	switch {
+	case err == nil && bytes.Equal(existing, data):
+		return nil
+	case err == nil:
+		log.Warn("Keeping existing LDAP permissions file, which differs from the exported one", "file", config.LDAPPermissionsFile)
+		return nil
+	case !errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("failed to read LDAP permissions: %w", err)
+	}
+	if err := os.WriteFile(config.LDAPPermissionsFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write LDAP permissions: %w", err)
+	}
+	log.Info("Imported LDAP permissions", "file", config.LDAPPermissionsFile)
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/charmbracelet/wish/git"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func gitMiddleware(hooks git.Hooks) wish.Middleware {
+	return func(next ssh.Handler) ssh.Handler {
+		return func(sess ssh.Session) {
+			cmd := sess.Command()
+			if len(cmd) != 2 || !isGitCommand(cmd[0]) {
+				next(sess)
+				return
+			}
+
+			gc := cmd[0]
+			if gc == "git-receive-pack" {
+				if msg := disks.pushError(); msg != "" {
+					pushesRejectedTotal.Inc("disk_space")
+					gitError(sess, msg)
+					return
+				}
+			}
+
+			// The server-wide window is checked before asking the
+			// authorization backend, which may be what is being maintained.
+			if msg := maintenanceError("", gc == "git-receive-pack"); msg != "" {
+				rejectForMaintenance(sess, gc, msg)
+				return
+			}
+			repo := resolveRepo(strings.Trim(cmd[1], "/"))
+			pk := sess.PublicKey()
+			existed := repoExists(repo)
+			access := hooks.AuthRepo(repo, pk)
+			if access >= git.ReadOnlyAccess {
+				if msg := maintenanceError(repo, gc == "git-receive-pack"); msg != "" {
+					rejectForMaintenance(sess, gc, msg)
+					return
+				}
+			}
+			if access == git.NoAccess && (!config.AutoCreate || config.CreateApproval) && !repoExists(repo) && isKeyAuthorized(repo, pk) {
+				if config.CreateApproval && gc == "git-receive-pack" {
+					pushesRejectedTotal.Inc("pending_approval")
+					gitError(sess, requestRepoCreation(repo, pk))
+					return
+				}
+				gitError(sess, errRepoNotFound.Error())
+				return
+			}
+			// A push brings its own history; a repository created by a clone
+			// gets the initial template so it isn't empty.
+			if !existed && gc != "git-receive-pack" && config.InitTemplate != "" && repoExists(repo) {
+				if err := seedRepo(repo, config.InitTemplate, ""); err != nil {
+					sshLog.Error("Failed to seed repository", "repo", repo, "template", config.InitTemplate, "error", err)
+				}
+			}
+
+			var ctx context.Context = sess.Context()
+			if config.TransferTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, config.TransferTimeout)
+				defer cancel()
+			}
+			limiters, release := acquireLimiters(pk)
+			defer release()
+			r, w := throttle(ctx, sess, sess, limiters)
+			in := &meteredReader{r: r}
+			out := &meteredWriter{w: w}
+			fingerprint := gossh.FingerprintSHA256(pk)
+			stats := transferStats{Op: gitOperation(gc), Repo: repo, Fingerprint: fingerprint, KeyID: keyIDFor(fingerprint)}
+			start := time.Now()
+
+			switch gc {
+			case "git-receive-pack":
+				if access < git.ReadWriteAccess {
+					git.Fatal(sess, git.ErrNotAuthed)
+					return
+				}
+				if msg := quotaError(repo); msg != "" {
+					pushesRejectedTotal.Inc("quota")
+					gitError(sess, msg)
+					return
+				}
+				before := refSnapshot(repoDirPath(repo))
+				err := receivePack(ctx, in, out, repo, stats.Fingerprint)
+				after := refSnapshot(repoDirPath(repo))
+				stats.RefsUpdated = changedRefs(before, after)
+				recordActivity(refEvents(repo, stats.Fingerprint, before, after)...)
+				stats.Objects = in.pack.objects
+				stats.BytesIn, stats.BytesOut, stats.Duration = in.n, out.n, time.Since(start)
+				recordTransfer(stats, err)
+				if err != nil && transferTimedOut(ctx, sess, repo) {
+					return
+				}
+				if err != nil {
+					sshLog.Error("git-receive-pack failed", "repo", repo, "error", err)
+					git.Fatal(sess, git.ErrSystemMalfunction)
+					return
+				}
+				logBackupResults(repo, start)
+				audit(stats.Fingerprint, "push", repo, fmt.Sprintf("refs_updated=%d objects=%d", stats.RefsUpdated, stats.Objects))
+				deliverWebhooks(repo, "push", stats)
+				syncPushMirrors(repo)
+				hooks.Push(repo, pk)
+			default:
+				if access < git.ReadOnlyAccess {
+					git.Fatal(sess, git.ErrNotAuthed)
+					return
+				}
+				if !repoExists(repo) {
+					git.Fatal(sess, git.ErrInvalidRepo)
+					return
+				}
+				err := runGit(ctx, in, out, "", strings.TrimPrefix(gc, "git-"), repoDirPath(repo))
+				stats.Objects = out.pack.objects
+				stats.BytesIn, stats.BytesOut, stats.Duration = in.n, out.n, time.Since(start)
+				recordTransfer(stats, err)
+				if err != nil && transferTimedOut(ctx, sess, repo) {
+					return
+				}
+				if err != nil {
+					sshLog.Error("unknown git error", "repo", repo, "error", err)
+					git.Fatal(sess, git.ErrSystemMalfunction)
+					return
+				}
+				hooks.Fetch(repo, pk)
+			}
+		}
+	}
+}
+
+// transferTimedOut reports a transfer that GIT_SERVER_TRANSFER_TIMEOUT cut
+// short.
+func transferTimedOut(ctx context.Context, sess ssh.Session, repo string) bool {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return false
+	}
+	sshLog.Warn("Transfer timed out", "repo", repo, "timeout", config.TransferTimeout)
+	gitError(sess, fmt.Sprintf("transfer took longer than %s and was aborted", config.TransferTimeout))
+	return true
+}
+
+func rejectForMaintenance(sess ssh.Session, gc, msg string) {
+	if gc == "git-receive-pack" {
+		pushesRejectedTotal.Inc("maintenance")
+	}
+	gitError(sess, msg)
+}
+
+// gitError reports an error using the pkt-line ERR packet, which git clients
+// print as "remote error: <msg>".
+func gitError(sess ssh.Session, msg string) {
+	fmt.Fprintf(sess, "%04xERR %s\n", len(msg)+9, msg)
+	sess.Exit(1)
+}
+
+func isGitCommand(cmd string) bool {
+	switch cmd {
+	case "git-receive-pack", "git-upload-pack", "git-upload-archive":
+		return true
+	}
+	return false
+}
+
+func gitOperation(cmd string) string {
+	switch cmd {
+	case "git-receive-pack":
+		return "push"
+	case "git-upload-archive":
+		return "archive"
+	default:
+		return "fetch"
+	}
+}
+
+// gitWaitDelay bounds how long a killed git process may keep the session
+// open while its stdin is still being copied from the client.
+const gitWaitDelay = time.Second
+
+func receivePack(ctx context.Context, stdin io.Reader, stdout io.Writer, repo, pusher string) error {
+	path := repoDirPath(repo)
+	cmd := exec.CommandContext(ctx, "git", "receive-pack", path)
+	cmd.WaitDelay = gitWaitDelay
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Env = append(os.Environ(), hookEnv(repo, pusher)...)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if err := ensureDefaultBranch(path); err != nil {
+		return err
+	}
+	return exec.Command("git", "-C", path, "update-server-info").Run()
+}
+
+func runGit(ctx context.Context, stdin io.Reader, stdout io.Writer, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.WaitDelay = gitWaitDelay
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	return cmd.Run()
+}
+
+// ensureDefaultBranch points HEAD at the first pushed branch when the branch
+// HEAD refers to does not exist, so clones of a fresh repo check something out.
+func ensureDefaultBranch(path string) error {
+	if err := exec.Command("git", "-C", path, "rev-parse", "--verify", "--quiet", "HEAD").Run(); err == nil {
+		return nil
+	}
+	out, err := exec.Command("git", "-C", path, "for-each-ref", "--count=1", "--format=%(refname)", "refs/heads").Output()
+	if err != nil {
+		return err
+	}
+	branch := strings.TrimSpace(string(out))
+	if branch == "" {
+		return nil
+	}
+	return exec.Command("git", "-C", path, "symbolic-ref", "HEAD", branch).Run()
+}
+
+func repoDirPath(repo string) string {
+	if t := tenantFor(repo); t != nil {
+		return filepath.Join(t.RepoDir, repo)
+	}
+	return filepath.Join(config.RepoDir, repo)
+}
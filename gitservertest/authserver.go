@@ -0,0 +1,162 @@
+package gitservertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthorizedKey is one entry of an authorization server response.
+type AuthorizedKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// Upload is a backup artifact posted to /upload by the post-receive hook or
+// the backup reconciler.
+type Upload struct {
+	Repo   string
+	Commit string
+	Data   []byte
+}
+
+// AuthServer is an in-process stand-in for the authorization server. GET
+// /<repo> lists the keys allowed on the repository and POST /upload accepts
+// backups.
+type AuthServer struct {
+	URL string
+
+	srv      *httptest.Server
+	mu       sync.Mutex
+	keys     map[string][]AuthorizedKey
+	status   int
+	requests []string
+	uploads  []Upload
+}
+
+// NewAuthServer starts an authorization server. Close it when done; Start
+// does so for the server it creates.
+func NewAuthServer() *AuthServer {
+	a := &AuthServer{keys: map[string][]AuthorizedKey{}}
+	a.srv = httptest.NewServer(http.HandlerFunc(a.serveHTTP))
+	a.URL = a.srv.URL
+	return a
+}
+
+func (a *AuthServer) Close() {
+	a.srv.Close()
+}
+
+// Allow lets key push to and fetch from repo, or every repository if repo is
+// empty, identified as id.
+func (a *AuthServer) Allow(repo, id string, key Key) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys[repo] = append(a.keys[repo], AuthorizedKey{ID: id, Key: key.Public})
+}
+
+// Deny removes key from repo, or from the keys allowed on every repository if
+// repo is empty.
+func (a *AuthServer) Deny(repo string, key Key) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	kept := a.keys[repo][:0]
+	for _, k := range a.keys[repo] {
+		if k.Key != key.Public {
+			kept = append(kept, k)
+		}
+	}
+	a.keys[repo] = kept
+}
+
+// FailWith makes key lookups answer with status, e.g. 500 or 503, to test how
+// authorization failures are handled. 0 restores normal answers.
+func (a *AuthServer) FailWith(status int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.status = status
+}
+
+// Requests returns the method and path of every request received so far.
+func (a *AuthServer) Requests() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.requests...)
+}
+
+// Uploads returns the backups received so far.
+func (a *AuthServer) Uploads() []Upload {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Upload(nil), a.uploads...)
+}
+
+// WaitForUpload waits until a backup of commit in repo arrives. Backups are
+// uploaded after the push has been acknowledged, so they can lag behind it.
+func (a *AuthServer) WaitForUpload(repo, commit string, timeout time.Duration) (Upload, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, u := range a.Uploads() {
+			if u.Repo == repo && u.Commit == commit {
+				return u, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return Upload{}, fmt.Errorf("no upload of %s in %s after %s", commit, repo, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (a *AuthServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	a.requests = append(a.requests, r.Method+" "+r.URL.Path)
+	status := a.status
+	a.mu.Unlock()
+
+	if r.Method == http.MethodPost && r.URL.Path == "/upload" {
+		a.upload(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	repo := strings.TrimPrefix(r.URL.Path, "/")
+	a.mu.Lock()
+	keys := append(append([]AuthorizedKey{}, a.keys[""]...), a.keys[repo]...)
+	a.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (a *AuthServer) upload(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.mu.Lock()
+	a.uploads = append(a.uploads, Upload{Repo: r.FormValue("repo"), Commit: r.FormValue("commit"), Data: data})
+	a.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,389 @@
+// Package gitservertest runs git-server end to end for tests: the server is
+// built and started as a separate process on free ports with temporary
+// directories, keys are checked and backups received by an in-process
+// authorization server, and real git and ssh clients are driven against it.
+//
+//	func TestPush(t *testing.T) {
+//		srv := gitservertest.Start(t, gitservertest.Options{})
+//		work := srv.NewWorkTree(t)
+//		srv.Git(t, srv.Key, work, "push", srv.URL("demo"), "HEAD:main")
+//	}
+//
+// git, ssh and, for backups, curl must be on PATH.
+package gitservertest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	startTimeout = 30 * time.Second
+	stopTimeout  = 10 * time.Second
+)
+
+// Options configures Start.
+type Options struct {
+	// Binary is a git-server executable to run. If empty, GIT_SERVER_TEST_BINARY
+	// is used, or else the module is built once per test binary.
+	Binary string
+	// Env holds extra GIT_SERVER_* settings. They override the harness's
+	// defaults.
+	Env map[string]string
+}
+
+// Key is an SSH client key.
+type Key struct {
+	// Path is the private key file.
+	Path string
+	// Public is the key in authorized_keys format, with a comment.
+	Public      string
+	Fingerprint string
+}
+
+// Server is a running git-server.
+type Server struct {
+	// Dir is the server's working directory. RepoDir, BackupDir and the
+	// metadata database are inside it.
+	Dir        string
+	RepoDir    string
+	BackupDir  string
+	SSHPort    int
+	AdminURL   string
+	AdminToken string
+	Auth       *AuthServer
+	// Key is allowed on every repository by Auth.
+	Key Key
+
+	cmd     *exec.Cmd
+	logPath string
+	exited  chan struct{}
+	stopped sync.Once
+	keys    atomic.Int32
+}
+
+// Start builds git-server if needed and starts it. The server is stopped and
+// its directories removed when the test ends; if the test failed, the
+// server's log is printed.
+func Start(t testing.TB, opts Options) *Server {
+	t.Helper()
+	bin := opts.Binary
+	if bin == "" {
+		var err error
+		if bin, err = serverBinary(); err != nil {
+			t.Fatalf("gitservertest: %v", err)
+		}
+	}
+
+	dir := t.TempDir()
+	s := &Server{
+		Dir:        dir,
+		RepoDir:    filepath.Join(dir, "repos"),
+		BackupDir:  filepath.Join(dir, "repo_backups"),
+		AdminToken: "gitservertest",
+		Auth:       NewAuthServer(),
+		logPath:    filepath.Join(dir, "server.log"),
+		exited:     make(chan struct{}),
+	}
+	t.Cleanup(s.Auth.Close)
+	s.Key = s.NewKey(t)
+	s.Auth.Allow("", "test-key", s.Key)
+
+	sshPort, err := freePort()
+	if err != nil {
+		t.Fatalf("gitservertest: %v", err)
+	}
+	adminPort, err := freePort()
+	if err != nil {
+		t.Fatalf("gitservertest: %v", err)
+	}
+	s.SSHPort = sshPort
+	s.AdminURL = "http://127.0.0.1:" + strconv.Itoa(adminPort)
+
+	env := map[string]string{
+		"GIT_SERVER_HOST":                     "127.0.0.1",
+		"GIT_SERVER_PORT":                     strconv.Itoa(sshPort),
+		"GIT_SERVER_ADMIN_ADDR":               "127.0.0.1:" + strconv.Itoa(adminPort),
+		"GIT_SERVER_ADMIN_TOKEN":              s.AdminToken,
+		"GIT_SERVER_AUTHORIZATION_SERVER_URL": s.Auth.URL,
+		"GIT_SERVER_REPO_DIR":                 s.RepoDir,
+		"GIT_SERVER_BACKUP_DIR":               s.BackupDir,
+		"GIT_SERVER_DATA_DIR":                 filepath.Join(dir, "data"),
+		"GIT_SERVER_TRASH_DIR":                filepath.Join(dir, "trash"),
+		"GIT_SERVER_SSH_KEY_PATH":             filepath.Join(dir, ".ssh", "id_ed25519"),
+		"GIT_SERVER_DRAIN_TIMEOUT":            "5s",
+		"GIT_SERVER_AUTH_PROXY":               "direct",
+		"GIT_SERVER_WEBHOOK_PROXY":            "direct",
+		"GIT_SERVER_BACKUP_PROXY":             "direct",
+	}
+	for k, v := range opts.Env {
+		env[k] = v
+	}
+
+	logFile, err := os.Create(s.logPath)
+	if err != nil {
+		t.Fatalf("gitservertest: %v", err)
+	}
+	defer logFile.Close()
+	s.cmd = exec.Command(bin)
+	s.cmd.Dir = dir
+	s.cmd.Env = os.Environ()
+	for k, v := range env {
+		s.cmd.Env = append(s.cmd.Env, k+"="+v)
+	}
+	s.cmd.Stdout = logFile
+	s.cmd.Stderr = logFile
+	if err := s.cmd.Start(); err != nil {
+		t.Fatalf("gitservertest: failed to start %s: %v", bin, err)
+	}
+	go func() {
+		s.cmd.Wait()
+		close(s.exited)
+	}()
+	t.Cleanup(func() {
+		if err := s.Stop(); err != nil {
+			t.Errorf("gitservertest: %v", err)
+		}
+		if t.Failed() {
+			t.Logf("git-server log:\n%s", s.Logs())
+		}
+	})
+
+	if err := s.waitReady(); err != nil {
+		t.Fatalf("gitservertest: %v\n%s", err, s.Logs())
+	}
+	return s
+}
+
+func (s *Server) waitReady() error {
+	deadline := time.Now().Add(startTimeout)
+	for {
+		select {
+		case <-s.exited:
+			return fmt.Errorf("git-server exited during startup: %v", s.cmd.ProcessState)
+		default:
+		}
+		if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(s.SSHPort))); err == nil {
+			conn.Close()
+			if resp, err := http.Get(s.AdminURL + "/metrics"); err == nil {
+				resp.Body.Close()
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("git-server did not start listening within %s", startTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Stop shuts the server down as on Ctrl-C. It is called when the test ends
+// and may be called earlier, e.g. to inspect the directories afterwards.
+func (s *Server) Stop() error {
+	var err error
+	s.stopped.Do(func() {
+		select {
+		case <-s.exited:
+			return
+		default:
+		}
+		if err = s.cmd.Process.Signal(os.Interrupt); err != nil {
+			// Platforms without signals.
+			err = s.cmd.Process.Kill()
+		}
+		select {
+		case <-s.exited:
+		case <-time.After(stopTimeout):
+			s.cmd.Process.Kill()
+			<-s.exited
+			err = fmt.Errorf("git-server did not stop within %s", stopTimeout)
+		}
+	})
+	return err
+}
+
+// Logs returns what the server has logged so far.
+func (s *Server) Logs() string {
+	data, _ := os.ReadFile(s.logPath)
+	return string(data)
+}
+
+// URL is the clone URL of repo.
+func (s *Server) URL(repo string) string {
+	return fmt.Sprintf("ssh://git@127.0.0.1:%d/%s", s.SSHPort, repo)
+}
+
+// NewKey creates an ed25519 client key. It has no access until it is allowed
+// on the AuthServer.
+func (s *Server) NewKey(t testing.TB) Key {
+	t.Helper()
+	key, err := newKey(filepath.Join(s.Dir, "keys"), fmt.Sprintf("key%d", s.keys.Add(1)))
+	if err != nil {
+		t.Fatalf("gitservertest: %v", err)
+	}
+	return key
+}
+
+func newKey(dir, name string) (Key, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Key{}, err
+	}
+	block, err := gossh.MarshalPrivateKey(priv, name+"@gitservertest")
+	if err != nil {
+		return Key{}, err
+	}
+	sshPub, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		return Key{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Key{}, err
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return Key{}, err
+	}
+	return Key{
+		Path:        path,
+		Public:      strings.TrimSpace(string(gossh.MarshalAuthorizedKey(sshPub))) + " " + name + "@gitservertest",
+		Fingerprint: gossh.FingerprintSHA256(sshPub),
+	}, nil
+}
+
+func (s *Server) sshCommand(key Key) string {
+	return fmt.Sprintf("ssh -i %s -p %d -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=no -o UserKnownHostsFile=%s -o LogLevel=ERROR",
+		key.Path, s.SSHPort, os.DevNull)
+}
+
+// GitEnv is the environment for running git as key against the server, with
+// a fixed identity and without the user's or system's git configuration.
+func (s *Server) GitEnv(key Key) []string {
+	return append(os.Environ(),
+		"GIT_SSH_COMMAND="+s.sshCommand(key),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL="+os.DevNull,
+		"GIT_AUTHOR_NAME=gitservertest", "GIT_AUTHOR_EMAIL=gitservertest@localhost",
+		"GIT_COMMITTER_NAME=gitservertest", "GIT_COMMITTER_EMAIL=gitservertest@localhost",
+	)
+}
+
+// RunGit runs git in dir as key and returns its combined output.
+func (s *Server) RunGit(key Key, dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = s.GitEnv(key)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// Git is RunGit that fails the test if git does.
+func (s *Server) Git(t testing.TB, key Key, dir string, args ...string) string {
+	t.Helper()
+	out, err := s.RunGit(key, dir, args...)
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return out
+}
+
+// NewWorkTree creates a repository with one commit on main, ready to push.
+func (s *Server) NewWorkTree(t testing.TB) string {
+	t.Helper()
+	dir := t.TempDir()
+	s.Git(t, s.Key, dir, "init", "--quiet", "--initial-branch=main")
+	if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("# test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.Git(t, s.Key, dir, "add", "README.md")
+	s.Git(t, s.Key, dir, "commit", "--quiet", "-m", "Initial commit")
+	return dir
+}
+
+// SSH runs one of the server's SSH commands, such as whoami, as key and
+// returns its combined output.
+func (s *Server) SSH(key Key, args ...string) (string, error) {
+	sshArgs := strings.Fields(s.sshCommand(key))[1:]
+	cmd := exec.Command("ssh", append(append(sshArgs, "git@127.0.0.1"), args...)...)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// Admin sends an authenticated request to the admin API.
+func (s *Server) Admin(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.AdminURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.AdminToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return http.DefaultClient.Do(req)
+}
+
+var build struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// serverBinary returns GIT_SERVER_TEST_BINARY, or builds the module this
+// package belongs to. The build is shared by every test in the binary.
+func serverBinary() (string, error) {
+	if bin := os.Getenv("GIT_SERVER_TEST_BINARY"); bin != "" {
+		return bin, nil
+	}
+	build.once.Do(func() {
+		_, file, _, ok := runtime.Caller(0)
+		if !ok {
+			build.err = fmt.Errorf("cannot locate the git-server sources; set GIT_SERVER_TEST_BINARY")
+			return
+		}
+		dir, err := os.MkdirTemp("", "gitservertest-*")
+		if err != nil {
+			build.err = err
+			return
+		}
+		build.path = filepath.Join(dir, "git-server")
+		if runtime.GOOS == "windows" {
+			build.path += ".exe"
+		}
+		cmd := exec.Command("go", "build", "-o", build.path, ".")
+		cmd.Dir = filepath.Dir(filepath.Dir(file))
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			build.err = fmt.Errorf("failed to build git-server: %v\n%s", err, out.String())
+		}
+	})
+	return build.path, build.err
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,98 @@
+package gitservertest_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mirasel/git-server/gitservertest"
+)
+
+// requireTools skips the test unless the given clients are on PATH.
+func requireTools(t *testing.T, tools ...string) {
+	t.Helper()
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+}
+
+func TestCloneAndPush(t *testing.T) {
+	requireTools(t, "git", "ssh")
+	srv := gitservertest.Start(t, gitservertest.Options{})
+	work := srv.NewWorkTree(t)
+	srv.Git(t, srv.Key, work, "push", "--quiet", srv.URL("demo"), "HEAD:main")
+	want := strings.TrimSpace(srv.Git(t, srv.Key, work, "rev-parse", "HEAD"))
+
+	clone := filepath.Join(t.TempDir(), "demo")
+	srv.Git(t, srv.Key, "", "clone", "--quiet", srv.URL("demo"), clone)
+	if got := strings.TrimSpace(srv.Git(t, srv.Key, clone, "rev-parse", "HEAD")); got != want {
+		t.Fatalf("clone is at %s, pushed %s", got, want)
+	}
+	data, err := os.ReadFile(filepath.Join(clone, "README.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "# test\n" {
+		t.Fatalf("README.md = %q", data)
+	}
+
+	if err := os.WriteFile(filepath.Join(clone, "CHANGES.md"), []byte("- second\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv.Git(t, srv.Key, clone, "add", "CHANGES.md")
+	srv.Git(t, srv.Key, clone, "commit", "--quiet", "-m", "Second commit")
+	srv.Git(t, srv.Key, clone, "push", "--quiet", "origin", "main")
+	srv.Git(t, srv.Key, work, "pull", "--quiet", "--ff-only", srv.URL("demo"), "main")
+	if _, err := os.Stat(filepath.Join(work, "CHANGES.md")); err != nil {
+		t.Fatalf("second push did not reach the first work tree: %v", err)
+	}
+}
+
+func TestPushRefusedByAuthorizer(t *testing.T) {
+	requireTools(t, "git", "ssh")
+	srv := gitservertest.Start(t, gitservertest.Options{})
+	work := srv.NewWorkTree(t)
+	stranger := srv.NewKey(t)
+	if out, err := srv.RunGit(stranger, work, "push", srv.URL("demo"), "HEAD:main"); err == nil {
+		t.Fatalf("push with an unknown key succeeded:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(srv.RepoDir, "demo")); err == nil {
+		t.Fatal("refused push created the repository")
+	}
+
+	srv.Git(t, srv.Key, work, "push", "--quiet", srv.URL("demo"), "HEAD:main")
+	srv.Auth.Deny("", srv.Key)
+	if out, err := srv.RunGit(srv.Key, work, "push", srv.URL("demo"), "HEAD:refs/heads/other"); err == nil {
+		t.Fatalf("push with a denied key succeeded:\n%s", out)
+	}
+	found := false
+	for _, r := range srv.Auth.Requests() {
+		if r == "GET /demo" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("authorization server was not asked about demo: %v", srv.Auth.Requests())
+	}
+}
+
+func TestBackupUpload(t *testing.T) {
+	requireTools(t, "git", "ssh", "curl")
+	srv := gitservertest.Start(t, gitservertest.Options{})
+	work := srv.NewWorkTree(t)
+	srv.Git(t, srv.Key, work, "push", "--quiet", srv.URL("demo"), "HEAD:main")
+	commit := strings.TrimSpace(srv.Git(t, srv.Key, work, "rev-parse", "HEAD"))
+
+	upload, err := srv.Auth.WaitForUpload("demo", commit, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upload.Data) == 0 {
+		t.Fatal("backup upload is empty")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish/git"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Guest grants give one SSH key access to one repository for a limited time,
+// independently of the authorization backend. Expired grants stop working at
+// once and are removed by a janitor.
+
+const guestJanitorInterval = time.Minute
+
+// guestAccess returns the access granted to key on repo by an unexpired
+// guest grant, if there is one.
+func guestAccess(repo string, key ssh.PublicKey) (authorizedKey, git.AccessLevel, bool) {
+	if store == nil {
+		return authorizedKey{}, git.NoAccess, false
+	}
+	g, err := store.ActiveGuestGrant(repo, gossh.FingerprintSHA256(key))
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			authLog.Error("Failed to look up guest grant", "repo", repo, "error", err)
+		}
+		return authorizedKey{}, git.NoAccess, false
+	}
+	access := git.ReadOnlyAccess
+	if g.ReadWrite {
+		access = git.ReadWriteAccess
+	}
+	return authorizedKey{ID: fmt.Sprintf("guest-%d", g.ID), Key: g.PublicKey}, access, true
+}
+
+func expireGuestGrants() {
+	grants, err := store.GuestGrants("")
+	if err != nil {
+		log.Error("Failed to list guest grants", "error", err)
+		return
+	}
+	now := time.Now()
+	for _, g := range grants {
+		if g.ExpiresAt.After(now) {
+			continue
+		}
+		if err := store.DeleteGuestGrant(g.Repo, g.ID); err != nil && !errors.Is(err, errNotFound) {
+			log.Error("Failed to remove expired guest grant", "repo", g.Repo, "id", g.ID, "error", err)
+			continue
+		}
+		log.Info("Guest grant expired", "repo", g.Repo, "id", g.ID, "fingerprint", g.Fingerprint)
+		audit("janitor", "guest.expire", g.Repo, fmt.Sprintf("id=%d fingerprint=%s", g.ID, g.Fingerprint))
+	}
+}
+
+func runGuestJanitor(ctx context.Context, interval time.Duration) {
+	expireGuestGrants()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expireGuestGrants()
+		}
+	}
+}
+
+// generateGuestKey creates an ed25519 keypair for a guest who doesn't bring
+// their own key, returning the public key and the private key in OpenSSH
+// format.
+func generateGuestKey(comment string) (gossh.PublicKey, string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	block, err := gossh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return nil, "", err
+	}
+	sshPub, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		return nil, "", err
+	}
+	return sshPub, string(pem.EncodeToMemory(block)), nil
+}
+
+func listGuestGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	grants, err := store.GuestGrants(repo.Name)
+	if err != nil {
+		log.Error("Failed to list guest grants", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list guest grants")
+		return
+	}
+	writeJSON(w, http.StatusOK, grants)
+}
+
+// createGuestGrantHandler grants a key access to the repository until
+// expires_in has passed. Without a public_key a keypair is generated and its
+// private key returned; it is not stored and can't be retrieved again.
+func createGuestGrantHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		PublicKey string `json:"public_key"`
+		Access    string `json:"access"`
+		ExpiresIn string `json:"expires_in"`
+		Note      string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	g := guestGrant{Repo: repo.Name, Note: body.Note, CreatedBy: adminActor(r), CreatedAt: time.Now().UTC()}
+	switch body.Access {
+	case "", "read-only":
+	case "read-write":
+		g.ReadWrite = true
+	default:
+		writeError(w, http.StatusBadRequest, "access must be read-only or read-write")
+		return
+	}
+	ttl := config.GuestDefaultTTL
+	if body.ExpiresIn != "" {
+		d, err := parseDuration(body.ExpiresIn)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid expires_in duration")
+			return
+		}
+		ttl = d
+	}
+	if config.GuestMaxTTL > 0 && ttl > config.GuestMaxTTL {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("expires_in may be at most %s", config.GuestMaxTTL))
+		return
+	}
+	g.ExpiresAt = g.CreatedAt.Add(ttl)
+
+	var pub gossh.PublicKey
+	var privateKey string
+	if body.PublicKey != "" {
+		var err error
+		if pub, _, _, _, err = gossh.ParseAuthorizedKey([]byte(body.PublicKey)); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid public_key")
+			return
+		}
+	} else {
+		var err error
+		if pub, privateKey, err = generateGuestKey("guest@" + repo.Name); err != nil {
+			log.Error("Failed to generate guest key", "repo", repo.Name, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to generate key")
+			return
+		}
+	}
+	g.Fingerprint = gossh.FingerprintSHA256(pub)
+	g.PublicKey = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(pub)))
+
+	g, err := store.AddGuestGrant(g)
+	if err != nil {
+		log.Error("Failed to add guest grant", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to add guest grant")
+		return
+	}
+	access := "read-only"
+	if g.ReadWrite {
+		access = "read-write"
+	}
+	log.Info("Guest grant created", "repo", repo.Name, "id", g.ID, "fingerprint", g.Fingerprint, "access", access, "expires_at", g.ExpiresAt)
+	audit(adminActor(r), "guest.create", repo.Name, fmt.Sprintf("id=%d fingerprint=%s access=%s expires_at=%s", g.ID, g.Fingerprint, access, g.ExpiresAt.Format(time.RFC3339)))
+	writeJSON(w, http.StatusCreated, struct {
+		guestGrant
+		PrivateKey string `json:"private_key,omitempty"`
+		CloneURL   string `json:"clone_url"`
+	}{g, privateKey, fmt.Sprintf("ssh://%s/%s", cloneHost(), repo.Name)})
+}
+
+func deleteGuestGrantHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid grant ID")
+		return
+	}
+	err = store.DeleteGuestGrant(repo.Name, id)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, "guest grant not found")
+		return
+	}
+	if err != nil {
+		log.Error("Failed to revoke guest grant", "repo", repo.Name, "id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to revoke guest grant")
+		return
+	}
+	log.Info("Guest grant revoked", "repo", repo.Name, "id", id)
+	audit(adminActor(r), "guest.revoke", repo.Name, fmt.Sprintf("id=%d", id))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+)
+
+const defaultLogCount = 20
+
+func logCommand(sess ssh.Session, args []string) {
+	count := defaultLogCount
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-n" && i+1 < len(args):
+			i++
+			arg = "-n" + args[i]
+			fallthrough
+		case strings.HasPrefix(arg, "-n"):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "-n"))
+			if err != nil || n <= 0 {
+				wish.Fatalln(sess, "invalid count:", arg)
+				return
+			}
+			count = n
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) < 1 || len(positional) > 2 {
+		wish.Fatalln(sess, "usage: log <repo> [<rev>] [-n <count>]")
+		return
+	}
+
+	repoPath, ok := readableRepoPath(sess, positional[0])
+	if !ok {
+		return
+	}
+	rev := "HEAD"
+	if len(positional) == 2 {
+		rev = positional[1]
+	}
+	if !isSafeRev(rev) {
+		wish.Fatalln(sess, "invalid revision:", rev)
+		return
+	}
+
+	runPaged(sess, repoPath, "log", "-n", strconv.Itoa(count), "--decorate", rev, "--")
+}
+
+func showCommand(sess ssh.Session, args []string) {
+	if len(args) != 2 {
+		wish.Fatalln(sess, "usage: show <repo> <rev>")
+		return
+	}
+	repoPath, ok := readableRepoPath(sess, args[0])
+	if !ok {
+		return
+	}
+	if !isSafeRev(args[1]) {
+		wish.Fatalln(sess, "invalid revision:", args[1])
+		return
+	}
+
+	runPaged(sess, repoPath, "show", "--stat", "--patch", args[1], "--")
+}
+
+func readableRepoPath(sess ssh.Session, repo string) (string, bool) {
+	repo = resolveRepo(repo)
+	if !isValidRepoName(repo) {
+		wish.Fatalln(sess, "invalid repository name")
+		return "", false
+	}
+	repoPath := repoDirPath(repo)
+	if _, err := os.Stat(repoPath); err != nil || !isKeyAuthorized(repo, sess.PublicKey()) {
+		wish.Fatalln(sess, "repository not found or access denied")
+		return "", false
+	}
+	return repoPath, true
+}
+
+func isSafeRev(rev string) bool {
+	return rev != "" && !strings.HasPrefix(rev, "-") && !strings.ContainsAny(rev, " \t\n")
+}
+
+func runPaged(sess ssh.Session, repoPath string, args ...string) {
+	ctx, cancel := context.WithCancel(sess.Context())
+	defer cancel()
+
+	pty, winCh, isPty := sess.Pty()
+	color := "--color=never"
+	if isPty {
+		color = "--color=always"
+	}
+	gitArgs := append([]string{"-C", repoPath, "--no-pager", args[0], color}, args[1:]...)
+	cmd := exec.CommandContext(ctx, "git", gitArgs...)
+	cmd.Stderr = sess.Stderr()
+
+	if !isPty {
+		cmd.Stdout = sess
+		if err := cmd.Run(); err != nil {
+			sshLog.Debug("git command failed", "args", args, "error", err)
+			sess.Exit(1)
+		}
+		return
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		wish.Fatalln(sess, "failed to run git")
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		wish.Fatalln(sess, "failed to run git")
+		return
+	}
+	page(sess, stdout, pty.Window.Height, winCh)
+	cancel()
+	cmd.Wait()
+}
+
+// page writes lines one screen at a time and waits for a key press between
+// screens: space for the next page, enter for the next line, q to stop.
+func page(sess ssh.Session, r io.Reader, height int, winCh <-chan ssh.Window) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	keys := bufio.NewReader(sess)
+	if height <= 0 {
+		height = math.MaxInt
+	}
+
+	remaining := max(height-1, 1)
+	for scanner.Scan() {
+		if remaining == 0 {
+			fmt.Fprint(sess, "\x1b[7m-- more -- (space: page, enter: line, q: quit)\x1b[0m")
+			key, err := keys.ReadByte()
+			fmt.Fprint(sess, "\r\x1b[K")
+			if err != nil || key == 'q' || key == 'Q' || key == 3 {
+				return
+			}
+			for drained := false; !drained; {
+				select {
+				case win := <-winCh:
+					if win.Height > 0 {
+						height = win.Height
+					}
+				default:
+					drained = true
+				}
+			}
+			remaining = max(height-1, 1)
+			if key == '\r' || key == '\n' {
+				remaining = 1
+			}
+		}
+		fmt.Fprintf(sess, "%s\r\n", scanner.Text())
+		remaining--
+	}
+}
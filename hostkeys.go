@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type hostKey struct {
+	Type        string `json:"type"`
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+	KnownHosts  string `json:"known_hosts"`
+}
+
+// hostPublicKeys returns the public halves of the server's host keys.
+func hostPublicKeys() ([]gossh.PublicKey, error) {
+	data, err := os.ReadFile(config.SSHKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host key: %w", err)
+	}
+	signer, err := gossh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key: %w", err)
+	}
+	return []gossh.PublicKey{signer.PublicKey()}, nil
+}
+
+// knownHostsNames returns the names clients connect to, as known_hosts
+// patterns. They come from GIT_SERVER_HOSTNAMES, or from the listen address
+// and the machine's hostname.
+func knownHostsNames(hosts []string) []string {
+	if len(hosts) == 0 {
+		hosts = config.Hostnames
+	}
+	if len(hosts) == 0 {
+		if ip := net.ParseIP(config.Host); config.Host != "" && (ip == nil || !ip.IsUnspecified()) {
+			hosts = []string{config.Host}
+		} else if name, err := os.Hostname(); err == nil {
+			hosts = []string{name}
+		}
+	}
+	names := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, config.Port)
+		}
+		names = append(names, knownhosts.Normalize(h))
+	}
+	return names
+}
+
+func hostKeys(hosts []string) ([]hostKey, error) {
+	pubs, err := hostPublicKeys()
+	if err != nil {
+		return nil, err
+	}
+	names := knownHostsNames(hosts)
+	keys := make([]hostKey, 0, len(pubs))
+	for _, pub := range pubs {
+		keys = append(keys, hostKey{
+			Type:        pub.Type(),
+			PublicKey:   strings.TrimSpace(string(gossh.MarshalAuthorizedKey(pub))),
+			Fingerprint: gossh.FingerprintSHA256(pub),
+			KnownHosts:  knownhosts.Line(names, pub),
+		})
+	}
+	return keys, nil
+}
+
+// hostkeysCommand prints known_hosts lines for the server, for the given
+// host names if any.
+func hostkeysCommand(sess ssh.Session, args []string) {
+	keys, err := hostKeys(args)
+	if err != nil {
+		sshLog.Error("Failed to read host keys", "error", err)
+		wish.Fatalln(sess, "failed to read host keys")
+		return
+	}
+	for _, k := range keys {
+		fmt.Fprintln(sess, k.KnownHosts)
+	}
+}
+
+// hostKeysHandler serves the host keys as JSON, or as a known_hosts file with
+// format=known_hosts. host may be repeated to name the hosts to pin.
+func hostKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := hostKeys(r.URL.Query()["host"])
+	if err != nil {
+		log.Error("Failed to read host keys", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to read host keys")
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, keys)
+	case "known_hosts":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, k := range keys {
+			fmt.Fprintln(w, k.KnownHosts)
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "format must be json or known_hosts")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish/git"
+	"github.com/go-ldap/ldap/v3"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const ldapCacheTTL = time.Minute
+
+type ldapPermission struct {
+	Group  string `json:"group"`
+	Repos  string `json:"repos"`
+	Access string `json:"access"`
+
+	level git.AccessLevel
+}
+
+type ldapUser struct {
+	id      string
+	key     string
+	groups  []string
+	fetched time.Time
+}
+
+type ldapAuthorizer struct {
+	permissions []ldapPermission
+
+	mu    sync.Mutex
+	users map[string]ldapUser
+}
+
+func newLDAPAuthorizer() (*ldapAuthorizer, error) {
+	if config.LDAPURL == "" || config.LDAPBaseDN == "" {
+		return nil, fmt.Errorf("GIT_SERVER_LDAP_URL and GIT_SERVER_LDAP_BASE_DN are required for the ldap backend")
+	}
+	data, err := os.ReadFile(config.LDAPPermissionsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read LDAP permissions: %w", err)
+	}
+	var permissions []ldapPermission
+	if err := json.Unmarshal(data, &permissions); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", config.LDAPPermissionsFile, err)
+	}
+	for i, p := range permissions {
+		level, err := parseAccessLevel(p.Access)
+		if err != nil {
+			return nil, fmt.Errorf("permission for group %q: %w", p.Group, err)
+		}
+		if _, err := path.Match(p.Repos, ""); err != nil {
+			return nil, fmt.Errorf("permission for group %q: invalid repos pattern %q", p.Group, p.Repos)
+		}
+		permissions[i].level = level
+	}
+	return &ldapAuthorizer{permissions: permissions, users: map[string]ldapUser{}}, nil
+}
+
+func (a *ldapAuthorizer) Authorize(repo string, key ssh.PublicKey) (authorizedKey, git.AccessLevel) {
+	user, err := a.lookupUser(key)
+	if err != nil {
+		authLog.Error("LDAP lookup failed", "error", err)
+		return authorizedKey{}, git.NoAccess
+	}
+	if user.id == "" {
+		return authorizedKey{}, git.NoAccess
+	}
+
+	access := git.NoAccess
+	for _, p := range a.permissions {
+		if p.level <= access || !hasGroup(user.groups, p.Group) {
+			continue
+		}
+		if ok, _ := path.Match(p.Repos, repo); ok {
+			access = p.level
+		}
+	}
+	return authorizedKey{ID: user.id, Key: user.key}, access
+}
+
+func hasGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupUser finds the directory entry holding key. Results, including
+// "not found", are cached briefly because a single session may authorize
+// against many repositories.
+func (a *ldapAuthorizer) lookupUser(key ssh.PublicKey) (ldapUser, error) {
+	marshaledKey := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+
+	a.mu.Lock()
+	user, ok := a.users[marshaledKey]
+	a.mu.Unlock()
+	if ok && time.Since(user.fetched) < ldapCacheTTL {
+		return user, nil
+	}
+
+	start := time.Now()
+	conn, err := ldap.DialURL(config.LDAPURL, ldap.DialWithDialer(&net.Dialer{Timeout: config.HTTPTimeout}))
+	if err != nil {
+		observeAuth("ldap", start, authResultError, authErrorClass(err, "connection"))
+		return ldapUser{}, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(config.HTTPTimeout)
+
+	if config.LDAPBindDN != "" {
+		if err := conn.Bind(config.LDAPBindDN, config.LDAPBindPassword); err != nil {
+			observeAuth("ldap", start, authResultError, authErrorClass(err, "bind"))
+			return ldapUser{}, fmt.Errorf("failed to bind: %w", err)
+		}
+	}
+
+	filter := fmt.Sprintf("(&%s(%s=%s*))", config.LDAPUserFilter, config.LDAPKeyAttribute, ldap.EscapeFilter(marshaledKey))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		config.LDAPBaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(config.HTTPTimeout.Seconds()), false,
+		filter,
+		[]string{config.LDAPIDAttribute, config.LDAPKeyAttribute, config.LDAPGroupAttribute},
+		nil,
+	))
+	if err != nil {
+		observeAuth("ldap", start, authResultError, authErrorClass(err, "search"))
+		return ldapUser{}, fmt.Errorf("search failed: %w", err)
+	}
+	observeAuth("ldap", start, authResultOK, "")
+
+	user = ldapUser{fetched: time.Now()}
+	switch len(result.Entries) {
+	case 0:
+	case 1:
+		entry := result.Entries[0]
+		user.id = entry.GetAttributeValue(config.LDAPIDAttribute)
+		user.groups = entry.GetAttributeValues(config.LDAPGroupAttribute)
+		for _, k := range entry.GetAttributeValues(config.LDAPKeyAttribute) {
+			if strings.HasPrefix(k, marshaledKey) {
+				user.key = k
+			}
+		}
+	default:
+		authLog.Warn("SSH key is registered to several LDAP entries, denying access", "entries", len(result.Entries))
+	}
+
+	a.mu.Lock()
+	a.users[marshaledKey] = user
+	a.mu.Unlock()
+	return user, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// Component loggers can be given their own level through
+// GIT_SERVER_LOG_LEVEL, e.g. "warn,auth=debug".
+var (
+	authLog     = log.Default().WithPrefix("auth")
+	sshLog      = log.Default().WithPrefix("ssh")
+	hooksLog    = log.Default().WithPrefix("hooks")
+	backupLog   = log.Default().WithPrefix("backup")
+	webhooksLog = log.Default().WithPrefix("webhooks")
+)
+
+var componentLoggers = map[string]*log.Logger{
+	"auth":     authLog,
+	"ssh":      sshLog,
+	"hooks":    hooksLog,
+	"backup":   backupLog,
+	"webhooks": webhooksLog,
+}
+
+// configureLogging applies GIT_SERVER_LOG_LEVEL: a default level followed by
+// optional component=level overrides, separated by commas.
+func configureLogging(spec string) error {
+	level := log.InfoLevel
+	overrides := map[string]log.Level{}
+	for _, item := range splitList(spec) {
+		name, value, scoped := strings.Cut(item, "=")
+		if !scoped {
+			value = name
+		}
+		l, err := log.ParseLevel(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		if !scoped {
+			level = l
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := componentLoggers[name]; !ok {
+			return fmt.Errorf("unknown log component %q, expected one of auth, ssh, hooks, backup, webhooks", name)
+		}
+		overrides[name] = l
+	}
+
+	log.SetLevel(level)
+	for name, logger := range componentLoggers {
+		if l, ok := overrides[name]; ok {
+			logger.SetLevel(l)
+		} else {
+			logger.SetLevel(level)
+		}
+	}
+	return nil
+}
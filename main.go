@@ -14,6 +14,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -44,36 +45,42 @@ type authorizedKey struct {
 
 func (a app) AuthRepo(repo string, key ssh.PublicKey) git.AccessLevel {
 	if !isValidRepoName(repo) {
-		log.Warn("Invalid repository name", "repo", repo)
+		sshLog.Warn("Invalid repository name", "repo", repo)
 		return git.NoAccess
 	}
 
-	if isKeyAuthorized(repo, key) {
-		repoPath := filepath.Join(config.RepoDir, repo)
+	authKey, access := lookupKey(repo, key)
+	if access >= git.ReadWriteAccess {
+		repoPath := repoDirPath(repo)
 		if _, err := os.Stat(repoPath); os.IsNotExist(err) {
-			log.Info("Creating new repository", "repo", repo)
+			if !config.AutoCreate || config.CreateApproval {
+				sshLog.Info("Repository does not exist and auto-create is disabled", "repo", repo)
+				return git.NoAccess
+			}
+			sshLog.Info("Creating new repository", "repo", repo)
 
-			err := createBareRepoWithHook(repo)
+			err := createBareRepoWithHook(repo, authKey.ID)
 			if err != nil {
-				log.Error("Repository creation failed", "repo", repo)
+				sshLog.Error("Repository creation failed", "repo", repo, "error", err)
 				return git.NoAccess
 			}
+			audit(gossh.FingerprintSHA256(key), "repo.create", repo, "created on first push")
+			recordActivity(repoActivity(repo, gossh.FingerprintSHA256(key), activityRepoCreate))
 		}
-		return git.ReadWriteAccess
 	}
-	return git.NoAccess
+	return access
 }
 
 func (a app) Push(repo string, key ssh.PublicKey) {
-	log.Info("push", "repo", repo)
+	sshLog.Info("push", "repo", repo)
 }
 
 func (a app) Fetch(repo string, key ssh.PublicKey) {
-	log.Info("fetch", "repo", repo)
+	sshLog.Info("fetch", "repo", repo)
 }
 
 func (a app) Pull(repo string, key ssh.PublicKey) {
-	log.Info("pull", "repo", repo)
+	sshLog.Info("pull", "repo", repo)
 }
 
 func isValidRepoName(repo string) bool {
@@ -86,98 +93,273 @@ func isValidRepoName(repo string) bool {
 	return repoNameRegex.MatchString(repo)
 }
 
-func isKeyAuthorized(repo string, key ssh.PublicKey) bool {
-	client := &http.Client{Timeout: config.HTTPTimeout}
+func listRepos() ([]string, error) {
+	var repos []string
+	for _, dir := range repoRoots() {
+		// A missing directory is an error rather than no repositories, so
+		// an unmounted volume does not look like an empty server.
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			// Only count a directory where repoDirPath looks for it.
+			if entry.IsDir() && repoDirPath(entry.Name()) == filepath.Join(dir, entry.Name()) {
+				repos = append(repos, entry.Name())
+			}
+		}
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+// missingRepoRoots lists the repository directories that do not exist. It
+// runs before the self-check creates them.
+func missingRepoRoots() []string {
+	var missing []string
+	for _, dir := range repoRoots() {
+		if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, dir)
+		}
+	}
+	return missing
+}
+
+func cloneHost() string {
+	return net.JoinHostPort(config.Host, config.Port)
+}
+
+// httpAuthorizer asks an authorization server for the keys of a repository.
+// The zero value uses GIT_SERVER_AUTHORIZATION_SERVER_URL; tenants set their
+// own server and the backend name their metrics are recorded under.
+type httpAuthorizer struct {
+	backend string
+	url     string
+}
+
+func (h httpAuthorizer) Authorize(repo string, key ssh.PublicKey) (authorizedKey, git.AccessLevel) {
+	backend, server := h.backend, h.url
+	if server == "" {
+		backend, server = "http", config.InternalServer
+	}
+	client := newHTTPClient(egressAuth, config.HTTPTimeout)
 	marshaledKey := string(gossh.MarshalAuthorizedKey(key))
 
-	resp, err := client.Get(fmt.Sprintf("%s/%s", config.InternalServer, repo))
+	url := fmt.Sprintf("%s/%s", server, repo)
+	authLog.Debug("Querying authorization server", "url", url)
+	start := time.Now()
+	resp, err := client.Get(url)
 	if err != nil {
-		log.Error("Authorization check failed")
-		return false
+		class := authErrorClass(err, "connection")
+		observeAuth(backend, start, authResultError, class)
+		authLog.Error("Authorization check failed", "repo", repo, "class", class, "error", err)
+		return authorizedKey{}, git.NoAccess
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		observeAuth(backend, start, authResultError, "5xx")
+		authLog.Error("Authorization server returned an error", "repo", repo, "status", resp.StatusCode)
+		return authorizedKey{}, git.NoAccess
+	}
 	if resp.StatusCode != http.StatusOK {
-		return false
+		observeAuth(backend, start, authResultDenied, "")
+		authLog.Debug("Authorization server denied repository", "repo", repo, "status", resp.StatusCode)
+		return authorizedKey{}, git.NoAccess
 	}
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Error("Failed to read response")
-		return false
+		class := authErrorClass(err, "read")
+		observeAuth(backend, start, authResultError, class)
+		authLog.Error("Failed to read response", "repo", repo, "class", class, "error", err)
+		return authorizedKey{}, git.NoAccess
 	}
 
 	var authKeys []authorizedKey
 	if err := json.Unmarshal(data, &authKeys); err != nil {
-		log.Error("Invalid response format")
-		return false
+		observeAuth(backend, start, authResultError, "decode")
+		authLog.Error("Invalid response format", "repo", repo, "class", "decode", "error", err)
+		return authorizedKey{}, git.NoAccess
 	}
+	observeAuth(backend, start, authResultOK, "")
+	authLog.Debug("Authorization server listed keys", "repo", repo, "keys", len(authKeys))
 
 	for _, authKey := range authKeys {
 		keyPart := strings.Split(authKey.Key, " ")
 		keyWithoutUserIdentity := strings.Join(keyPart[0:len(keyPart)-1], " ")
 		if strings.TrimSpace(keyWithoutUserIdentity) == strings.TrimSpace(marshaledKey) {
-			return true
-		}
-	}
-	return false
-}
-
-func gitListMiddleware(next ssh.Handler) ssh.Handler {
-	return func(sess ssh.Session) {
-		if len(sess.Command()) != 0 {
-			next(sess)
-			return
-		}
-		dest, err := os.ReadDir(config.RepoDir)
-		if err != nil && err != fs.ErrNotExist {
-			log.Error("invalid repository", "error", err)
-		}
-		if len(dest) > 0 {
-			fmt.Fprintf(sess, "\n### Repo Menu ###\n\n")
+			return authKey, git.ReadWriteAccess
 		}
-		for _, dir := range dest {
-			fmt.Fprintf(sess, "• %s\n", dir.Name())
-			fmt.Fprintf(sess, "git clone ssh://%s/%s\n", net.JoinHostPort(config.Host, config.Port), dir.Name())
-		}
-		fmt.Fprintf(sess, "\n\n### Add some repos! ###\n\n")
-		fmt.Fprintf(sess, "> cd some_repo\n")
-		fmt.Fprintf(sess, "> git remote add wish_test ssh://%s/some_repo\n", net.JoinHostPort(config.Host, config.Port))
-		fmt.Fprintf(sess, "> git push wish_test\n\n\n")
-		next(sess)
 	}
+	return authorizedKey{}, git.NoAccess
 }
 
-func createBareRepoWithHook(repoName string) error {
+func createBareRepoWithHook(repoName, owner string) error {
 	repoMutex.Lock()
 	defer repoMutex.Unlock()
 
-	repoPath := filepath.Join(config.RepoDir, repoName)
+	repoPath := repoDirPath(repoName)
 
 	if _, err := os.Stat(repoPath); !os.IsNotExist(err) {
 		return nil
 	}
 
-	if err := os.MkdirAll(repoPath, 0755); err != nil {
+	if err := os.MkdirAll(repoPath, repoPerms.dirModeOr(0755)); err != nil {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	cmd := exec.Command("git", "init", "--bare", repoPath)
+	args := append([]string{"init", "--bare"}, repoPerms.initArgs()...)
+	cmd := exec.Command("git", append(args, repoPath)...)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to initialize repository: %w", err)
 	}
 
+	if err := installHooks(repoPath, repoName); err != nil {
+		return err
+	}
+	if err := applyRepoPermissions(repoPath); err != nil {
+		return err
+	}
+	if err := store.AddRepo(repoName, owner); err != nil {
+		return fmt.Errorf("failed to record repository: %w", err)
+	}
+	return nil
+}
+
+func installHooks(repoPath, repoName string) error {
+	if err := hideRefBackups(repoPath); err != nil {
+		return err
+	}
+	if err := createPreReceiveHook(repoPath); err != nil {
+		return err
+	}
 	return createPostReceiveHook(repoPath, repoName)
 }
 
+// refreshHooks rewrites the hooks of every repository so that they pick up
+// the current configuration and hook changes from newer server versions.
+func refreshHooks() {
+	repos, err := listRepos()
+	if err != nil {
+		hooksLog.Error("Failed to list repositories", "error", err)
+		return
+	}
+	for _, repo := range repos {
+		if err := installHooks(repoDirPath(repo), repo); err != nil {
+			hooksLog.Error("Failed to update hooks", "repo", repo, "error", err)
+		}
+	}
+}
+
+func createPreReceiveHook(repoPath string) error {
+	hookPath := filepath.Join(repoPath, "hooks", "pre-receive")
+	hookScript := fmt.Sprintf(`#!/bin/bash
+set -e
+
+MAX_FILE_SIZE=${GIT_SERVER_REPO_MAX_FILE_SIZE:-%d}
+ALLOW_LFS_TRACKED=%t
+ZERO="0000000000000000000000000000000000000000"
+UPDATES=$(cat)
+
+# Protected branch rules live in the server's database.
+if [ -n "$GIT_SERVER_BIN" ]; then
+	printf '%%s\n' "$UPDATES" | "$GIT_SERVER_BIN" hook pre-receive
+fi
+
+if [ "$MAX_FILE_SIZE" -le 0 ]; then
+	exit 0
+fi
+
+lfs_tracked() {
+	local rev="$1" path="$2" pattern attrs
+	while read -r pattern attrs; do
+		case "$attrs" in
+			*filter=lfs*) ;;
+			*) continue ;;
+		esac
+		if [[ "$pattern" == */* ]]; then
+			[[ "$path" == ${pattern#/} ]] && return 0
+		else
+			[[ "${path##*/}" == $pattern ]] && return 0
+		fi
+	done < <(git show "$rev:.gitattributes" 2>/dev/null)
+	return 1
+}
+
+# A path marked filter=lfs only proves a pointer was intended; the blob
+# itself must be one.
+lfs_pointer() {
+	git cat-file blob "$1" | head -c 100 | grep -q '^version https://git-lfs.github.com/spec/v1'
+}
+
+REJECTED=0
+while IFS=' ' read -r oldrev newrev refname; do
+	if [ -z "$newrev" ] || [ "$newrev" = "$ZERO" ]; then
+		continue
+	fi
+	
+	if [ "$oldrev" = "$ZERO" ]; then
+		RANGE="$newrev --not --all"
+	else
+		RANGE="$oldrev..$newrev"
+	fi
+	
+	while read -r type sha size path; do
+		if [ "$type" != "blob" ] || [ "$size" -le "$MAX_FILE_SIZE" ]; then
+			continue
+		fi
+		if [ "$ALLOW_LFS_TRACKED" = "true" ] && lfs_tracked "$newrev" "$path" && lfs_pointer "$sha"; then
+			continue
+		fi
+		echo "error: $path is $size bytes, which exceeds the $MAX_FILE_SIZE byte limit ($refname)" >&2
+		echo "hint: move it to Git LFS: git lfs track \"$path\" && git lfs migrate import --include=\"$path\"" >&2
+		REJECTED=1
+	done < <(git rev-list --objects $RANGE | git cat-file --batch-check='%%(objecttype) %%(objectname) %%(objectsize) %%(rest)')
+done <<< "$UPDATES"
+
+if [ "$REJECTED" -ne 0 ]; then
+	echo "push rejected: large files must be stored with Git LFS" >&2
+	exit 1
+fi
+`, config.MaxFileSize, config.AllowLFSTracked)
+
+	return writeHookFile(hookPath, []byte(hookScript))
+}
+
 func createPostReceiveHook(repoPath, repoName string) error {
 	hookPath := filepath.Join(repoPath, "hooks", "post-receive")
+	// The hook runs in the repository, which tenants keep at other depths.
+	backupRoot := filepath.Join("..", "..", config.BackupDir)
+	if absRepo, err := filepath.Abs(repoPath); err == nil {
+		if absBackups, err := filepath.Abs(config.BackupDir); err == nil {
+			if rel, err := filepath.Rel(absRepo, absBackups); err == nil {
+				backupRoot = rel
+			}
+		}
+	}
 	hookScript := fmt.Sprintf(`#!/bin/bash
 set -e
 
 BACKUP_ROOT="%s"
 REPO_NAME="%s"
 UPLOAD_URL="%s/upload"
+UPDATES=$(cat)
+
+# GIT_SERVER_BACKUP_PROXY overrides the proxy environment; curl only reads
+# the lower-case http_proxy.
+PROXY_ARGS=()
+case "${GIT_SERVER_BACKUP_PROXY:-}" in
+	"") export http_proxy="${http_proxy:-${HTTP_PROXY:-}}" ;;
+	direct) PROXY_ARGS=(--noproxy '*') ;;
+	*) PROXY_ARGS=(--proxy "$GIT_SERVER_BACKUP_PROXY") ;;
+esac
+
+# Keep the previous tips of deleted and force-updated refs, and sign a push
+# receipt if enabled.
+if [ -n "$GIT_SERVER_BIN" ]; then
+	printf '%%s\n' "$UPDATES" | "$GIT_SERVER_BIN" hook post-receive || true
+fi
 
 while IFS=' ' read -r oldrev newrev refname; do
 	if [ "$newrev" = "0000000000000000000000000000000000000000" ]; then
@@ -191,48 +373,214 @@ while IFS=' ' read -r oldrev newrev refname; do
 	mkdir -p "$DEST_DIR"
 	git archive "$newrev" --format=zip -o "$DEST_PATH"
 	
-	curl -X POST "$UPLOAD_URL" \
+	CONNECT=$(curl "${PROXY_ARGS[@]}" -X POST "$UPLOAD_URL" \
 		-F "repo=$REPO_NAME" \
 		-F "commit=$newrev" \
 		-F "file=@$DEST_PATH" \
 		--max-time 30 \
 		--retry 3 \
-		--fail --silent --show-error || echo "Upload failed for $newrev"
-done
-`, filepath.Join("..", "..", config.BackupDir), repoName, config.InternalServer)
+		--fail --silent --show-error \
+		--output /dev/null --write-out '%%{http_connect} %%{http_code}') && CURL_EXIT=0 || CURL_EXIT=$?
+	read -r CONNECT HTTP_CODE <<< "$CONNECT"
+	if [ "$CURL_EXIT" -eq 0 ]; then
+		STATUS=ok
+	elif [ "$CURL_EXIT" -eq 5 ] || [ "$CURL_EXIT" -eq 97 ] || { [ "$CURL_EXIT" -eq 7 ] && [ "${PROXY_ARGS[0]:-}" = --proxy ]; }; then
+		# The proxy's name didn't resolve, it couldn't be reached or its
+		# handshake failed.
+		STATUS=proxy_connect
+	elif [ "$CONNECT" = "407" ] || [ "$HTTP_CODE" = "407" ]; then
+		STATUS=proxy_auth
+	elif [ "$CONNECT" != "000" ] && [ "$CONNECT" != "200" ]; then
+		STATUS=proxy_refused
+	else
+		STATUS=failed
+	fi
+	if [ "$STATUS" != ok ]; then
+		echo "Upload failed for $newrev ($STATUS)"
+	fi
+	echo "$(date +%%s) $newrev $STATUS" >> "$DEST_DIR/uploads.log"
+done <<< "$UPDATES"
+`, backupRoot, repoName, backupServer(repoName))
 
-	return os.WriteFile(hookPath, []byte(hookScript), 0755)
+	return writeHookFile(hookPath, []byte(hookScript))
 }
 
 func main() {
+	if err := configureLogging(config.LogLevel); err != nil {
+		log.Fatal("invalid GIT_SERVER_LOG_LEVEL", "error", err)
+	}
+	if config.Umask != "" {
+		mask, err := parseUmask(config.Umask)
+		if err == nil {
+			err = setUmask(mask)
+		}
+		if err != nil {
+			log.Fatal("invalid GIT_SERVER_UMASK", "error", err)
+		}
+	}
+	var err error
+	tenants, err = loadTenants(config.TenantsFile)
+	if err != nil {
+		log.Fatal("could not load tenants", "error", err)
+	}
+	if runCLI(os.Args[1:]) {
+		return
+	}
 	a := app{config: config}
+	// The store is opened before the self-check creates missing repository
+	// directories, so a directory that should hold repositories is noticed.
+	store, err = openStore(config.DBDriver, config.DBDSN)
+	if err != nil {
+		log.Fatal("could not open metadata database", "error", err)
+	}
+	defer store.Close()
+	if err := store.checkRepoRoots(missingRepoRoots()); err != nil {
+		log.Fatal("refusing to start, mount the repository directory or fix its setting", "error", err)
+	}
+	if !reportSelfCheck(selfCheck()) {
+		log.Fatal("self-check failed, fix the problems above and restart")
+	}
+
+	repoPerms, err = loadRepoPermissions()
+	if err != nil {
+		log.Fatal("invalid repository permissions", "error", err)
+	}
+	authorizer, err = newAuthorizer()
+	if err != nil {
+		log.Fatal("could not configure authorization", "error", err)
+	}
+	if len(tenants) > 0 {
+		authorizer = tenantAuthorizer{fallback: authorizer}
+		log.Info("Multi-tenant mode", "tenants", len(tenants))
+	}
+	if err := store.syncRepos(); err != nil {
+		log.Fatal("could not sync repositories with the database", "error", err)
+	}
+	aliases, err = loadAliases(store, filepath.Join(config.DataDir, "aliases.json"))
+	if err != nil {
+		log.Fatal("could not load repository aliases", "error", err)
+	}
+	auditSigner, err = loadAuditSigner(config.AuditSigningKey)
+	if err != nil {
+		log.Fatal("could not load the audit signing key", "error", err)
+	}
+	checkRepoNameCollisions()
+	checkRepoSuffixDuplicates()
+	refreshHooks()
 
 	s, err := wish.NewServer(
 		wish.WithAddress(net.JoinHostPort(config.Host, config.Port)),
 		wish.WithHostKeyPath(config.SSHKeyPath),
+		wish.WithIdleTimeout(config.IdleTimeout),
 		ssh.PublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool {
+			if fingerprint := gossh.FingerprintSHA256(key); keyRevoked(fingerprint) {
+				authLog.Warn("Rejected revoked key", "fingerprint", fingerprint, "remote_addr", ctx.RemoteAddr())
+				return false
+			}
 			return true
 		}),
 		wish.WithMiddleware(
-			git.Middleware(config.RepoDir, a),
-			// gitListMiddleware, // uncomment to see SSH interface, (basically available repos and clone instructions)
-			logging.Middleware(),
+			gitMiddleware(a),
+			commandMiddleware,
+			gitListMiddleware,
+			sessionMiddleware,
+			commandFilterMiddleware,
+			logging.StructuredMiddlewareWithLogger(sshLog, log.InfoLevel),
 		),
 	)
 	if err != nil {
 		log.Fatal("could not start server", "error", err)
 	}
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	if config.MinFreeSpace > 0 {
+		go disks.run(bgCtx, config.DiskCheckInterval)
+	}
+	if config.BackupReconcileInterval > 0 {
+		go runBackupReconciler(bgCtx, config.BackupReconcileInterval)
+	}
+	if config.AuthSummaryInterval > 0 {
+		go runAuthSummary(bgCtx, config.AuthSummaryInterval)
+	}
+	if config.TrashRetention > 0 {
+		go runTrashJanitor(bgCtx, trashJanitorInterval)
+	}
+	go runGuestJanitor(bgCtx, guestJanitorInterval)
+	go runRevocationEnforcer(bgCtx, revocationCheckInterval)
+	if config.SearchIndex {
+		go indexUnindexedRepos(bgCtx)
+	}
+	if config.MirrorInterval > 0 {
+		go runMirrorMonitor(bgCtx, config.MirrorInterval)
+	}
+	if auditSigner != nil && config.AuditSignInterval > 0 {
+		go runAuditSigner(bgCtx, config.AuditSignInterval)
+	}
+
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	if len(restartSignals) > 0 {
+		signal.Notify(hup, restartSignals...)
+	}
+
+	listeners := map[string]net.Listener{}
+	sshListener, err := listen("ssh", net.JoinHostPort(config.Host, config.Port))
+	if err != nil {
+		log.Fatal("could not start server", "error", err)
+	}
+	listeners["ssh"] = sshListener
 	log.Info("Starting SSH server", "host", config.Host, "port", config.Port)
 	go func() {
-		if err := s.ListenAndServe(); err != nil && !errors.Is(err, ssh.ErrServerClosed) {
+		if err := s.Serve(sshListener); err != nil && !errors.Is(err, ssh.ErrServerClosed) {
 			log.Error("could not start server", "error", err)
 			done <- nil
 		}
 	}()
-	<-done
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+	servers := []drainer{s}
+	if !adminAPIEnabled() {
+		log.Warn("Neither GIT_SERVER_ADMIN_TOKEN nor GIT_SERVER_OIDC_ISSUER is set, admin API disabled")
+		if l, _ := inheritedListener("admin"); l != nil {
+			l.Close()
+		}
+	} else {
+		admin := newAdminServer()
+		adminListener, err := listen("admin", config.AdminAddr)
+		if err != nil {
+			log.Fatal("could not start admin API", "error", err)
+		}
+		listeners["admin"] = adminListener
+		servers = append(servers, admin)
+		log.Info("Starting admin API", "addr", config.AdminAddr)
+		go func() {
+			if err := admin.Serve(adminListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error("could not start admin API", "error", err)
+			}
+		}()
+	}
+	notifyReady()
+	writePIDFile()
+
+	timeout := 30 * time.Second
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		case <-hup:
+			log.Info("Restarting, handing listeners to a new process")
+			if err := restart(listeners); err != nil {
+				log.Error("Restart failed, continuing to serve", "error", err)
+				continue
+			}
+			log.Info("New process is serving, draining sessions", "active_sessions", len(sessions.List()), "timeout", config.DrainTimeout)
+			timeout = config.DrainTimeout
+			break wait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	s.Shutdown(ctx)
+	drain(ctx, servers...)
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// useTestStore gives the test a repository directory and metadata database of
+// its own, restoring the server's globals afterwards.
+func useTestStore(t *testing.T) {
+	t.Helper()
+	savedConfig, savedStore, savedAliases := config, store, aliases
+	config.DataDir = t.TempDir()
+	config.RepoDir = t.TempDir()
+	s, err := openStore("sqlite", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	aliases = &aliasStore{db: s, aliases: map[string]string{}}
+	t.Cleanup(func() {
+		s.Close()
+		config, store, aliases = savedConfig, savedStore, savedAliases
+	})
+}
+
+// addTestRepo creates an empty repository directory and its record.
+func addTestRepo(t *testing.T, name string) {
+	t.Helper()
+	if err := os.MkdirAll(repoDirPath(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddRepo(name, ""); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// maintenanceError returns the rejection for a git operation on repo while a
+// maintenance window covers it, or "" if the operation may proceed. An empty
+// repo checks the server-wide window only. Fetches are refused only by
+// windows that block them.
+func maintenanceError(repo string, push bool) string {
+	if store == nil {
+		return ""
+	}
+	m, err := store.Maintenance(repo)
+	if errors.Is(err, errNotFound) {
+		return ""
+	}
+	if err != nil {
+		log.Error("Failed to look up maintenance window", "repo", repo, "error", err)
+		return ""
+	}
+	if !push && !m.BlockFetch {
+		return ""
+	}
+	return m.describe()
+}
+
+func (m maintenanceWindow) describe() string {
+	subject := "server"
+	if m.Repo != "" {
+		subject = m.Repo
+	}
+	message := m.Message
+	if message == "" {
+		message = config.MaintenanceMessage
+	}
+	msg := fmt.Sprintf("%s is in maintenance: %s", subject, message)
+	switch {
+	case m.ETA == nil:
+	case time.Until(*m.ETA) > 0:
+		left := strings.TrimSuffix(time.Until(*m.ETA).Round(time.Minute).String(), "0s")
+		if left == "" {
+			left = "under a minute"
+		}
+		msg += fmt.Sprintf(" (expected back at %s, in %s)", m.ETA.UTC().Format("2006-01-02 15:04 MST"), left)
+	default:
+		msg += " (expected back shortly)"
+	}
+	return msg
+}
+
+func listMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	windows, err := store.MaintenanceWindows()
+	if err != nil {
+		log.Error("Failed to list maintenance windows", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list maintenance windows")
+		return
+	}
+	writeJSON(w, http.StatusOK, windows)
+}
+
+// maintenanceScope returns the repository a maintenance request applies to,
+// or "" for the server-wide routes.
+func maintenanceScope(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.PathValue("name") == "" {
+		return "", true
+	}
+	repo, ok := lookupRepoRecord(w, r)
+	return repo.Name, ok
+}
+
+func getMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := maintenanceScope(w, r)
+	if !ok {
+		return
+	}
+	m, err := store.Maintenance(repo)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, "not in maintenance")
+		return
+	}
+	if err != nil {
+		log.Error("Failed to load maintenance window", "repo", repo, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load maintenance window")
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func putMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := maintenanceScope(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Message    string     `json:"message"`
+		ETA        *time.Time `json:"eta"`
+		BlockFetch bool       `json:"block_fetch"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.ETA != nil && !body.ETA.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "eta must be in the future")
+		return
+	}
+	m := maintenanceWindow{Repo: repo, Message: body.Message, ETA: body.ETA, BlockFetch: body.BlockFetch, Actor: adminActor(r), StartedAt: time.Now()}
+	if err := store.SetMaintenance(m); err != nil {
+		log.Error("Failed to start maintenance", "repo", repo, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to start maintenance")
+		return
+	}
+	// An update keeps the original start time.
+	if stored, err := store.Maintenance(repo); err == nil {
+		m = stored
+	}
+	writeJSON(w, http.StatusOK, m)
+	log.Warn("Maintenance mode enabled", "repo", repo, "block_fetch", m.BlockFetch, "message", m.Message)
+	eta := ""
+	if m.ETA != nil {
+		eta = m.ETA.UTC().Format(time.RFC3339)
+	}
+	audit(m.Actor, "maintenance.start", repo, fmt.Sprintf("block_fetch=%t eta=%s message=%q", m.BlockFetch, eta, m.Message))
+}
+
+func deleteMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := maintenanceScope(w, r)
+	if !ok {
+		return
+	}
+	err := store.ClearMaintenance(repo)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, "not in maintenance")
+		return
+	}
+	if err != nil {
+		log.Error("Failed to end maintenance", "repo", repo, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to end maintenance")
+		return
+	}
+	log.Info("Maintenance mode disabled", "repo", repo)
+	audit(adminActor(r), "maintenance.end", repo, "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal Prometheus text-format registry; the server only needs counters,
+// gauges and histograms with a handful of labels.
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	registryMu.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryMu.Unlock()
+	for _, c := range collectors {
+		c.writeTo(w)
+	}
+}
+
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+type counterVec struct{ metricVec }
+
+type gaugeVec struct{ metricVec }
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{metricVec{name: name, help: help, kind: "counter", labels: labels, values: map[string]float64{}}}
+	register(c)
+	return c
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{metricVec{name: name, help: help, kind: "gauge", labels: labels, values: map[string]float64{}}}
+	register(g)
+	return g
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	c.add(v, labelValues)
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+func (g *gaugeVec) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[labelKey(labelValues)] = v
+}
+
+// Delete drops the series, e.g. of a removed mirror.
+func (g *gaugeVec) Delete(labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.values, labelKey(labelValues))
+}
+
+func (g *gaugeVec) Add(v float64, labelValues ...string) {
+	g.add(v, labelValues)
+}
+
+func (m *metricVec) add(v float64, labelValues []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[labelKey(labelValues)] += v
+}
+
+func (m *metricVec) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, splitLabelKey(key), "", ""), formatFloat(m.values[key]))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := labelKey(labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		values := splitLabelKey(key)
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values, "", ""), s.count)
+	}
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func splitLabelKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		if i < len(values) {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Repositories can have push mirrors, which receive every push, and pull
+// mirrors, which are fetched from. Every GIT_SERVER_MIRROR_INTERVAL each
+// mirror is synced and the branch and tag tips on both sides are compared.
+// A mirror that has not synced successfully for GIT_SERVER_MIRROR_STALE_AFTER
+// raises an alert, which is cleared by the next successful sync.
+
+const (
+	mirrorPush = "push"
+	mirrorPull = "pull"
+
+	mirrorSyncTimeout = 10 * time.Minute
+)
+
+var (
+	mirrorSyncsTotal   = newCounterVec("git_server_mirror_syncs_total", "Mirror syncs by direction and result.", "direction", "status")
+	mirrorDivergedRefs = newGaugeVec("git_server_mirror_diverged_refs", "Branches and tags whose tips differ between a repository and its mirror.", "repo", "mirror")
+	mirrorLastSuccess  = newGaugeVec("git_server_mirror_last_success_timestamp_seconds", "Unix time of the last successful sync of a mirror.", "repo", "mirror")
+	mirrorStale        = newGaugeVec("git_server_mirror_stale", "1 while a mirror has not synced successfully within GIT_SERVER_MIRROR_STALE_AFTER.", "repo", "mirror")
+)
+
+var (
+	// mirrorLocks serializes syncs of one mirror, which pushes and the
+	// periodic run can start at the same time.
+	mirrorLocks sync.Map
+
+	mirrorAlertsMu sync.Mutex
+	mirrorAlerting = map[int64]bool{}
+)
+
+// scpLikeURL matches git's user@host:path form of SSH URLs.
+var scpLikeURL = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/]`)
+
+// checkMirrorURL accepts remote URLs only, so that a mirror cannot read or
+// write other repositories on the server's disk.
+func checkMirrorURL(raw string) error {
+	if scpLikeURL.MatchString(raw) {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New("url must be an http, https, ssh or git URL, or user@host:path")
+	}
+	switch u.Scheme {
+	case "http", "https", "ssh", "git":
+		return nil
+	}
+	return fmt.Errorf("unsupported mirror URL scheme %q", u.Scheme)
+}
+
+// redactURL hides the password of a URL with credentials.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
+
+// redacted is the mirror as shown to admins and alert receivers. Errors are
+// redacted when they are recorded.
+func (m mirror) redacted() mirror {
+	m.URL = redactURL(m.URL)
+	return m
+}
+
+func (m mirror) label() string {
+	return strconv.FormatInt(m.ID, 10)
+}
+
+// mirrorProxy returns the proxy that git uses for an http(s) mirror URL, or
+// nil when it connects directly.
+func mirrorProxy(raw string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	proxy, err := parseProxySetting(config.MirrorProxy)
+	if err != nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	if proxy == nil {
+		return nil
+	}
+	proxyURL, _ := proxy(&http.Request{URL: u})
+	return proxyURL
+}
+
+// gitProxyErrorClass picks the proxy failure out of git's error output,
+// which comes from curl and differs between curl versions. The classes are
+// those of proxyError.
+func gitProxyErrorClass(stderr string) string {
+	switch {
+	case strings.Contains(stderr, "CONNECT tunnel failed, response 407"),
+		strings.Contains(stderr, "Received HTTP code 407 from proxy"),
+		strings.Contains(stderr, "returned error: 407"):
+		return "auth"
+	case strings.Contains(stderr, "CONNECT tunnel failed"), strings.Contains(stderr, "from proxy after CONNECT"):
+		return "refused"
+	case strings.Contains(stderr, "Failed to connect to"), strings.Contains(stderr, "Could not resolve proxy"):
+		return "connect"
+	}
+	return ""
+}
+
+// mirrorGit runs git in the mirror's repository without prompting for
+// credentials, and keeps the mirror's password out of its errors. http(s)
+// mirrors go through GIT_SERVER_MIRROR_PROXY, like the HTTP clients of the
+// other subsystems.
+func mirrorGit(ctx context.Context, m mirror, args ...string) (string, error) {
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if os.Getenv("GIT_SSH_COMMAND") == "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+	}
+	proxy := mirrorProxy(m.URL)
+	switch config.MirrorProxy {
+	case "":
+		// git reads the proxy from the environment itself.
+	case "direct":
+		env = append(env, "NO_PROXY=*", "no_proxy=*")
+	default:
+		// Passed in the environment rather than with -c, which would
+		// show the proxy's credentials in the process list.
+		if proxy != nil {
+			env = append(env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.proxy", "GIT_CONFIG_VALUE_0="+proxy.String())
+		}
+	}
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", repoDirPath(m.Repo)}, args...)...)
+	cmd.Env = env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.ReplaceAll(strings.TrimSpace(stderr.String()), m.URL, redactURL(m.URL))
+		if proxy != nil {
+			if class := gitProxyErrorClass(msg); class != "" {
+				proxyErrorsTotal.Inc(egressMirror, class)
+				log.Warn("Egress proxy error", "subsystem", egressMirror, "proxy", proxy.Redacted(), "class", class, "url", redactURL(m.URL), "error", msg)
+			}
+		}
+		return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, msg)
+	}
+	return string(out), nil
+}
+
+// syncMirror pushes to or fetches from the mirror, compares the ref tips and
+// records the result.
+func syncMirror(ctx context.Context, m mirror) mirror {
+	lock, _ := mirrorLocks.LoadOrStore(m.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	ctx, cancel := context.WithTimeout(ctx, mirrorSyncTimeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	m.LastSyncAt = &now
+	var err error
+	switch m.Direction {
+	case mirrorPush:
+		// git refuses refspecs that match nothing, e.g. in an empty
+		// repository.
+		if len(mirrorRefs(m.Repo)) > 0 {
+			_, err = mirrorGit(ctx, m, "push", "--force", "--prune", m.URL, "refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*")
+		}
+	case mirrorPull:
+		before := refSnapshot(repoDirPath(m.Repo))
+		_, err = mirrorGit(ctx, m, "fetch", "--prune", "--force", m.URL, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+		if err == nil && config.SearchIndex && changedRefs(before, refSnapshot(repoDirPath(m.Repo))) > 0 {
+			if err := reindexRepo(m.Repo); err != nil {
+				log.Warn("Failed to reindex pulled mirror", "repo", m.Repo, "error", err)
+			}
+		}
+	}
+	if err != nil {
+		mirrorSyncsTotal.Inc(m.Direction, "failed")
+		m.LastError = err.Error()
+		log.Warn("Mirror sync failed", "repo", m.Repo, "mirror", m.ID, "direction", m.Direction, "url", redactURL(m.URL), "error", err)
+	} else {
+		mirrorSyncsTotal.Inc(m.Direction, "ok")
+		m.LastError = ""
+		m.LastSuccessAt = &now
+		log.Debug("Mirror synced", "repo", m.Repo, "mirror", m.ID, "direction", m.Direction)
+	}
+
+	if diverged, err := compareMirror(ctx, m); err != nil {
+		if m.LastError == "" {
+			m.LastError = err.Error()
+		}
+	} else {
+		checked := time.Now().UTC()
+		m.CheckedAt, m.DivergedRefs = &checked, diverged
+		if diverged > 0 {
+			log.Warn("Mirror has diverged", "repo", m.Repo, "mirror", m.ID, "direction", m.Direction, "refs", diverged)
+		}
+	}
+	if err := store.UpdateMirrorHealth(m); err != nil {
+		log.Error("Failed to record mirror health", "repo", m.Repo, "mirror", m.ID, "error", err)
+	}
+	updateMirrorMetrics(m)
+	checkMirrorStaleness(m, time.Now())
+	return m
+}
+
+// compareMirror counts the branches and tags whose tips differ between the
+// repository and the mirror, including those that exist on one side only.
+func compareMirror(ctx context.Context, m mirror) (int, error) {
+	out, err := mirrorGit(ctx, m, "ls-remote", "--refs", m.URL, "refs/heads/*", "refs/tags/*")
+	if err != nil {
+		return 0, err
+	}
+	remote := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if sha, ref, ok := strings.Cut(line, "\t"); ok {
+			remote[ref] = sha
+		}
+	}
+	local := mirrorRefs(m.Repo)
+	diverged := 0
+	for ref, sha := range local {
+		if remote[ref] != sha {
+			diverged++
+		}
+	}
+	for ref := range remote {
+		if _, ok := local[ref]; !ok {
+			diverged++
+		}
+	}
+	return diverged, nil
+}
+
+// mirrorRefs returns the branches and tags of repo, the refs that mirrors
+// carry.
+func mirrorRefs(repo string) map[string]string {
+	refs := map[string]string{}
+	for ref, sha := range refSnapshot(repoDirPath(repo)) {
+		if strings.HasPrefix(ref, "refs/heads/") || strings.HasPrefix(ref, "refs/tags/") {
+			refs[ref] = sha
+		}
+	}
+	return refs
+}
+
+func updateMirrorMetrics(m mirror) {
+	mirrorDivergedRefs.Set(float64(m.DivergedRefs), m.Repo, m.label())
+	if m.LastSuccessAt != nil {
+		mirrorLastSuccess.Set(float64(m.LastSuccessAt.Unix()), m.Repo, m.label())
+	}
+}
+
+func forgetMirrorMetrics(m mirror) {
+	mirrorDivergedRefs.Delete(m.Repo, m.label())
+	mirrorLastSuccess.Delete(m.Repo, m.label())
+	mirrorStale.Delete(m.Repo, m.label())
+	mirrorAlertsMu.Lock()
+	delete(mirrorAlerting, m.ID)
+	mirrorAlertsMu.Unlock()
+}
+
+// mirrorIsStale reports whether the mirror has not synced successfully, or
+// since it was added, for longer than GIT_SERVER_MIRROR_STALE_AFTER.
+func mirrorIsStale(m mirror, now time.Time) bool {
+	if config.MirrorStaleAfter <= 0 {
+		return false
+	}
+	since := m.CreatedAt
+	if m.LastSuccessAt != nil {
+		since = *m.LastSuccessAt
+	}
+	return now.Sub(since) > config.MirrorStaleAfter
+}
+
+// checkMirrorStaleness raises an alert when the mirror becomes stale and
+// resolves it once it has synced again.
+func checkMirrorStaleness(m mirror, now time.Time) {
+	stale := mirrorIsStale(m, now)
+	mirrorAlertsMu.Lock()
+	wasStale := mirrorAlerting[m.ID]
+	if stale {
+		mirrorAlerting[m.ID] = true
+	} else {
+		delete(mirrorAlerting, m.ID)
+	}
+	mirrorAlertsMu.Unlock()
+
+	if stale {
+		mirrorStale.Set(1, m.Repo, m.label())
+	} else {
+		mirrorStale.Set(0, m.Repo, m.label())
+	}
+	switch {
+	case stale && !wasStale:
+		log.Warn("Mirror is stale", "repo", m.Repo, "mirror", m.ID, "direction", m.Direction, "last_success", m.LastSuccessAt, "threshold", config.MirrorStaleAfter, "error", m.LastError)
+		sendMirrorAlert(m, "firing")
+	case wasStale && !stale:
+		log.Info("Mirror recovered", "repo", m.Repo, "mirror", m.ID, "direction", m.Direction)
+		sendMirrorAlert(m, "resolved")
+	}
+}
+
+type mirrorAlert struct {
+	Repo          string     `json:"repo"`
+	Mirror        int64      `json:"mirror"`
+	URL           string     `json:"url"`
+	Direction     string     `json:"direction"`
+	Status        string     `json:"status"`
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	DivergedRefs  int        `json:"diverged_refs"`
+	StaleAfter    float64    `json:"stale_after_seconds"`
+	Time          time.Time  `json:"time"`
+}
+
+// sendMirrorAlert posts the alert to GIT_SERVER_MIRROR_ALERT_URL, if
+// configured.
+func sendMirrorAlert(m mirror, status string) {
+	if config.MirrorAlertURL == "" {
+		return
+	}
+	m = m.redacted()
+	body, err := json.Marshal(mirrorAlert{
+		Repo:          m.Repo,
+		Mirror:        m.ID,
+		URL:           m.URL,
+		Direction:     m.Direction,
+		Status:        status,
+		LastSuccessAt: m.LastSuccessAt,
+		LastError:     m.LastError,
+		DivergedRefs:  m.DivergedRefs,
+		StaleAfter:    config.MirrorStaleAfter.Seconds(),
+		Time:          time.Now().UTC(),
+	})
+	if err != nil {
+		log.Error("Failed to encode mirror alert", "error", err)
+		return
+	}
+	client := newHTTPClient(egressMirror, config.HTTPTimeout)
+	resp, err := client.Post(config.MirrorAlertURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warn("Failed to send mirror alert", "url", config.MirrorAlertURL, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Warn("Mirror alert rejected", "url", config.MirrorAlertURL, "status", resp.Status)
+	}
+}
+
+// syncPushMirrors updates the push mirrors of repo in the background after a
+// push.
+func syncPushMirrors(repo string) {
+	mirrors, err := store.Mirrors(repo)
+	if err != nil {
+		log.Error("Failed to load mirrors", "repo", repo, "error", err)
+		return
+	}
+	for _, m := range mirrors {
+		if m.Direction == mirrorPush {
+			go syncMirror(context.Background(), m)
+		}
+	}
+}
+
+// runMirrorMonitor syncs and compares every mirror each interval.
+func runMirrorMonitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		syncAllMirrors(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func syncAllMirrors(ctx context.Context) {
+	mirrors, err := store.Mirrors("")
+	if err != nil {
+		log.Error("Failed to load mirrors", "error", err)
+		return
+	}
+	for _, m := range mirrors {
+		if ctx.Err() != nil {
+			return
+		}
+		if !repoExists(m.Repo) {
+			continue
+		}
+		syncMirror(ctx, m)
+	}
+}
+
+func listAllMirrorsHandler(w http.ResponseWriter, r *http.Request) {
+	mirrors, err := store.Mirrors("")
+	if err != nil {
+		log.Error("Failed to list mirrors", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list mirrors")
+		return
+	}
+	writeMirrors(w, mirrors)
+}
+
+func listMirrorsHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	mirrors, err := store.Mirrors(repo.Name)
+	if err != nil {
+		log.Error("Failed to list mirrors", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list mirrors")
+		return
+	}
+	writeMirrors(w, mirrors)
+}
+
+// mirrorStatus is a mirror as reported by the admin API.
+type mirrorStatus struct {
+	mirror
+	Stale bool `json:"stale"`
+}
+
+func newMirrorStatus(m mirror, now time.Time) mirrorStatus {
+	return mirrorStatus{mirror: m.redacted(), Stale: mirrorIsStale(m, now)}
+}
+
+func writeMirrors(w http.ResponseWriter, mirrors []mirror) {
+	now := time.Now()
+	list := make([]mirrorStatus, 0, len(mirrors))
+	for _, m := range mirrors {
+		list = append(list, newMirrorStatus(m, now))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func addMirrorHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		URL       string `json:"url"`
+		Direction string `json:"direction"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.Direction != mirrorPush && body.Direction != mirrorPull {
+		writeError(w, http.StatusBadRequest, "direction must be push or pull")
+		return
+	}
+	if err := checkMirrorURL(body.URL); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	m, err := store.AddMirror(repo.Name, body.URL, body.Direction)
+	if err != nil {
+		log.Error("Failed to add mirror", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to add mirror")
+		return
+	}
+	audit(adminActor(r), "mirror.add", repo.Name, fmt.Sprintf("direction=%s url=%s", m.Direction, redactURL(m.URL)))
+	go syncMirror(context.Background(), m)
+	writeJSON(w, http.StatusCreated, m.redacted())
+}
+
+func deleteMirrorHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid mirror id")
+		return
+	}
+	err = store.DeleteMirror(repo.Name, id)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, "mirror not found")
+		return
+	}
+	if err != nil {
+		log.Error("Failed to delete mirror", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete mirror")
+		return
+	}
+	forgetMirrorMetrics(mirror{ID: id, Repo: repo.Name})
+	audit(adminActor(r), "mirror.delete", repo.Name, fmt.Sprintf("id=%d", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// syncMirrorHandler syncs a mirror right away and returns its health.
+func syncMirrorHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid mirror id")
+		return
+	}
+	mirrors, err := store.Mirrors(repo.Name)
+	if err != nil {
+		log.Error("Failed to list mirrors", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list mirrors")
+		return
+	}
+	for _, m := range mirrors {
+		if m.ID == id {
+			m = syncMirror(r.Context(), m)
+			writeJSON(w, http.StatusOK, newMirrorStatus(m, time.Now()))
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "mirror not found")
+}
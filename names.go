@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	repoNameCaseSensitive   = "sensitive"
+	repoNameCaseInsensitive = "insensitive"
+)
+
+// resolveRepo maps a name from a client onto a repository. Like repository
+// names, aliases are found with or without a trailing ".git".
+func resolveRepo(name string) string {
+	if base := strings.TrimSuffix(name, ".git"); base != "" {
+		if repo, ok := aliases.Lookup(base); ok {
+			return repo
+		}
+	}
+	if repo, ok := aliases.Lookup(name); ok {
+		return repo
+	}
+	return normalizeRepoName(name)
+}
+
+// normalizeRepoName maps name onto the existing repository it refers to:
+// a trailing ".git" is optional, and in case-insensitive mode the case of the
+// name is ignored. Names of new repositories are returned without the suffix
+// (and lowercased in case-insensitive mode). Ambiguous names resolve to "",
+// which is rejected as invalid.
+func normalizeRepoName(name string) string {
+	base := strings.TrimSuffix(name, ".git")
+	if base == "" {
+		return name
+	}
+	for _, candidate := range []string{base, base + ".git"} {
+		repo, err := findRepo(candidate)
+		if err != nil {
+			log.Warn("Ambiguous repository name", "repo", name, "error", err)
+			return ""
+		}
+		if repo != "" {
+			return repo
+		}
+	}
+	if config.RepoNameCase == repoNameCaseInsensitive {
+		return strings.ToLower(base)
+	}
+	return base
+}
+
+// findRepo returns the existing repository called name, in case-insensitive
+// mode regardless of case. Candidates come from the database, which indexes
+// the folded names, rather than from a scan of the repository directories.
+func findRepo(name string) (string, error) {
+	if repoExists(name) {
+		return name, nil
+	}
+	if config.RepoNameCase != repoNameCaseInsensitive {
+		return "", nil
+	}
+
+	candidates, err := foldedRepoNames(name)
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, repo := range candidates {
+		if strings.EqualFold(repo, name) && repoExists(repo) {
+			matches = append(matches, repo)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", nil
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%q matches %s", name, strings.Join(matches, ", "))
+	}
+}
+
+// foldedRepoNames lists the repositories that may match name regardless of
+// case. When the database is not open the repository directories are read.
+func foldedRepoNames(name string) ([]string, error) {
+	if store != nil {
+		return store.ReposByFoldedName(name)
+	}
+	return listRepos()
+}
+
+func repoNameCollisions() ([][]string, error) {
+	repos, err := listRepos()
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string][]string{}
+	for _, repo := range repos {
+		key := strings.ToLower(repo)
+		groups[key] = append(groups[key], repo)
+	}
+	var collisions [][]string
+	for _, group := range groups {
+		if len(group) > 1 {
+			sort.Strings(group)
+			collisions = append(collisions, group)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i][0] < collisions[j][0] })
+	return collisions, nil
+}
+
+func checkRepoNameCollisions() {
+	collisions, err := repoNameCollisions()
+	if err != nil {
+		log.Error("Failed to check repository names", "error", err)
+		return
+	}
+	for _, group := range collisions {
+		if config.RepoNameCase == repoNameCaseInsensitive {
+			log.Warn("Repositories differ only by case and cannot be resolved case-insensitively; rename or merge them", "repos", group)
+		} else {
+			log.Warn("Repositories differ only by case", "repos", group)
+		}
+	}
+}
+
+type duplicateRepo struct {
+	Repo           string   `json:"repo"`
+	Duplicate      string   `json:"duplicate"`
+	MissingRefs    []string `json:"missing_refs"`
+	Recommendation string   `json:"recommendation"`
+}
+
+// repoSuffixDuplicates reports pairs of repositories that only differ by a
+// ".git" suffix. Clients are routed to the repository without the suffix, so
+// the duplicate is checked for refs whose commits the canonical repository
+// does not have.
+func repoSuffixDuplicates() ([]duplicateRepo, error) {
+	repos, err := listRepos()
+	if err != nil {
+		return nil, err
+	}
+	var duplicates []duplicateRepo
+	for _, repo := range repos {
+		base := strings.TrimSuffix(repo, ".git")
+		if base == repo || base == "" || !repoExists(base) {
+			continue
+		}
+		missing, err := missingRefs(base, repo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare %s with %s: %w", repo, base, err)
+		}
+		dup := duplicateRepo{Repo: base, Duplicate: repo, MissingRefs: missing}
+		if len(missing) == 0 {
+			dup.Recommendation = fmt.Sprintf("%s has everything in %s; the duplicate can be deleted", base, repo)
+		} else {
+			dup.Recommendation = fmt.Sprintf("fetch the missing refs into %s (git -C %s fetch ../%s 'refs/heads/*:refs/heads/%s/*') and delete the duplicate",
+				base, repoDirPath(base), repo, repo)
+		}
+		duplicates = append(duplicates, dup)
+	}
+	return duplicates, nil
+}
+
+func missingRefs(repo, duplicate string) ([]string, error) {
+	out, err := exec.Command("git", "-C", repoDirPath(duplicate), "for-each-ref", "--format=%(objectname) %(refname)").Output()
+	if err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		sha, ref, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		if exec.Command("git", "-C", repoDirPath(repo), "cat-file", "-e", sha).Run() != nil {
+			missing = append(missing, ref)
+		}
+	}
+	return missing, nil
+}
+
+func checkRepoSuffixDuplicates() {
+	duplicates, err := repoSuffixDuplicates()
+	if err != nil {
+		log.Error("Failed to check repository names", "error", err)
+		return
+	}
+	for _, dup := range duplicates {
+		log.Warn("Repository has a .git duplicate that is no longer reachable", "repo", dup.Repo, "duplicate", dup.Duplicate, "missing_refs", len(dup.MissingRefs))
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestNormalizeRepoName(t *testing.T) {
+	useTestStore(t)
+	addTestRepo(t, "demo")
+	addTestRepo(t, "legacy.git")
+	addTestRepo(t, "Mixed")
+
+	tests := []struct {
+		name, want string
+	}{
+		{"demo", "demo"},
+		{"demo.git", "demo"},
+		{"legacy", "legacy.git"},
+		{"legacy.git", "legacy.git"},
+		{"new", "new"},
+		{"new.git", "new"},
+		{"Mixed", "Mixed"},
+		{"mixed", "mixed"},
+		{"NewRepo", "NewRepo"},
+		{".git", ".git"},
+	}
+	for _, tt := range tests {
+		if got := normalizeRepoName(tt.name); got != tt.want {
+			t.Errorf("normalizeRepoName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeRepoNameCaseInsensitive(t *testing.T) {
+	useTestStore(t)
+	config.RepoNameCase = repoNameCaseInsensitive
+	addTestRepo(t, "demo")
+	addTestRepo(t, "Mixed")
+	addTestRepo(t, "Twin")
+	addTestRepo(t, "twin")
+
+	tests := []struct {
+		name, want string
+	}{
+		{"DEMO", "demo"},
+		{"Demo.git", "demo"},
+		{"mixed", "Mixed"},
+		{"MIXED.git", "Mixed"},
+		{"NewRepo", "newrepo"},
+		{"NewRepo.git", "newrepo"},
+		{"Twin", "Twin"},
+		// Neither exists under this spelling and both match it.
+		{"TWIN", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeRepoName(tt.name); got != tt.want {
+			t.Errorf("normalizeRepoName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveRepoAliases(t *testing.T) {
+	useTestStore(t)
+	addTestRepo(t, "new-name")
+	if err := aliases.Set("old-name", "new-name"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"old-name", "old-name.git", "new-name", "new-name.git"} {
+		if got := resolveRepo(name); got != "new-name" {
+			t.Errorf("resolveRepo(%q) = %q, want new-name", name, got)
+		}
+	}
+	if got := resolveRepo("Old-Name"); got != "Old-Name" {
+		t.Errorf("resolveRepo(Old-Name) = %q with case-sensitive names", got)
+	}
+
+	config.RepoNameCase = repoNameCaseInsensitive
+	for _, name := range []string{"OLD-NAME", "Old-Name.git"} {
+		if got := resolveRepo(name); got != "new-name" {
+			t.Errorf("resolveRepo(%q) = %q, want new-name", name, got)
+		}
+	}
+}
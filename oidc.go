@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwksCacheTTL      = time.Hour
+	jwksRefreshPeriod = time.Minute
+	jwtClockSkew      = time.Minute
+	// minRSAKeyBits rejects RSA signing keys too short to be trusted.
+	minRSAKeyBits = 2048
+)
+
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	client   *http.Client
+
+	mu      sync.Mutex
+	jwksURI string
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newOIDCVerifier(issuer, audience string) *oidcVerifier {
+	return &oidcVerifier{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		client:   newHTTPClient(egressAuth, config.HTTPTimeout),
+	}
+}
+
+// Verify checks the signature, issuer, audience and validity period of a JWT
+// and returns its claims.
+func (v *oidcVerifier) Verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !slices.Contains(claimStrings(claims, "aud"), v.audience) {
+		return nil, errors.New("token is not intended for this audience")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtClockSkew)) {
+		return nil, errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the signing key with the given ID, refetching the JWKS when the
+// cache is stale or the key is unknown (e.g. after the provider rotated keys).
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetched) > jwksCacheTTL
+	if ok && !stale {
+		return key, nil
+	}
+	if !stale && time.Since(v.fetched) < jwksRefreshPeriod {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := v.refresh(); err != nil {
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (v *oidcVerifier) refresh() error {
+	v.fetched = time.Now()
+	if v.jwksURI == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return err
+		}
+		if discovery.JWKSURI == "" {
+			return errors.New("discovery document has no jwks_uri")
+		}
+		v.jwksURI = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(v.jwksURI, &jwks); err != nil {
+		return err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	v.keys = keys
+	return nil
+}
+
+func (v *oidcVerifier) getJSON(url string, out any) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key of %d bits is shorter than %d", key.N.BitLen(), minRSAKeyBits)
+		}
+		return key, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+var esCurves = map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "PS256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		h, hashID = sha512.New(), crypto.SHA512
+	case "EdDSA":
+		if pub, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(pub, signed, signature) {
+			return nil
+		}
+		return errors.New("invalid signature")
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if strings.HasPrefix(alg, "PS") {
+			err = rsa.VerifyPSS(pub, hashID, digest, signature, nil)
+		} else if strings.HasPrefix(alg, "RS") {
+			err = rsa.VerifyPKCS1v15(pub, hashID, digest, signature)
+		} else {
+			err = errors.New("key type does not match algorithm")
+		}
+		if err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		// Each ES algorithm names its curve as well as its hash.
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if esCurves[alg] != pub.Curve.Params().Name || len(signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return errors.New("key type does not match algorithm")
+	}
+}
+
+// claimStrings reads a string or string-array claim. Dotted names reach into
+// nested objects, e.g. "realm_access.roles".
+func claimStrings(claims map[string]any, name string) []string {
+	var value any = claims
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = obj[part]
+	}
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
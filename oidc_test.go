@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://id.example.com/realms/main"
+	testAudience = "git-server"
+)
+
+type testKeys struct {
+	rsa   *rsa.PrivateKey
+	ec    *ecdsa.PrivateKey
+	ed    ed25519.PrivateKey
+	edPub ed25519.PublicKey
+	p384  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{rsa: rsaKey, ec: ecKey, ed: edKey, edPub: edPub, p384: p384}
+}
+
+// verifier trusts the test keys without fetching them.
+func (k testKeys) verifier() *oidcVerifier {
+	return &oidcVerifier{
+		issuer:   testIssuer,
+		audience: testAudience,
+		keys: map[string]crypto.PublicKey{
+			"rsa":  &k.rsa.PublicKey,
+			"ec":   &k.ec.PublicKey,
+			"ed":   k.edPub,
+			"p384": &k.p384.PublicKey,
+		},
+		fetched: time.Now(),
+	}
+}
+
+// signJWT builds a token with the given header and claims, signed by key with
+// the algorithm alg, which may differ from the header's.
+func signJWT(t *testing.T, header, claims map[string]any, alg string, key any) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch alg {
+	case "none":
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "ES256":
+		priv := key.(*ecdsa.PrivateKey)
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, priv, digest[:])
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		if err == nil {
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+		}
+	case "EdDSA":
+		sig = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signed))
+	default:
+		t.Fatalf("unknown algorithm %s", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	v := keys.verifier()
+	now := time.Now()
+	claims := func(change func(map[string]any)) map[string]any {
+		c := map[string]any{"iss": testIssuer, "aud": testAudience, "sub": "alice", "exp": now.Add(time.Hour).Unix()}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	header := func(alg, kid string) map[string]any {
+		return map[string]any{"alg": alg, "kid": kid, "typ": "JWT"}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", signJWT(t, header("RS256", "rsa"), claims(nil), "RS256", keys.rsa), true},
+		{"ES256", signJWT(t, header("ES256", "ec"), claims(nil), "ES256", keys.ec), true},
+		{"EdDSA", signJWT(t, header("EdDSA", "ed"), claims(nil), "EdDSA", keys.ed), true},
+		{"audience list", signJWT(t, header("RS256", "rsa"), claims(func(c map[string]any) { c["aud"] = []string{"other", testAudience} }), "RS256", keys.rsa), true},
+
+		{"alg none", signJWT(t, header("none", "rsa"), claims(nil), "none", nil), false},
+		{"HS256 with the public key as secret", signJWT(t, header("HS256", "rsa"), claims(nil), "HS256", keys.rsa.PublicKey.N.Bytes()), false},
+		{"RS256 header on an EC key", signJWT(t, header("RS256", "ec"), claims(nil), "ES256", keys.ec), false},
+		{"ES256 header on an RSA key", signJWT(t, header("ES256", "rsa"), claims(nil), "RS256", keys.rsa), false},
+		{"EdDSA header on an RSA key", signJWT(t, header("EdDSA", "rsa"), claims(nil), "RS256", keys.rsa), false},
+		{"ES256 header on a P-384 key", signJWT(t, header("ES256", "p384"), claims(nil), "ES256", keys.p384), false},
+		{"signed by another key", signJWT(t, header("ES256", "ec"), claims(nil), "ES256", keys.p384), false},
+		{"unknown kid", signJWT(t, header("RS256", "rotated"), claims(nil), "RS256", keys.rsa), false},
+
+		{"expired", signJWT(t, header("RS256", "rsa"), claims(func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() }), "RS256", keys.rsa), false},
+		{"no exp", signJWT(t, header("RS256", "rsa"), claims(func(c map[string]any) { delete(c, "exp") }), "RS256", keys.rsa), false},
+		{"nbf in the future", signJWT(t, header("RS256", "rsa"), claims(func(c map[string]any) { c["nbf"] = now.Add(time.Hour).Unix() }), "RS256", keys.rsa), false},
+		{"wrong audience", signJWT(t, header("RS256", "rsa"), claims(func(c map[string]any) { c["aud"] = "other" }), "RS256", keys.rsa), false},
+		{"wrong issuer", signJWT(t, header("RS256", "rsa"), claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" }), "RS256", keys.rsa), false},
+		{"malformed", "not-a-token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.Verify(tt.token)
+			if tt.ok && err != nil {
+				t.Fatalf("Verify failed: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("Verify accepted the token with claims %v", got)
+			}
+		})
+	}
+}
+
+func TestOIDCTamperedClaims(t *testing.T) {
+	keys := newTestKeys(t)
+	token := signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa"},
+		map[string]any{"iss": testIssuer, "aud": testAudience, "sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}, "RS256", keys.rsa)
+	forged := signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa"},
+		map[string]any{"iss": testIssuer, "aud": testAudience, "sub": "admin", "exp": time.Now().Add(time.Hour).Unix()}, "RS256", keys.rsa)
+	parts, forgedParts := strings.Split(token, "."), strings.Split(forged, ".")
+	if _, err := keys.verifier().Verify(parts[0] + "." + forgedParts[1] + "." + parts[2]); err == nil {
+		t.Fatal("Verify accepted claims that were not signed")
+	}
+}
+
+func TestJWKMinimumRSAKeySize(t *testing.T) {
+	for _, bits := range []int{1024, 2048} {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := jwk{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+		_, err = k.publicKey()
+		if bits < minRSAKeyBits && err == nil {
+			t.Errorf("%d-bit RSA key was accepted", bits)
+		}
+		if bits >= minRSAKeyBits && err != nil {
+			t.Errorf("%d-bit RSA key was rejected: %v", bits, err)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const zeroRev = "0000000000000000000000000000000000000000"
+
+var shaRegex = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+const (
+	statusPending = "pending"
+	statusSuccess = "success"
+	statusFailure = "failure"
+	statusError   = "error"
+)
+
+type commitStatus struct {
+	ID          int64     `json:"id"`
+	Repo        string    `json:"-"`
+	SHA         string    `json:"sha"`
+	Context     string    `json:"context"`
+	State       string    `json:"state"`
+	Description string    `json:"description,omitempty"`
+	TargetURL   string    `json:"target_url,omitempty"`
+	Actor       string    `json:"actor"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// protectedBranch rejects deletions and non-fast-forward pushes to matching
+// branches and, with RequireStatus, pushes whose new commit has not passed
+// its status checks.
+type protectedBranch struct {
+	Repo             string   `json:"-"`
+	Pattern          string   `json:"pattern"`
+	RequireStatus    bool     `json:"require_status"`
+	RequiredContexts []string `json:"required_contexts"`
+}
+
+func isValidStatusState(state string) bool {
+	switch state {
+	case statusPending, statusSuccess, statusFailure, statusError:
+		return true
+	}
+	return false
+}
+
+// latestStatuses keeps the newest status of every context.
+func latestStatuses(statuses []commitStatus) []commitStatus {
+	seen := map[string]bool{}
+	latest := []commitStatus{}
+	for _, cs := range statuses {
+		if !seen[cs.Context] {
+			seen[cs.Context] = true
+			latest = append(latest, cs)
+		}
+	}
+	return latest
+}
+
+// combinedState folds the latest status of every context into one state.
+// With required contexts only those count and a missing one is pending;
+// otherwise all reported contexts count and a commit without any is pending.
+func combinedState(statuses []commitStatus, required []string) string {
+	latest := latestStatuses(statuses)
+	states := map[string]string{}
+	for _, cs := range latest {
+		states[cs.Context] = cs.State
+	}
+	contexts := required
+	if len(contexts) == 0 {
+		if len(latest) == 0 {
+			return statusPending
+		}
+		for context := range states {
+			contexts = append(contexts, context)
+		}
+	}
+
+	combined := statusSuccess
+	for _, context := range contexts {
+		switch states[context] {
+		case statusSuccess:
+		case statusFailure, statusError:
+			return statusFailure
+		default:
+			combined = statusPending
+		}
+	}
+	return combined
+}
+
+func matchProtectedBranch(rules []protectedBranch, branch string) (protectedBranch, bool) {
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule.Pattern, branch); ok {
+			return rule, true
+		}
+	}
+	return protectedBranch{}, false
+}
+
+type refUpdate struct {
+	Old, New, Ref string
+	FastForward   bool
+}
+
+func readRefUpdates(r io.Reader) ([]refUpdate, error) {
+	var updates []refUpdate
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		updates = append(updates, refUpdate{Old: fields[0], New: fields[1], Ref: fields[2]})
+	}
+	return updates, scanner.Err()
+}
+
+// checkProtectedRefs returns a message for every update that breaks one of
+// the repository's protected branch rules or the extra rules from its
+// configuration file.
+func checkProtectedRefs(repo string, updates []refUpdate, extra []protectedBranch) ([]string, error) {
+	rules, err := store.ProtectedBranches(repo)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(rules, extra...)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	var rejections []string
+	for _, u := range updates {
+		branch, ok := strings.CutPrefix(u.Ref, "refs/heads/")
+		if !ok {
+			continue
+		}
+		rule, ok := matchProtectedBranch(rules, branch)
+		if !ok {
+			continue
+		}
+		switch {
+		case u.New == zeroRev:
+			rejections = append(rejections, fmt.Sprintf("%s is protected and cannot be deleted", branch))
+		case u.Old != zeroRev && !u.FastForward:
+			rejections = append(rejections, fmt.Sprintf("%s is protected; only fast-forward pushes are allowed", branch))
+		case rule.RequireStatus:
+			statuses, err := store.CommitStatuses(repo, u.New)
+			if err != nil {
+				return nil, err
+			}
+			if state := combinedState(statuses, rule.RequiredContexts); state != statusSuccess {
+				rejections = append(rejections, fmt.Sprintf("%s is protected; commit %s has status %q but needs %q", branch, u.New[:12], state, statusSuccess))
+			}
+		}
+	}
+	return rejections, nil
+}
+
+// hookEnv passes what the pre-receive hook needs to call back into the server
+// binary: where to find it, the directory the relative config paths are
+// based on, and who is pushing to which repository. A large-file limit from
+// the repository's configuration file is passed along too.
+func hookEnv(repo, pusher string) []string {
+	exe, _ := os.Executable()
+	wd, _ := os.Getwd()
+	env := []string{
+		"GIT_SERVER_BIN=" + exe,
+		"GIT_SERVER_WORKDIR=" + wd,
+		"GIT_SERVER_REPO=" + repo,
+		"GIT_SERVER_PUSHER=" + pusher,
+	}
+	if limit := repoSettings(repo).maxFileSize(); limit != config.MaxFileSize {
+		env = append(env, "GIT_SERVER_REPO_MAX_FILE_SIZE="+strconv.FormatInt(limit, 10))
+	}
+	return env
+}
+
+// runHook implements "git-server hook pre-receive" and "git-server hook
+// post-receive", which the generated hooks run with the pushed ref updates on
+// stdin.
+func runHook(args []string) int {
+	if len(args) != 1 || (args[0] != "pre-receive" && args[0] != "post-receive") {
+		fmt.Fprintln(os.Stderr, "usage: git-server hook pre-receive|post-receive")
+		return 2
+	}
+	if config.HookTimeout > 0 {
+		// A pre-receive hook that gives up rejects the push.
+		time.AfterFunc(config.HookTimeout, func() {
+			fmt.Fprintf(os.Stderr, "error: %s hook timed out after %s\n", args[0], config.HookTimeout)
+			os.Exit(1)
+		})
+	}
+	updates, err := readRefUpdates(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to read ref updates:", err)
+		return 1
+	}
+	if args[0] == "post-receive" {
+		return postReceiveHook(updates)
+	}
+	// Pushed objects are only visible through git's quarantine environment,
+	// which is relative to the repository, so check ancestry before leaving it.
+	for i, u := range updates {
+		if u.Old != zeroRev && u.New != zeroRev {
+			updates[i].FastForward = exec.Command("git", "merge-base", "--is-ancestor", u.Old, u.New).Run() == nil
+		}
+	}
+	repoCfg, _ := readRepoConfig(".")
+	rejections := checkRepoConfigUpdate(".", updates)
+
+	if err := os.Chdir(os.Getenv("GIT_SERVER_WORKDIR")); err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to enter server directory:", err)
+		return 1
+	}
+	store, err = openStore(config.DBDriver, config.DBDSN)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer store.Close()
+
+	protected, err := checkProtectedRefs(os.Getenv("GIT_SERVER_REPO"), updates, repoCfg.protectedBranches())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to check protected branches:", err)
+		return 1
+	}
+	for _, msg := range append(rejections, protected...) {
+		fmt.Fprintln(os.Stderr, "error:", msg)
+	}
+	switch {
+	case len(protected) > 0:
+		fmt.Fprintln(os.Stderr, "push rejected: protected branch rules not met")
+		return 1
+	case len(rejections) > 0:
+		fmt.Fprintln(os.Stderr, "push rejected: invalid repository configuration")
+		return 1
+	}
+	return 0
+}
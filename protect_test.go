@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckProtectedRefs(t *testing.T) {
+	useTestStore(t)
+	addTestRepo(t, "demo")
+	if err := store.SetProtectedBranch(protectedBranch{Repo: "demo", Pattern: "main"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetProtectedBranch(protectedBranch{Repo: "demo", Pattern: "release/*", RequireStatus: true, RequiredContexts: []string{"ci"}}); err != nil {
+		t.Fatal(err)
+	}
+	extra := []protectedBranch{{Pattern: "stable"}}
+	const (
+		oldRev  = "1111111111111111111111111111111111111111"
+		newRev  = "2222222222222222222222222222222222222222"
+		goodRev = "3333333333333333333333333333333333333333"
+	)
+	if _, err := store.AddCommitStatus(commitStatus{Repo: "demo", SHA: goodRev, Context: "ci", State: statusSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddCommitStatus(commitStatus{Repo: "demo", SHA: newRev, Context: "ci", State: statusFailure}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		update refUpdate
+		reject string
+	}{
+		{"fast-forward", refUpdate{Old: oldRev, New: newRev, Ref: "refs/heads/main", FastForward: true}, ""},
+		{"force push", refUpdate{Old: oldRev, New: newRev, Ref: "refs/heads/main"}, "only fast-forward"},
+		{"deletion", refUpdate{Old: oldRev, New: zeroRev, Ref: "refs/heads/main"}, "cannot be deleted"},
+		{"creation", refUpdate{Old: zeroRev, New: newRev, Ref: "refs/heads/main"}, ""},
+		{"unprotected force push", refUpdate{Old: oldRev, New: newRev, Ref: "refs/heads/feature"}, ""},
+		{"unprotected deletion", refUpdate{Old: oldRev, New: zeroRev, Ref: "refs/heads/feature"}, ""},
+		{"tag with a protected name", refUpdate{Old: oldRev, New: zeroRev, Ref: "refs/tags/main"}, ""},
+		{"rule from the repository config", refUpdate{Old: oldRev, New: zeroRev, Ref: "refs/heads/stable"}, "cannot be deleted"},
+		{"required status passed", refUpdate{Old: oldRev, New: goodRev, Ref: "refs/heads/release/1.0", FastForward: true}, ""},
+		{"required status failed", refUpdate{Old: oldRev, New: newRev, Ref: "refs/heads/release/1.0", FastForward: true}, `has status "failure"`},
+		{"required status missing", refUpdate{Old: zeroRev, New: oldRev, Ref: "refs/heads/release/2.0"}, `has status "pending"`},
+		{"pattern does not cross slashes", refUpdate{Old: oldRev, New: zeroRev, Ref: "refs/heads/release/1.0/hotfix"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejections, err := checkProtectedRefs("demo", []refUpdate{tt.update}, extra)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.reject == "" && len(rejections) > 0:
+				t.Fatalf("rejected: %v", rejections)
+			case tt.reject != "" && len(rejections) != 1:
+				t.Fatalf("got rejections %v, want one containing %q", rejections, tt.reject)
+			case tt.reject != "" && !strings.Contains(rejections[0], tt.reject):
+				t.Fatalf("rejection %q does not contain %q", rejections[0], tt.reject)
+			}
+		})
+	}
+}
+
+func TestCheckProtectedRefsWithoutRules(t *testing.T) {
+	useTestStore(t)
+	addTestRepo(t, "demo")
+	rejections, err := checkProtectedRefs("demo", []refUpdate{{Old: "1111111111111111111111111111111111111111", New: zeroRev, Ref: "refs/heads/main"}}, nil)
+	if err != nil || len(rejections) != 0 {
+		t.Fatalf("got %v, %v without any rules", rejections, err)
+	}
+}
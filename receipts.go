@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// With GIT_SERVER_PUSH_RECEIPTS set, the post-receive hook signs a receipt of
+// the refs a push updated, shows it to the pusher and records it in the audit
+// log. Receipts are SSH signatures in the format of ssh-keygen -Y sign, made
+// with the host key unless GIT_SERVER_RECEIPT_SIGNING_KEY names another key,
+// so they can be checked with ssh-keygen alone.
+
+// receiptNamespace keeps receipt signatures from being valid for anything
+// else signed with the same key.
+const receiptNamespace = "git-server-push-receipt"
+
+type receiptRef struct {
+	Ref string `json:"ref"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+type pushReceipt struct {
+	Repo   string       `json:"repo"`
+	Pusher string       `json:"pusher"`
+	Refs   []receiptRef `json:"refs"`
+	Time   time.Time    `json:"time"`
+	// Server is the fingerprint of the signing key.
+	Server    string   `json:"server"`
+	Hostnames []string `json:"hostnames,omitempty"`
+}
+
+func loadReceiptSigner() (gossh.Signer, error) {
+	path := config.ReceiptSigningKey
+	if path == "" {
+		path = config.SSHKeyPath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read receipt signing key: %w", err)
+	}
+	signer, err := gossh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse receipt signing key: %w", err)
+	}
+	return signer, nil
+}
+
+// signPushReceipt returns the receipt as one line of JSON, which is the
+// signed message, and its armored signature.
+func signPushReceipt(signer gossh.Signer, r pushReceipt) (string, string, error) {
+	r.Server = gossh.FingerprintSHA256(signer.PublicKey())
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", "", err
+	}
+	message := string(data) + "\n"
+	sig, err := sshSign(signer, receiptNamespace, []byte(message))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to sign push receipt: %w", err)
+	}
+	return message, sig, nil
+}
+
+// sshSign signs message like ssh-keygen -Y sign -n namespace, returning the
+// armored signature.
+func sshSign(signer gossh.Signer, namespace string, message []byte) (string, error) {
+	hash := sha512.Sum512(message)
+	signed := append([]byte("SSHSIG"), gossh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Hash      string
+	}{namespace, "", "sha512", string(hash[:])})...)
+
+	var sig *gossh.Signature
+	var err error
+	if as, ok := signer.(gossh.AlgorithmSigner); ok && signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(rand.Reader, signed, gossh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = signer.Sign(rand.Reader, signed)
+	}
+	if err != nil {
+		return "", err
+	}
+	blob := append([]byte("SSHSIG"), gossh.Marshal(struct {
+		Version   uint32
+		PublicKey string
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Signature string
+	}{1, string(signer.PublicKey().Marshal()), namespace, "", "sha512", string(gossh.Marshal(sig))})...)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob})), nil
+}
+
+// issuePushReceipt runs in the post-receive hook, from the server's working
+// directory with the metadata store open.
+func issuePushReceipt(repo, pusher string, updates []refUpdate) error {
+	signer, err := loadReceiptSigner()
+	if err != nil {
+		return err
+	}
+	r := pushReceipt{Repo: repo, Pusher: pusher, Refs: []receiptRef{}, Time: time.Now().UTC(), Hostnames: config.Hostnames}
+	for _, u := range updates {
+		r.Refs = append(r.Refs, receiptRef{Ref: u.Ref, Old: u.Old, New: u.New})
+	}
+	message, sig, err := signPushReceipt(signer, r)
+	if err != nil {
+		return err
+	}
+	audit(pusher, "push.receipt", repo, message+sig)
+
+	fmt.Fprintln(os.Stderr, "Push receipt, signed by", gossh.FingerprintSHA256(signer.PublicKey()))
+	fmt.Fprint(os.Stderr, message, sig)
+	return nil
+}
+
+// splitReceipt separates an audit entry's details into the receipt and its
+// signature.
+func splitReceipt(details string) (pushReceipt, string, string, error) {
+	message, sig, ok := strings.Cut(details, "-----BEGIN SSH SIGNATURE-----")
+	if !ok {
+		return pushReceipt{}, "", "", errors.New("receipt has no signature")
+	}
+	var r pushReceipt
+	if err := json.Unmarshal([]byte(message), &r); err != nil {
+		return r, "", "", err
+	}
+	return r, message, "-----BEGIN SSH SIGNATURE-----" + sig, nil
+}
+
+type storedReceipt struct {
+	AuditID   int64       `json:"audit_id"`
+	Receipt   pushReceipt `json:"receipt"`
+	Message   string      `json:"message"`
+	Signature string      `json:"signature"`
+}
+
+// listReceiptsHandler serves a repository's push receipts from the audit log,
+// newest first, with the signed message and signature ready to be checked.
+func listReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	limit, before, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	entries, err := store.AuditEntries(repo.Name, "push.receipt", before, limit)
+	if err != nil {
+		log.Error("Failed to read push receipts", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to read push receipts")
+		return
+	}
+	receipts := []storedReceipt{}
+	for _, e := range entries {
+		receipt, message, sig, err := splitReceipt(e.Details)
+		if err != nil {
+			log.Warn("Skipping malformed push receipt", "repo", repo.Name, "audit_id", e.ID, "error", err)
+			continue
+		}
+		receipts = append(receipts, storedReceipt{AuditID: e.ID, Receipt: receipt, Message: message, Signature: sig})
+	}
+	writeJSON(w, http.StatusOK, receipts)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// refBackupPrefix holds the previous tips of deleted and force-updated refs
+// as refs/backup/<unix time in nanoseconds>/<ref without "refs/">; backups
+// made by earlier versions use seconds. The namespace is hidden from clients
+// through transfer.hideRefs.
+const refBackupPrefix = "refs/backup/"
+
+var (
+	errRefBackupNotFound = errors.New("no backup found for that ref")
+	errRefExists         = errors.New("ref already exists; restore it under another name")
+	errInvalidRef        = errors.New("invalid ref name")
+)
+
+type refBackup struct {
+	ID   string    `json:"id"`
+	Ref  string    `json:"ref"`
+	SHA  string    `json:"sha"`
+	Time time.Time `json:"time"`
+}
+
+func (b refBackup) expired() bool {
+	return config.RefBackupRetention > 0 && time.Since(b.Time) > config.RefBackupRetention
+}
+
+// postReceiveHook runs inside the repository after refs were updated but
+// before git's automatic gc, while the old tips are still present.
+func postReceiveHook(updates []refUpdate) int {
+	if err := archiveRefUpdates(".", updates); err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
+	if err := pruneRefBackups("."); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: failed to prune ref backups:", err)
+	}
+	// Receipts and the search index live in the metadata store, which is
+	// opened from the server's working directory.
+	if !config.PushReceipts && !config.SearchIndex {
+		return 0
+	}
+	repoPath, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+		return 0
+	}
+	if err := os.Chdir(os.Getenv("GIT_SERVER_WORKDIR")); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: failed to enter server directory:", err)
+		return 0
+	}
+	if store, err = openStore(config.DBDriver, config.DBDSN); err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+		return 0
+	}
+	defer store.Close()
+	repo := os.Getenv("GIT_SERVER_REPO")
+	if config.SearchIndex {
+		if err := indexRefUpdates(repoPath, repo, updates); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: search index not updated:", err)
+		}
+	}
+	if config.PushReceipts {
+		if err := issuePushReceipt(repo, os.Getenv("GIT_SERVER_PUSHER"), updates); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: no push receipt:", err)
+		}
+	}
+	return 0
+}
+
+// archiveRefUpdates keeps the previous tip of every deleted or force-updated
+// ref.
+func archiveRefUpdates(repoPath string, updates []refUpdate) error {
+	now := time.Now().UnixNano()
+	for _, u := range updates {
+		if u.Old == zeroRev || strings.HasPrefix(u.Ref, refBackupPrefix) {
+			continue
+		}
+		if u.New != zeroRev && exec.Command("git", "-C", repoPath, "merge-base", "--is-ancestor", u.Old, u.New).Run() == nil {
+			continue
+		}
+		name := fmt.Sprintf("%s%d/%s", refBackupPrefix, now, strings.TrimPrefix(u.Ref, "refs/"))
+		// The empty old value refuses to overwrite an existing backup.
+		if out, err := exec.Command("git", "-C", repoPath, "update-ref", name, u.Old, "").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to back up %s: %w: %s", u.Ref, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// refBackups lists the backups of a repository, newest first.
+func refBackups(repoPath string) ([]refBackup, error) {
+	out, err := exec.Command("git", "-C", repoPath, "for-each-ref", "--format=%(refname) %(objectname)", refBackupPrefix).Output()
+	if err != nil {
+		return nil, err
+	}
+	var backups []refBackup
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		name, sha, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		id := strings.TrimPrefix(name, refBackupPrefix)
+		ts, ref, ok := strings.Cut(id, "/")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, refBackup{ID: id, Ref: "refs/" + ref, SHA: sha, Time: refBackupTime(n)})
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// refBackupTime reads the time of a backup, telling the seconds of older
+// backups from nanoseconds by their size.
+func refBackupTime(n int64) time.Time {
+	if n < 1e12 {
+		return time.Unix(n, 0)
+	}
+	return time.Unix(0, n)
+}
+
+// liveRefBackups lists the backups that are still within the retention
+// window.
+func liveRefBackups(repo string) ([]refBackup, error) {
+	backups, err := refBackups(repoDirPath(repo))
+	if err != nil {
+		return nil, err
+	}
+	live := []refBackup{}
+	for _, b := range backups {
+		if !b.expired() {
+			live = append(live, b)
+		}
+	}
+	return live, nil
+}
+
+func pruneRefBackups(repoPath string) error {
+	if config.RefBackupRetention <= 0 {
+		return nil
+	}
+	backups, err := refBackups(repoPath)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		if !b.expired() {
+			continue
+		}
+		if out, err := exec.Command("git", "-C", repoPath, "update-ref", "-d", refBackupPrefix+b.ID).CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// qualifyRef turns a short branch name into a full ref name.
+func qualifyRef(name string) string {
+	if strings.HasPrefix(name, "refs/") {
+		return name
+	}
+	return "refs/heads/" + name
+}
+
+// restoreRefBackup recreates a ref from a backup. name is a backup ID or a
+// ref, which selects the newest backup of that ref. The ref is restored under
+// its original name unless target is given; either way it must not exist.
+func restoreRefBackup(repo, name, target, actor string) (refBackup, string, error) {
+	backups, err := liveRefBackups(repo)
+	if err != nil {
+		return refBackup{}, "", err
+	}
+	var backup refBackup
+	found := false
+	for _, b := range backups {
+		if b.ID == name {
+			backup, found = b, true
+			break
+		}
+	}
+	if !found {
+		for _, b := range backups {
+			if b.Ref == qualifyRef(name) {
+				backup, found = b, true
+				break
+			}
+		}
+	}
+	if !found {
+		return backup, "", errRefBackupNotFound
+	}
+
+	if target == "" {
+		target = backup.Ref
+	}
+	target = qualifyRef(target)
+	if strings.HasPrefix(target, refBackupPrefix) || exec.Command("git", "check-ref-format", target).Run() != nil {
+		return backup, target, errInvalidRef
+	}
+	repoPath := repoDirPath(repo)
+	if exec.Command("git", "-C", repoPath, "rev-parse", "--verify", "--quiet", target).Run() == nil {
+		return backup, target, errRefExists
+	}
+	// An empty old value makes git refuse to overwrite a ref created since
+	// the check above.
+	if out, err := exec.Command("git", "-C", repoPath, "update-ref", target, backup.SHA, "").CombinedOutput(); err != nil {
+		return backup, target, fmt.Errorf("failed to restore %s: %w: %s", target, err, strings.TrimSpace(string(out)))
+	}
+
+	sshLog.Info("Ref restored from backup", "repo", repo, "ref", target, "sha", backup.SHA, "backup", backup.ID)
+	audit(actor, "ref.restore", repo, fmt.Sprintf("ref=%s sha=%s backup=%s", target, backup.SHA, backup.ID))
+	recordActivity(activityEvent{Time: time.Now(), Repo: repo, Actor: actor, Type: activityRefRestore, Ref: target, NewRev: backup.SHA})
+	return backup, target, nil
+}
+
+// hideRefBackups keeps refs/backup out of ref advertisements and out of
+// reach of pushes.
+func hideRefBackups(repoPath string) error {
+	out, err := exec.Command("git", "-C", repoPath, "config", "transfer.hideRefs", strings.TrimSuffix(refBackupPrefix, "/")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to hide ref backups: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
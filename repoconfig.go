@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// repoConfigPath is read from the tip of the default branch, so repository
+// settings change by pushing a commit.
+const repoConfigPath = ".git-server/server.yaml"
+
+type repoConfig struct {
+	Visibility        string              `yaml:"visibility" json:"visibility,omitempty"`
+	MaxFileSize       int64               `yaml:"max_file_size" json:"max_file_size,omitempty"`
+	ProtectedBranches []repoConfigBranch  `yaml:"protected_branches" json:"protected_branches,omitempty"`
+	Webhooks          []repoConfigWebhook `yaml:"webhooks" json:"webhooks,omitempty"`
+}
+
+type repoConfigBranch struct {
+	Pattern          string   `yaml:"pattern" json:"pattern"`
+	RequireStatus    bool     `yaml:"require_status" json:"require_status"`
+	RequiredContexts []string `yaml:"required_contexts" json:"required_contexts,omitempty"`
+}
+
+type repoConfigWebhook struct {
+	URL    string `yaml:"url" json:"url"`
+	Secret string `yaml:"secret" json:"-"`
+}
+
+type cachedRepoConfig struct {
+	blob string
+	cfg  repoConfig
+	err  error
+}
+
+var (
+	repoConfigMu    sync.Mutex
+	repoConfigCache = map[string]cachedRepoConfig{}
+)
+
+func parseRepoConfig(data []byte) (repoConfig, error) {
+	var cfg repoConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return repoConfig{}, err
+	}
+	switch cfg.Visibility {
+	case "", visibilityPrivate, visibilityPublic:
+	default:
+		return repoConfig{}, fmt.Errorf("visibility must be %q or %q", visibilityPrivate, visibilityPublic)
+	}
+	if cfg.MaxFileSize < 0 {
+		return repoConfig{}, errors.New("max_file_size must not be negative")
+	}
+	for _, b := range cfg.ProtectedBranches {
+		if _, err := path.Match(b.Pattern, ""); err != nil || b.Pattern == "" {
+			return repoConfig{}, fmt.Errorf("invalid protected branch pattern %q", b.Pattern)
+		}
+	}
+	for _, h := range cfg.Webhooks {
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return repoConfig{}, fmt.Errorf("invalid webhook url %q", h.URL)
+		}
+	}
+	return cfg, nil
+}
+
+// readRepoConfig returns the configuration committed to the default branch of
+// the repository at repoPath. Parsed files are cached by blob ID, so a lookup
+// costs one git call until the file changes. A missing file is an empty
+// configuration.
+func readRepoConfig(repoPath string) (repoConfig, error) {
+	if !config.RepoConfig {
+		return repoConfig{}, nil
+	}
+	out, err := exec.Command("git", "-C", repoPath, "rev-parse", "--verify", "--quiet", "HEAD:"+repoConfigPath).Output()
+	if err != nil {
+		return repoConfig{}, nil
+	}
+	blob := strings.TrimSpace(string(out))
+
+	repoConfigMu.Lock()
+	cached, ok := repoConfigCache[repoPath]
+	repoConfigMu.Unlock()
+	if ok && cached.blob == blob {
+		return cached.cfg, cached.err
+	}
+
+	data, err := exec.Command("git", "-C", repoPath, "cat-file", "blob", blob).Output()
+	if err != nil {
+		return repoConfig{}, fmt.Errorf("failed to read %s: %w", repoConfigPath, err)
+	}
+	cfg, err := parseRepoConfig(data)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", repoConfigPath, err)
+		hooksLog.Warn("Ignoring invalid repository config", "path", repoPath, "error", err)
+	}
+	repoConfigMu.Lock()
+	repoConfigCache[repoPath] = cachedRepoConfig{blob: blob, cfg: cfg, err: err}
+	repoConfigMu.Unlock()
+	return cfg, err
+}
+
+// repoSettings is readRepoConfig for a repository name, treating an invalid
+// file like a missing one.
+func repoSettings(repo string) repoConfig {
+	cfg, _ := readRepoConfig(repoDirPath(repo))
+	return cfg
+}
+
+// checkRepoConfigUpdate validates the configuration file in pushes to the
+// default branch so a broken file is rejected instead of silently ignored.
+func checkRepoConfigUpdate(repoPath string, updates []refUpdate) []string {
+	if !config.RepoConfig {
+		return nil
+	}
+	head, err := exec.Command("git", "-C", repoPath, "symbolic-ref", "HEAD").Output()
+	if err != nil {
+		return nil
+	}
+	var rejections []string
+	for _, u := range updates {
+		if u.Ref != strings.TrimSpace(string(head)) || u.New == zeroRev {
+			continue
+		}
+		data, err := exec.Command("git", "-C", repoPath, "cat-file", "blob", u.New+":"+repoConfigPath).Output()
+		if err != nil {
+			continue
+		}
+		if _, err := parseRepoConfig(data); err != nil {
+			rejections = append(rejections, fmt.Sprintf("%s: %v", repoConfigPath, err))
+		}
+	}
+	return rejections
+}
+
+func (cfg repoConfig) protectedBranches() []protectedBranch {
+	var rules []protectedBranch
+	for _, b := range cfg.ProtectedBranches {
+		rules = append(rules, protectedBranch{Pattern: b.Pattern, RequireStatus: b.RequireStatus, RequiredContexts: b.RequiredContexts})
+	}
+	return rules
+}
+
+// maxFileSize returns the large-file limit for the repository. A repository
+// can lower the server-wide limit but not raise it.
+func (cfg repoConfig) maxFileSize() int64 {
+	if cfg.MaxFileSize > 0 && (config.MaxFileSize <= 0 || cfg.MaxFileSize < config.MaxFileSize) {
+		return cfg.MaxFileSize
+	}
+	return config.MaxFileSize
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/ssh"
+	bm "github.com/charmbracelet/wish/bubbletea"
+)
+
+// repoMenuPageSize is how many names a listing reads from the database at a
+// time.
+const repoMenuPageSize = 200
+
+// gitListMiddleware shows the repository menu to sessions without a command
+// when GIT_SERVER_REPO_MENU is set. Names are read page by page from the
+// metadata database, so large servers start listing at once: plain sessions
+// get a streamed listing, terminals a menu that loads more as it scrolls.
+func gitListMiddleware(next ssh.Handler) ssh.Handler {
+	return func(sess ssh.Session) {
+		if !config.RepoMenu || len(sess.Command()) != 0 {
+			next(sess)
+			return
+		}
+		if pty, windowChanges, ok := sess.Pty(); ok {
+			runRepoMenu(sess, pty, windowChanges)
+		} else {
+			streamRepoList(sess)
+		}
+		next(sess)
+	}
+}
+
+func streamRepoList(sess ssh.Session) {
+	after := ""
+	for sess.Context().Err() == nil {
+		page, err := store.RepoNames(after, "", repoMenuPageSize)
+		if err != nil {
+			sshLog.Error("Failed to list repositories", "error", err)
+			fmt.Fprintln(sess.Stderr(), "failed to list repositories")
+			return
+		}
+		if after == "" && len(page) > 0 {
+			fmt.Fprintf(sess, "\n### Repo Menu ###\n\n")
+		}
+		for _, repo := range page {
+			fmt.Fprintf(sess, "• %s\ngit clone ssh://%s/%s\n", repo, cloneHost(), repo)
+		}
+		if len(page) < repoMenuPageSize {
+			break
+		}
+		after = page[len(page)-1]
+	}
+	fmt.Fprintf(sess, "\n\n### Add some repos! ###\n\n")
+	fmt.Fprintf(sess, "> cd some_repo\n")
+	fmt.Fprintf(sess, "> git remote add wish_test ssh://%s/some_repo\n", cloneHost())
+	fmt.Fprintf(sess, "> git push wish_test\n\n\n")
+}
+
+type repoMenuModel struct {
+	styles dashboardStyles
+	width  int
+	height int
+
+	repos     []string
+	more      bool
+	cursor    int
+	query     string
+	searching bool
+	status    string
+}
+
+func runRepoMenu(sess ssh.Session, pty ssh.Pty, windowChanges <-chan ssh.Window) {
+	renderer := bm.MakeRenderer(sess)
+	model := &repoMenuModel{
+		width:  pty.Window.Width,
+		height: pty.Window.Height,
+		styles: dashboardStyles{
+			title:    renderer.NewStyle().Bold(true),
+			selected: renderer.NewStyle().Reverse(true),
+			warning:  renderer.NewStyle().Foreground(lipgloss.Color("1")),
+			help:     renderer.NewStyle().Faint(true),
+		},
+	}
+	model.reload()
+
+	program := tea.NewProgram(model, append(bm.MakeOptions(sess), tea.WithAltScreen())...)
+	ctx, cancel := context.WithCancel(sess.Context())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				program.Quit()
+				return
+			case w := <-windowChanges:
+				program.Send(tea.WindowSizeMsg{Width: w.Width, Height: w.Height})
+			}
+		}
+	}()
+	if _, err := program.Run(); err != nil {
+		sshLog.Error("Repository menu exited with error", "error", err)
+	}
+	program.Kill()
+}
+
+// reload starts the listing over, for a new search.
+func (m *repoMenuModel) reload() {
+	m.repos, m.more, m.cursor = nil, true, 0
+	m.loadMore()
+}
+
+// loadMore reads the next page if the cursor is within a screen of the end
+// of what has been loaded.
+func (m *repoMenuModel) loadMore() {
+	if !m.more || m.cursor+m.visible() < len(m.repos) {
+		return
+	}
+	after := ""
+	if len(m.repos) > 0 {
+		after = m.repos[len(m.repos)-1]
+	}
+	page, err := store.RepoNames(after, m.query, repoMenuPageSize)
+	if err != nil {
+		sshLog.Error("Failed to list repositories", "error", err)
+		m.status = "failed to list repositories"
+		m.more = false
+		return
+	}
+	m.repos = append(m.repos, page...)
+	m.more = len(page) == repoMenuPageSize
+}
+
+func (m *repoMenuModel) visible() int {
+	return max(m.height-7, 1)
+}
+
+func (m *repoMenuModel) Init() tea.Cmd {
+	return nil
+}
+
+func (m *repoMenuModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.loadMore()
+	case tea.KeyMsg:
+		if m.searching {
+			switch msg.Type {
+			case tea.KeyEnter:
+				m.searching = false
+			case tea.KeyEsc:
+				m.searching, m.query = false, ""
+				m.reload()
+			case tea.KeyBackspace:
+				if r := []rune(m.query); len(r) > 0 {
+					m.query = string(r[:len(r)-1])
+					m.reload()
+				}
+			case tea.KeyRunes:
+				m.query += string(msg.Runes)
+				m.reload()
+			}
+			return m, nil
+		}
+		switch msg.String() {
+		case "q", "ctrl+c", "esc":
+			return m, tea.Quit
+		case "/":
+			m.searching = true
+		case "up", "k":
+			m.cursor = max(m.cursor-1, 0)
+		case "down", "j":
+			m.cursor = min(m.cursor+1, max(len(m.repos)-1, 0))
+		case "pgup":
+			m.cursor = max(m.cursor-m.visible(), 0)
+		case "pgdown", " ":
+			m.cursor = min(m.cursor+m.visible(), max(len(m.repos)-1, 0))
+		case "home", "g":
+			m.cursor = 0
+		}
+		m.loadMore()
+	}
+	return m, nil
+}
+
+func (m *repoMenuModel) View() string {
+	var b strings.Builder
+	count := fmt.Sprintf("%d repositories", len(m.repos))
+	if m.more {
+		count = fmt.Sprintf("%d+ repositories", len(m.repos))
+	}
+	fmt.Fprintf(&b, "%s  %s\n", m.styles.title.Render("Repo Menu"), m.styles.help.Render(count))
+	switch {
+	case m.searching:
+		fmt.Fprintf(&b, "/%s█\n\n", m.query)
+	case m.query != "":
+		fmt.Fprintf(&b, "%s\n\n", m.styles.help.Render("matching "+m.query))
+	default:
+		b.WriteString("\n\n")
+	}
+
+	visible := m.visible()
+	offset := max(m.cursor-visible+1, 0)
+	for i := offset; i < len(m.repos) && i < offset+visible; i++ {
+		if i == m.cursor {
+			b.WriteString(m.styles.selected.Render(m.repos[i]) + "\n")
+		} else {
+			b.WriteString(m.repos[i] + "\n")
+		}
+	}
+	if len(m.repos) == 0 {
+		b.WriteString(m.styles.help.Render("no repositories") + "\n")
+	}
+
+	b.WriteString("\n")
+	if m.cursor < len(m.repos) {
+		fmt.Fprintf(&b, "git clone ssh://%s/%s\n", cloneHost(), m.repos[m.cursor])
+	}
+	b.WriteString(m.styles.help.Render("↑/↓: scroll • /: search • q: quit") + "\n")
+	if m.status != "" {
+		b.WriteString(m.styles.warning.Render(m.status) + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// Repositories are created with mode 0755 and owned by the server's user
+// unless GIT_SERVER_REPO_DIR_MODE, GIT_SERVER_REPO_FILE_MODE,
+// GIT_SERVER_REPO_OWNER or GIT_SERVER_REPO_GROUP say otherwise, e.g. for
+// group-writable repositories with setgid directories on shared hosts.
+
+// repoPermissions is the parsed form of the settings. Zero modes and negative
+// IDs leave the defaults alone.
+type repoPermissions struct {
+	dirMode  fs.FileMode
+	fileMode fs.FileMode
+	uid, gid int
+}
+
+var repoPerms = repoPermissions{uid: -1, gid: -1}
+
+func loadRepoPermissions() (repoPermissions, error) {
+	p := repoPermissions{uid: -1, gid: -1}
+	var err error
+	if p.dirMode, err = parseFileMode(config.RepoDirMode); err != nil {
+		return p, fmt.Errorf("GIT_SERVER_REPO_DIR_MODE: %w", err)
+	}
+	if p.dirMode != 0 && p.dirMode.Perm()&0700 != 0700 {
+		return p, fmt.Errorf("GIT_SERVER_REPO_DIR_MODE %s must give the owner rwx", config.RepoDirMode)
+	}
+	if p.fileMode, err = parseFileMode(config.RepoFileMode); err != nil {
+		return p, fmt.Errorf("GIT_SERVER_REPO_FILE_MODE: %w", err)
+	}
+	if p.fileMode != 0 && (p.fileMode.Perm()&0600 != 0600 || p.fileMode&^fs.ModePerm != 0) {
+		return p, fmt.Errorf("GIT_SERVER_REPO_FILE_MODE %s must give the owner rw and have no special bits", config.RepoFileMode)
+	}
+	if config.RepoOwner != "" {
+		u, err := lookupID(config.RepoOwner, user.Lookup, func(u *user.User) string { return u.Uid })
+		if err != nil {
+			return p, fmt.Errorf("GIT_SERVER_REPO_OWNER: %w", err)
+		}
+		p.uid = u
+	}
+	if config.RepoGroup != "" {
+		g, err := lookupID(config.RepoGroup, user.LookupGroup, func(g *user.Group) string { return g.Gid })
+		if err != nil {
+			return p, fmt.Errorf("GIT_SERVER_REPO_GROUP: %w", err)
+		}
+		p.gid = g
+	}
+	return p, nil
+}
+
+func parseUmask(s string) (int, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return 0, fmt.Errorf("%q is not an octal umask", s)
+	}
+	return int(n), nil
+}
+
+// parseFileMode parses an octal mode such as 2775, keeping the setuid, setgid
+// and sticky bits.
+func parseFileMode(s string) (fs.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 07777 || n == 0 {
+		return 0, fmt.Errorf("%q is not an octal file mode", s)
+	}
+	mode := fs.FileMode(n & 0777)
+	if n&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if n&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if n&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode, nil
+}
+
+// lookupID resolves a user or group given by name or numeric ID.
+func lookupID[T any](name string, lookup func(string) (T, error), id func(T) string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil && n >= 0 {
+		return n, nil
+	}
+	v, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id(v))
+}
+
+// dirModeOr returns the configured directory mode, or def.
+func (p repoPermissions) dirModeOr(def fs.FileMode) fs.FileMode {
+	if p.dirMode != 0 {
+		return p.dirMode
+	}
+	return def
+}
+
+// hookMode is the file mode with execute bits wherever it grants read.
+func (p repoPermissions) hookMode() fs.FileMode {
+	if p.fileMode == 0 {
+		return 0755
+	}
+	return p.fileMode | (p.fileMode&0444)>>2
+}
+
+// initArgs are the extra git init arguments: with a file mode set, git keeps
+// new objects and refs at that mode through core.sharedRepository.
+func (p repoPermissions) initArgs() []string {
+	if p.fileMode == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("--shared=0%o", p.fileMode.Perm())}
+}
+
+// writeHookFile writes a hook, also fixing the mode of one that exists.
+func writeHookFile(path string, data []byte) error {
+	mode := repoPerms.hookMode()
+	if err := os.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// applyRepoPermissions runs after a repository is created or seeded. It
+// hands the repository to the configured owner and group, applies the
+// configured modes to everything in it if GIT_SERVER_REPO_FIX_PERMISSIONS is
+// set, and restores SELinux contexts if GIT_SERVER_REPO_RESTORECON is set.
+func applyRepoPermissions(repoPath string) error {
+	p := repoPerms
+	if p.dirMode != 0 {
+		// MkdirAll is subject to the umask and drops the setgid bit.
+		if err := os.Chmod(repoPath, p.dirMode); err != nil {
+			return fmt.Errorf("failed to set repository mode: %w", err)
+		}
+	}
+	if p.uid >= 0 || p.gid >= 0 || config.RepoFixPermissions {
+		err := filepath.WalkDir(repoPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p.uid >= 0 || p.gid >= 0 {
+				if err := os.Lchown(path, p.uid, p.gid); err != nil {
+					return err
+				}
+			}
+			if !config.RepoFixPermissions || d.Type()&fs.ModeSymlink != 0 {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			switch {
+			case d.IsDir():
+				return os.Chmod(path, p.dirModeOr(0755))
+			case info.Mode()&0111 != 0:
+				return os.Chmod(path, p.hookMode())
+			case p.fileMode != 0 && info.Mode()&0200 == 0:
+				// Objects and packs stay read-only.
+				return os.Chmod(path, p.fileMode&^0222)
+			case p.fileMode != 0:
+				return os.Chmod(path, p.fileMode)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply repository ownership and modes: %w", err)
+		}
+	}
+	if config.RepoRestorecon {
+		if out, err := exec.Command("restorecon", "-R", repoPath).CombinedOutput(); err != nil {
+			return fmt.Errorf("restorecon failed: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	log.Debug("Applied repository permissions", "path", repoPath)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var (
+	errRepoNotFound = errors.New("repository not found; ask an admin to create it")
+	errRepoExists   = errors.New("repository already exists")
+	errInvalidRepo  = errors.New("invalid repository name")
+)
+
+func isAdminKey(key ssh.PublicKey) bool {
+	return key != nil && slices.Contains(config.AdminKeys, gossh.FingerprintSHA256(key))
+}
+
+// createRepo explicitly creates a repository on behalf of an admin and
+// returns its normalized name. The repository is seeded from template, or
+// from GIT_SERVER_INIT_TEMPLATE when template is empty.
+func createRepo(name, owner, template, actor string) (string, error) {
+	if template == "" {
+		template = config.InitTemplate
+	}
+	return initRepo(name, owner, template, actor)
+}
+
+// initRepo creates a repository, seeded from template unless it is empty.
+func initRepo(name, owner, template, actor string) (string, error) {
+	repo := normalizeRepoName(name)
+	if !isValidRepoName(repo) {
+		return "", errInvalidRepo
+	}
+	if _, ok := aliases.Lookup(repo); ok || repoExists(repo) {
+		return repo, errRepoExists
+	}
+	if template != "" {
+		if _, err := templateFiles(template, repo, owner); err != nil {
+			return repo, err
+		}
+	}
+	if err := createBareRepoWithHook(repo, owner); err != nil {
+		return repo, fmt.Errorf("failed to create repository: %w", err)
+	}
+	log.Info("Repository created", "repo", repo, "owner", owner)
+	// A pending creation request for the name is settled.
+	if err := store.DeleteRepoRequest(repo); err != nil && !errors.Is(err, errNotFound) {
+		log.Error("Failed to remove creation request", "repo", repo, "error", err)
+	}
+	if template != "" {
+		if err := seedRepo(repo, template, owner); err != nil {
+			log.Error("Failed to seed repository", "repo", repo, "template", template, "error", err)
+		} else if err := applyRepoPermissions(repoDirPath(repo)); err != nil {
+			log.Error("Failed to apply repository permissions", "repo", repo, "error", err)
+		}
+	}
+	audit(actor, "repo.create", repo, "owner="+owner)
+	recordActivity(repoActivity(repo, actor, activityRepoCreate))
+	return repo, nil
+}
+
+// transferRepo hands a repository to a new owner and optionally renames it.
+// A rename moves the repository and its backups on disk and leaves the old
+// name as an alias so existing clones keep working.
+func transferRepo(name, newName, owner, actor string) (repoRecord, error) {
+	from := resolveRepo(name)
+	record, err := store.Repo(from)
+	if err != nil {
+		return record, err
+	}
+	if owner == "" {
+		owner = record.Owner
+	}
+	to := from
+	if newName != "" {
+		to = normalizeRepoName(newName)
+		if !isValidRepoName(to) {
+			return record, errInvalidRepo
+		}
+	}
+	if to != from {
+		if target, ok := aliases.Lookup(to); (ok && target != from) || repoExists(to) {
+			return record, errRepoExists
+		}
+	}
+
+	repoMutex.Lock()
+	defer repoMutex.Unlock()
+
+	if to != from {
+		if err := os.Rename(repoDirPath(from), repoDirPath(to)); err != nil {
+			return record, fmt.Errorf("failed to move repository: %w", err)
+		}
+	}
+	if err := store.TransferRepo(from, to, owner, aliasKey(from)); err != nil {
+		if to != from {
+			if rerr := os.Rename(repoDirPath(to), repoDirPath(from)); rerr != nil {
+				log.Error("Failed to move repository back after a failed transfer", "repo", from, "path", repoDirPath(to), "error", rerr)
+			}
+		}
+		return record, fmt.Errorf("failed to update repository record: %w", err)
+	}
+
+	if to != from {
+		if err := installHooks(repoDirPath(to), to); err != nil {
+			hooksLog.Error("Failed to update hooks", "repo", to, "error", err)
+		}
+		oldBackups, newBackups := filepath.Join(config.BackupDir, from), filepath.Join(config.BackupDir, to)
+		if _, err := os.Stat(oldBackups); err == nil {
+			if err := os.Rename(oldBackups, newBackups); err != nil {
+				log.Warn("Failed to move backups", "repo", to, "from", oldBackups, "error", err)
+			}
+		}
+		if err := aliases.reload(); err != nil {
+			log.Error("Failed to reload aliases", "error", err)
+		}
+	}
+
+	details := fmt.Sprintf("from=%s to=%s owner=%s previous_owner=%s", from, to, owner, record.Owner)
+	log.Info("Repository transferred", "from", from, "to", to, "owner", owner)
+	audit(actor, "repo.transfer", to, details)
+	recordActivity(repoActivity(to, actor, activityRepoTransfer))
+	return store.Repo(to)
+}
+
+// isPublicRepo reports whether a repository is readable by any key. The
+// repository's configuration file takes precedence over the database.
+func isPublicRepo(repo string) bool {
+	return repoVisibility(repo) == visibilityPublic
+}
+
+func repoVisibility(repo string) string {
+	if v := repoSettings(repo).Visibility; v != "" {
+		return v
+	}
+	r, err := store.Repo(repo)
+	if err != nil {
+		return visibilityPrivate
+	}
+	return r.Visibility
+}
+
+// quotaError returns a message when a repository has reached its size quota.
+func quotaError(repo string) string {
+	r, err := store.Repo(repo)
+	if err != nil || r.QuotaBytes <= 0 {
+		return ""
+	}
+	size, err := dirSize(repoDirPath(repo))
+	if err != nil || size < r.QuotaBytes {
+		return ""
+	}
+	return fmt.Sprintf("repository has reached its quota of %s", formatBytes(r.QuotaBytes))
+}
+
+// runMaintenance repacks a repository and prunes unreachable objects.
+func runMaintenance(repo string) error {
+	log.Info("Running repository maintenance", "repo", repo)
+	start := time.Now()
+	out, err := exec.Command("git", "-C", repoDirPath(repo), "gc", "--quiet").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git gc failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	log.Info("Repository maintenance finished", "repo", repo, "duration", time.Since(start))
+	return nil
+}
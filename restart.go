@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	listenFDsEnv = "GIT_SERVER_LISTEN_FDS"
+	readyFDEnv   = "GIT_SERVER_READY_FD"
+)
+
+// listen reuses the socket inherited from the previous process during a
+// restart and opens a new one otherwise.
+func listen(name, addr string) (net.Listener, error) {
+	l, err := inheritedListener(name)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		log.Info("Using inherited listener", "name", name, "addr", l.Addr())
+		return l, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+func writePIDFile() {
+	if config.PIDFile == "" {
+		return
+	}
+	if err := os.WriteFile(config.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		log.Error("Failed to write PID file", "path", config.PIDFile, "error", err)
+	}
+}
+
+type drainer interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// drain stops the servers from accepting and waits for their open
+// connections to finish, closing whatever is left when ctx expires.
+func drain(ctx context.Context, servers ...drainer) {
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, net.ErrClosed) {
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Warn("Drain timed out, closing remaining connections", "active_sessions", len(sessions.List()))
+			} else {
+				log.Error("Shutdown failed", "error", err)
+			}
+			srv.Close()
+		}
+	}
+}
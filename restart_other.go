@@ -0,0 +1,21 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+var restartSignals []os.Signal
+
+func restart(listeners map[string]net.Listener) error {
+	return errors.New("restarts are not supported on this platform")
+}
+
+func inheritedListener(name string) (net.Listener, error) {
+	return nil, nil
+}
+
+func notifyReady() {}
@@ -0,0 +1,123 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var restartSignals = []os.Signal{syscall.SIGHUP}
+
+// restart starts a new copy of the binary that inherits the listening sockets
+// and returns once it reports that it is serving, leaving the caller to drain
+// its own sessions and exit. If the new process fails to come up, the caller
+// keeps serving.
+func restart(listeners map[string]net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var fds []string
+	for name, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s cannot be handed off", name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("failed to duplicate listener %s: %w", name, err)
+		}
+		files = append(files, f)
+		// ExtraFiles start at fd 3 in the child.
+		fds = append(fds, fmt.Sprintf("%s:%d", name, 2+len(files)))
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		listenFDsEnv+"="+strings.Join(fds, ","),
+		readyFDEnv+"="+strconv.Itoa(2+len(files)),
+	)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start new process: %w", err)
+	}
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := ready.Read(buf); err != nil {
+			result <- errors.New("new process exited before it was ready")
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			<-exited
+		}
+		return err
+	case <-time.After(time.Minute):
+		cmd.Process.Kill()
+		return errors.New("new process did not become ready within a minute")
+	}
+}
+
+// inheritedListener returns the listener passed down under name by the
+// previous process, if any.
+func inheritedListener(name string) (net.Listener, error) {
+	for _, entry := range strings.Split(os.Getenv(listenFDsEnv), ",") {
+		n, fd, ok := strings.Cut(entry, ":")
+		if !ok || n != name {
+			continue
+		}
+		num, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q", listenFDsEnv, entry)
+		}
+		f := os.NewFile(uintptr(num), name)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return nil, nil
+}
+
+// notifyReady tells the previous process that this one is serving.
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyFDEnv))
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+	os.Unsetenv(readyFDEnv)
+	os.Unsetenv(listenFDsEnv)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// The revocation list is consulted before the authorization backend. A
+// revoked key, or one past its expiry date, is refused at the SSH handshake,
+// and its open sessions are closed.
+
+const revocationCheckInterval = 30 * time.Second
+
+var errInvalidFingerprint = errors.New("fingerprint must look like SHA256:...")
+
+// keyRevoked reports whether the key may no longer authenticate. If the list
+// can't be read the key is refused.
+func keyRevoked(fingerprint string) bool {
+	if store == nil {
+		return false
+	}
+	k, err := store.KeyRevocation(fingerprint)
+	if errors.Is(err, errNotFound) {
+		return false
+	}
+	if err != nil {
+		authLog.Error("Failed to check key revocation list", "fingerprint", fingerprint, "error", err)
+		return true
+	}
+	return !k.RevokeAt.After(time.Now())
+}
+
+// revokeKey adds the key to the revocation list, taking effect at revokeAt,
+// and closes its sessions if that is now.
+func revokeKey(fingerprint string, revokeAt time.Time, reason, actor string) (keyRevocation, error) {
+	if !strings.HasPrefix(fingerprint, "SHA256:") {
+		return keyRevocation{}, errInvalidFingerprint
+	}
+	now := time.Now()
+	if revokeAt.IsZero() || revokeAt.Before(now) {
+		revokeAt = now
+	}
+	k := keyRevocation{Fingerprint: fingerprint, RevokeAt: revokeAt, Reason: reason, CreatedBy: actor, CreatedAt: now}
+	if err := store.PutKeyRevocation(k); err != nil {
+		return k, fmt.Errorf("failed to store key revocation: %w", err)
+	}
+	if revokeAt.After(now) {
+		authLog.Info("Key expiry set", "fingerprint", fingerprint, "expires_at", revokeAt.UTC())
+		audit(actor, "key.expire", "", fmt.Sprintf("fingerprint=%s expires_at=%s reason=%s", fingerprint, revokeAt.UTC().Format(time.RFC3339), reason))
+		return k, nil
+	}
+	closed := sessions.KillKey(fingerprint)
+	authLog.Info("Key revoked", "fingerprint", fingerprint, "sessions_closed", closed)
+	audit(actor, "key.revoke", "", fmt.Sprintf("fingerprint=%s reason=%s sessions_closed=%d", fingerprint, reason, closed))
+	return k, nil
+}
+
+func unrevokeKey(fingerprint, actor string) error {
+	if err := store.DeleteKeyRevocation(fingerprint); err != nil {
+		return err
+	}
+	authLog.Info("Key revocation lifted", "fingerprint", fingerprint)
+	audit(actor, "key.unrevoke", "", "fingerprint="+fingerprint)
+	return nil
+}
+
+// closeRevokedSessions closes the sessions of keys that have reached their
+// expiry date since they connected.
+func closeRevokedSessions() {
+	revocations, err := store.KeyRevocations()
+	if err != nil {
+		authLog.Error("Failed to read key revocation list", "error", err)
+		return
+	}
+	now := time.Now()
+	for _, k := range revocations {
+		if k.RevokeAt.After(now) {
+			break
+		}
+		if closed := sessions.KillKey(k.Fingerprint); closed > 0 {
+			authLog.Info("Closed sessions of revoked key", "fingerprint", k.Fingerprint, "sessions", closed)
+		}
+	}
+}
+
+func runRevocationEnforcer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			closeRevokedSessions()
+		}
+	}
+}
+
+// revokeCommand revokes a key at once. Without arguments it prints the
+// revocation list.
+func revokeCommand(sess ssh.Session, args []string) {
+	if !isAdminKey(sess.PublicKey()) {
+		wish.Fatalln(sess, "revoke is restricted to admin keys")
+		return
+	}
+	if len(args) == 0 {
+		revocations, err := store.KeyRevocations()
+		if err != nil {
+			sshLog.Error("Failed to read key revocation list", "error", err)
+			wish.Fatalln(sess, "failed to read key revocation list")
+			return
+		}
+		if len(revocations) == 0 {
+			fmt.Fprintln(sess, "No keys are revoked or expiring")
+			return
+		}
+		now := time.Now()
+		for _, k := range revocations {
+			state := "revoked"
+			if k.RevokeAt.After(now) {
+				state = "expires"
+			}
+			fmt.Fprintf(sess, "%-52s %s %s by %s %s\n", k.Fingerprint, state, k.RevokeAt.Format(time.RFC3339), k.CreatedBy, k.Reason)
+		}
+		return
+	}
+	_, err := revokeKey(args[0], time.Time{}, strings.Join(args[1:], " "), gossh.FingerprintSHA256(sess.PublicKey()))
+	if err != nil {
+		if !errors.Is(err, errInvalidFingerprint) {
+			sshLog.Error("Key revocation failed", "fingerprint", args[0], "error", err)
+			err = errors.New("failed to revoke key")
+		}
+		wish.Fatalln(sess, err)
+		return
+	}
+	fmt.Fprintf(sess, "Revoked %s\n", args[0])
+}
+
+func listKeyRevocationsHandler(w http.ResponseWriter, r *http.Request) {
+	revocations, err := store.KeyRevocations()
+	if err != nil {
+		log.Error("Failed to read key revocation list", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to read key revocation list")
+		return
+	}
+	writeJSON(w, http.StatusOK, revocations)
+}
+
+// putKeyRevocationHandler revokes a key at once, or at expires_at (an RFC 3339
+// time) or after expires_in.
+func putKeyRevocationHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+		ExpiresIn string     `json:"expires_in"`
+		Reason    string     `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	var revokeAt time.Time
+	switch {
+	case body.ExpiresAt != nil && body.ExpiresIn != "":
+		writeError(w, http.StatusBadRequest, "give expires_at or expires_in, not both")
+		return
+	case body.ExpiresAt != nil:
+		revokeAt = *body.ExpiresAt
+	case body.ExpiresIn != "":
+		d, err := parseDuration(body.ExpiresIn)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "invalid expires_in duration")
+			return
+		}
+		revokeAt = time.Now().Add(d)
+	}
+	k, err := revokeKey(r.PathValue("fingerprint"), revokeAt, body.Reason, adminActor(r))
+	switch {
+	case errors.Is(err, errInvalidFingerprint):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		log.Error("Key revocation failed", "fingerprint", r.PathValue("fingerprint"), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to revoke key")
+	default:
+		writeJSON(w, http.StatusOK, k)
+	}
+}
+
+func deleteKeyRevocationHandler(w http.ResponseWriter, r *http.Request) {
+	err := unrevokeKey(r.PathValue("fingerprint"), adminActor(r))
+	switch {
+	case errors.Is(err, errNotFound):
+		writeError(w, http.StatusNotFound, "key is not on the revocation list")
+	case err != nil:
+		log.Error("Failed to lift key revocation", "fingerprint", r.PathValue("fingerprint"), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to lift key revocation")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
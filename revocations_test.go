@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyRevoked(t *testing.T) {
+	useTestStore(t)
+	now := time.Now()
+	revocations := []keyRevocation{
+		{Fingerprint: "SHA256:revoked", RevokeAt: now.Add(-time.Hour)},
+		{Fingerprint: "SHA256:expired", RevokeAt: now.Add(-time.Second)},
+		{Fingerprint: "SHA256:expiring", RevokeAt: now.Add(time.Hour)},
+	}
+	for _, k := range revocations {
+		k.CreatedAt = now
+		if err := store.PutKeyRevocation(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		fingerprint string
+		revoked     bool
+	}{
+		{"SHA256:revoked", true},
+		{"SHA256:expired", true},
+		{"SHA256:expiring", false},
+		{"SHA256:unknown", false},
+	}
+	for _, tt := range tests {
+		if got := keyRevoked(tt.fingerprint); got != tt.revoked {
+			t.Errorf("keyRevoked(%s) = %v, want %v", tt.fingerprint, got, tt.revoked)
+		}
+	}
+
+	// Moving the expiry into the past takes effect at once.
+	if err := store.PutKeyRevocation(keyRevocation{Fingerprint: "SHA256:expiring", RevokeAt: now.Add(-time.Minute), CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if !keyRevoked("SHA256:expiring") {
+		t.Error("key is still accepted after its expiry was moved into the past")
+	}
+	if err := store.DeleteKeyRevocation("SHA256:revoked"); err != nil {
+		t.Fatal(err)
+	}
+	if keyRevoked("SHA256:revoked") {
+		t.Error("key is still refused after its revocation was lifted")
+	}
+}
+
+func TestKeyRevokedWithoutDatabase(t *testing.T) {
+	useTestStore(t)
+	store.Close()
+	if !keyRevoked("SHA256:any") {
+		t.Error("key was accepted although the revocation list could not be read")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/charmbracelet/wish/git"
+)
+
+// The search index holds the commit messages, branch and tag names and the
+// file paths of the default branch of every repository. The post-receive
+// hook updates it; repositories that were never indexed are indexed at
+// startup.
+
+const (
+	// searchMaxCommits bounds the commits indexed per ref update, so that
+	// pushing a large history doesn't hold up the push.
+	searchMaxCommits   = 5000
+	searchDefaultLimit = 50
+	// searchMaxRepos bounds the readable repositories searched at once.
+	searchMaxRepos = 100
+	// searchMaxChecks bounds the repositories whose access is checked per
+	// search, each check being a call to the authorization backend.
+	searchMaxChecks = 1000
+)
+
+var errInvalidSearchKind = errors.New("kind must be commit, ref or path")
+
+func isIndexedRef(ref string) bool {
+	return strings.HasPrefix(ref, "refs/heads/") || strings.HasPrefix(ref, "refs/tags/")
+}
+
+// indexRefUpdates adds the commits the updates brought in and refreshes the
+// repository's refs and paths.
+func indexRefUpdates(repoPath, repo string, updates []refUpdate) error {
+	var commits []searchCommit
+	for _, u := range updates {
+		if u.New == zeroRev || !isIndexedRef(u.Ref) {
+			continue
+		}
+		args := []string{"-C", repoPath, "log", "-n", strconv.Itoa(searchMaxCommits), "--format=%H%x1f%an <%ae>%x1f%ct%x1f%B%x1e", u.New}
+		if u.Old != zeroRev {
+			args = append(args, "^"+u.Old)
+		}
+		out, err := exec.Command("git", append(args, "--")...).Output()
+		if err != nil {
+			return fmt.Errorf("failed to read commits of %s: %w", u.Ref, err)
+		}
+		for _, record := range strings.Split(string(out), "\x1e") {
+			fields := strings.SplitN(strings.TrimLeft(record, "\n"), "\x1f", 4)
+			if len(fields) != 4 {
+				continue
+			}
+			ts, _ := strconv.ParseInt(fields[2], 10, 64)
+			commits = append(commits, searchCommit{SHA: fields[0], Author: fields[1], CommittedAt: time.Unix(ts, 0), Message: strings.TrimSpace(fields[3])})
+		}
+	}
+
+	out, err := exec.Command("git", "-C", repoPath, "for-each-ref", "--format=%(refname) %(objectname)", "refs/heads", "refs/tags").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list refs: %w", err)
+	}
+	var refs []searchRef
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if ref, sha, ok := strings.Cut(line, " "); ok {
+			refs = append(refs, searchRef{Ref: ref, SHA: sha})
+		}
+	}
+
+	paths := []string{}
+	if exec.Command("git", "-C", repoPath, "rev-parse", "--verify", "--quiet", "HEAD^{commit}").Run() == nil {
+		out, err := exec.Command("git", "-C", repoPath, "ls-tree", "-r", "-z", "--name-only", "HEAD").Output()
+		if err != nil {
+			return fmt.Errorf("failed to list files: %w", err)
+		}
+		for _, p := range strings.Split(string(out), "\x00") {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+
+	if err := store.AddSearchCommits(repo, commits); err != nil {
+		return fmt.Errorf("failed to index commits: %w", err)
+	}
+	if err := store.SetSearchRefs(repo, refs, paths); err != nil {
+		return fmt.Errorf("failed to index refs and paths: %w", err)
+	}
+	return nil
+}
+
+// reindexRepo rebuilds the repository's index from scratch.
+func reindexRepo(repo string) error {
+	if err := store.ClearSearchIndex(repo); err != nil {
+		return fmt.Errorf("failed to clear search index: %w", err)
+	}
+	repoPath := repoDirPath(repo)
+	out, err := exec.Command("git", "-C", repoPath, "for-each-ref", "--format=%(refname) %(objectname)", "refs/heads", "refs/tags").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list refs: %w", err)
+	}
+	var updates []refUpdate
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if ref, sha, ok := strings.Cut(line, " "); ok {
+			updates = append(updates, refUpdate{Old: zeroRev, New: sha, Ref: ref})
+		}
+	}
+	return indexRefUpdates(repoPath, repo, updates)
+}
+
+// indexUnindexedRepos indexes repositories that predate the index or were
+// restored from the trash.
+func indexUnindexedRepos(ctx context.Context) {
+	repos, err := listRepos()
+	if err != nil {
+		log.Error("Failed to list repositories for search indexing", "error", err)
+		return
+	}
+	for _, repo := range repos {
+		if ctx.Err() != nil {
+			return
+		}
+		indexed, err := store.SearchIndexed(repo)
+		if err != nil {
+			log.Error("Failed to read search index", "repo", repo, "error", err)
+			continue
+		}
+		if indexed {
+			continue
+		}
+		start := time.Now()
+		if err := reindexRepo(repo); err != nil {
+			log.Warn("Failed to index repository for search", "repo", repo, "error", err)
+			continue
+		}
+		log.Info("Indexed repository for search", "repo", repo, "duration", time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// searchCommand searches the repositories the key can read:
+//
+//	search [--kind=commit|ref|path] [--repo=<repo>] [-n <count>] <text>
+func searchCommand(sess ssh.Session, args []string) {
+	kind, repo, limit := "", "", searchDefaultLimit
+	var terms []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "--kind="):
+			kind = strings.TrimPrefix(arg, "--kind=")
+		case strings.HasPrefix(arg, "--repo="):
+			repo = strings.TrimPrefix(arg, "--repo=")
+		case arg == "-n" && i+1 < len(args):
+			i++
+			arg = "-n" + args[i]
+			fallthrough
+		case strings.HasPrefix(arg, "-n"):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "-n"))
+			if err != nil || n <= 0 || n > 1000 {
+				wish.Fatalln(sess, "invalid count:", arg)
+				return
+			}
+			limit = n
+		default:
+			terms = append(terms, arg)
+		}
+	}
+	term := strings.Join(terms, " ")
+	if term == "" {
+		wish.Fatalln(sess, "usage: search [--kind=commit|ref|path] [--repo=<repo>] [-n <count>] <text>")
+		return
+	}
+	if kind != "" && kind != "commit" && kind != "ref" && kind != "path" {
+		wish.Fatalln(sess, errInvalidSearchKind)
+		return
+	}
+
+	readable, complete := []string{resolveRepo(repo)}, true
+	if repo != "" {
+		if _, access := lookupKey(readable[0], sess.PublicKey()); access == git.NoAccess {
+			wish.Fatalln(sess, "repository not found or access denied")
+			return
+		}
+	} else {
+		var err error
+		if readable, complete, err = readableSearchRepos(term, kind, sess.PublicKey()); err != nil {
+			sshLog.Error("Search failed", "error", err)
+			wish.Fatalln(sess, "search failed")
+			return
+		}
+	}
+
+	hits, err := store.Search(term, kind, readable, limit)
+	if err != nil {
+		sshLog.Error("Search failed", "error", err)
+		wish.Fatalln(sess, "search failed")
+		return
+	}
+	switch {
+	case complete:
+	case len(readable) == searchMaxRepos:
+		defer fmt.Fprintf(sess, "\nMatches in more than %d repositories you can read, only the first %d by name were searched; narrow the search with --repo\n", searchMaxRepos, searchMaxRepos)
+	default:
+		defer fmt.Fprintf(sess, "\nStopped checking access after %d repositories with a match; narrow the search with --repo\n", searchMaxChecks)
+	}
+	if len(hits) == 0 {
+		fmt.Fprintln(sess, "No matches")
+		return
+	}
+	for _, h := range hits {
+		switch h.Kind {
+		case "commit":
+			subject, _, _ := strings.Cut(h.Message, "\n")
+			fmt.Fprintf(sess, "%-30s commit %.10s %s %s\n", h.Repo, h.SHA, h.Time.Format(time.DateOnly), subject)
+		case "ref":
+			fmt.Fprintf(sess, "%-30s ref    %s (%.10s)\n", h.Repo, h.Ref, h.SHA)
+		case "path":
+			fmt.Fprintf(sess, "%-30s path   %s\n", h.Repo, h.Path)
+		}
+	}
+}
+
+// readableSearchRepos pages through the repositories with a match for term,
+// in name order, and returns the first searchMaxRepos that the key can read.
+// complete is false when readable repositories were left out, or when access
+// checks stopped at searchMaxChecks.
+func readableSearchRepos(term, kind string, key ssh.PublicKey) (readable []string, complete bool, err error) {
+	readable = []string{}
+	after, checked := "", 0
+	for {
+		page, err := store.SearchRepos(term, kind, after, searchMaxRepos)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, name := range page {
+			if checked == searchMaxChecks {
+				return readable, false, nil
+			}
+			checked++
+			if _, access := lookupKey(name, key); access > git.NoAccess {
+				if len(readable) == searchMaxRepos {
+					return readable, false, nil
+				}
+				readable = append(readable, name)
+			}
+		}
+		if len(page) < searchMaxRepos {
+			return readable, true, nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+// searchHandler searches every repository, or the one given by repo.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	term := q.Get("q")
+	if term == "" {
+		writeError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	kind := q.Get("kind")
+	if kind != "" && kind != "commit" && kind != "ref" && kind != "path" {
+		writeError(w, http.StatusBadRequest, errInvalidSearchKind.Error())
+		return
+	}
+	limit, _, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	var repos []string
+	if repo := q.Get("repo"); repo != "" {
+		repos = []string{resolveRepo(repo)}
+	}
+	hits, err := store.Search(term, kind, repos, limit)
+	if err != nil {
+		log.Error("Search failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, hits)
+}
+
+func reindexRepoHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := lookupRepoRecord(w, r)
+	if !ok {
+		return
+	}
+	if err := reindexRepo(repo.Name); err != nil {
+		log.Error("Failed to rebuild search index", "repo", repo.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to rebuild search index")
+		return
+	}
+	log.Info("Rebuilt search index", "repo", repo.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
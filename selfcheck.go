@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-ldap/ldap/v3"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// minGitVersion is the first release that runs pre-receive hooks against a
+// quarantine directory, which the hooks rely on.
+var minGitVersion = [2]int{2, 11}
+
+var gitVersionRegex = regexp.MustCompile(`git version (\d+)\.(\d+)`)
+
+// selfCheckResult collects problems found at startup. Problems stop the
+// server; warnings name a feature that will not work until they are fixed.
+type selfCheckResult struct {
+	problems []string
+	warnings []string
+}
+
+func (r *selfCheckResult) fail(format string, args ...any) {
+	r.problems = append(r.problems, fmt.Sprintf(format, args...))
+}
+
+func (r *selfCheckResult) warn(format string, args ...any) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+// selfCheck validates the configuration and the environment before the
+// server accepts connections, so that mistakes surface at startup instead
+// of at the first push.
+func selfCheck() selfCheckResult {
+	var r selfCheckResult
+	checkConfigValues(&r)
+	checkGit(&r)
+	checkWritableDir(&r, "GIT_SERVER_REPO_DIR", config.RepoDir, true)
+	checkWritableDir(&r, "GIT_SERVER_BACKUP_DIR", config.BackupDir, false)
+	checkWritableDir(&r, "GIT_SERVER_TRASH_DIR", config.TrashDir, false)
+	for _, t := range tenants {
+		checkWritableDir(&r, "repo_dir of tenant "+t.Name, t.RepoDir, true)
+	}
+	checkHostKey(&r)
+	checkAuthBackend(&r)
+	checkTenantAuthServers(&r)
+	return r
+}
+
+// reportSelfCheck logs the result of selfCheck and reports whether the
+// server may start.
+func reportSelfCheck(r selfCheckResult) bool {
+	for _, w := range r.warnings {
+		log.Warn("Self-check: " + w)
+	}
+	for _, p := range r.problems {
+		log.Error("Self-check: " + p)
+	}
+	if len(r.problems) > 0 {
+		return false
+	}
+	log.Info("Self-check passed", "warnings", len(r.warnings))
+	return true
+}
+
+func checkConfigValues(r *selfCheckResult) {
+	if len(invalidEnv) > 0 {
+		r.warn("ignoring invalid values: %s", strings.Join(invalidEnv, ", "))
+	}
+	if port, err := strconv.Atoi(config.Port); err != nil || port < 1 || port > 65535 {
+		r.fail("GIT_SERVER_PORT must be a port number between 1 and 65535, got %q", config.Port)
+	}
+	if config.HTTPTimeout <= 0 {
+		r.fail("GIT_SERVER_HTTP_TIMEOUT must be positive, got %s", config.HTTPTimeout)
+	}
+	if err := checkHTTPURL(config.InternalServer); err != nil {
+		if config.AuthBackend == "http" {
+			r.fail("GIT_SERVER_AUTHORIZATION_SERVER_URL: %v", err)
+		} else {
+			r.warn("GIT_SERVER_AUTHORIZATION_SERVER_URL: %v; backup uploads will fail", err)
+		}
+	}
+	if config.RepoNameCase != repoNameCaseSensitive && config.RepoNameCase != repoNameCaseInsensitive {
+		r.fail("GIT_SERVER_REPO_NAME_CASE must be sensitive or insensitive, got %q", config.RepoNameCase)
+	}
+	if adminAPIEnabled() {
+		if _, _, err := net.SplitHostPort(config.AdminAddr); err != nil {
+			r.fail("GIT_SERVER_ADMIN_ADDR must be host:port, got %q", config.AdminAddr)
+		}
+	}
+	for _, fp := range config.AdminKeys {
+		if !strings.HasPrefix(fp, "SHA256:") {
+			r.warn("GIT_SERVER_ADMIN_KEYS entry %q is not a SHA256 fingerprint and never matches a key", fp)
+		}
+	}
+	if config.MaxFileSize < 0 {
+		r.warn("GIT_SERVER_MAX_FILE_SIZE is negative; no size limit is enforced")
+	}
+	if config.AuthAlertErrorRatio <= 0 || config.AuthAlertErrorRatio > 1 {
+		r.warn("GIT_SERVER_AUTH_ALERT_ERROR_RATIO should be between 0 and 1, got %g", config.AuthAlertErrorRatio)
+	}
+	if config.AuthAlertURL != "" {
+		if err := checkHTTPURL(config.AuthAlertURL); err != nil {
+			r.warn("GIT_SERVER_AUTH_ALERT_URL: %v; alerts will not be delivered", err)
+		}
+	}
+	if config.MirrorAlertURL != "" {
+		if err := checkHTTPURL(config.MirrorAlertURL); err != nil {
+			r.warn("GIT_SERVER_MIRROR_ALERT_URL: %v; alerts will not be delivered", err)
+		}
+	}
+	if _, err := loadAuditSigner(config.AuditSigningKey); err != nil {
+		r.fail("GIT_SERVER_AUDIT_SIGNING_KEY %s: %v", config.AuditSigningKey, err)
+	}
+	for _, p := range []struct{ env, setting string }{
+		{"GIT_SERVER_AUTH_PROXY", config.AuthProxy},
+		{"GIT_SERVER_WEBHOOK_PROXY", config.WebhookProxy},
+		{"GIT_SERVER_BACKUP_PROXY", config.BackupProxy},
+		{"GIT_SERVER_MIRROR_PROXY", config.MirrorProxy},
+	} {
+		if _, err := parseProxySetting(p.setting); err != nil {
+			r.fail("%s: %v", p.env, err)
+		}
+	}
+	if config.PushReceipts && config.ReceiptSigningKey != "" {
+		if _, err := loadReceiptSigner(); err != nil {
+			r.fail("GIT_SERVER_RECEIPT_SIGNING_KEY %s: %v", config.ReceiptSigningKey, err)
+		}
+	}
+	if config.Umask != "" {
+		if _, err := parseUmask(config.Umask); err != nil {
+			r.fail("GIT_SERVER_UMASK: %v", err)
+		}
+	}
+	if _, err := loadRepoPermissions(); err != nil {
+		r.fail("%v", err)
+	}
+	if config.RepoRestorecon {
+		if _, err := exec.LookPath("restorecon"); err != nil {
+			r.fail("GIT_SERVER_REPO_RESTORECON is set but restorecon is not on PATH")
+		}
+	}
+	if config.InitTemplate != "" {
+		if _, err := templateFiles(config.InitTemplate, "", ""); err != nil {
+			r.fail("GIT_SERVER_INIT_TEMPLATE %q: %v", config.InitTemplate, err)
+		}
+	}
+}
+
+func checkHTTPURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", raw)
+	}
+	return nil
+}
+
+func checkGit(r *selfCheckResult) {
+	out, err := exec.Command("git", "--version").Output()
+	if err != nil {
+		r.fail("git is not installed or not on PATH: %v", err)
+		return
+	}
+	m := gitVersionRegex.FindStringSubmatch(string(out))
+	if m == nil {
+		r.warn("could not parse the git version from %q", strings.TrimSpace(string(out)))
+	} else {
+		major, _ := strconv.Atoi(m[1])
+		minor, _ := strconv.Atoi(m[2])
+		if major < minGitVersion[0] || (major == minGitVersion[0] && minor < minGitVersion[1]) {
+			r.fail("git %d.%d is too old, %d.%d or newer is required", major, minor, minGitVersion[0], minGitVersion[1])
+		}
+	}
+	// The hooks are bash scripts that upload backups with curl.
+	if _, err := exec.LookPath("bash"); err != nil {
+		r.fail("bash is not on PATH; repository hooks cannot run and every push would fail")
+	}
+	if _, err := exec.LookPath("curl"); err != nil {
+		r.warn("curl is not on PATH; push backups will not be uploaded")
+	}
+}
+
+// checkWritableDir creates dir if needed and makes sure files can be written
+// to it.
+func checkWritableDir(r *selfCheckResult, name, dir string, required bool) {
+	report := r.warn
+	if required {
+		report = r.fail
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		report("%s %s cannot be created: %v", name, dir, err)
+		return
+	}
+	f, err := os.CreateTemp(dir, ".git-server-check-*")
+	if err != nil {
+		report("%s %s is not writable: %v", name, dir, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func checkHostKey(r *selfCheckResult) {
+	data, err := os.ReadFile(config.SSHKeyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// wish generates a key on first start.
+		dir := filepath.Dir(config.SSHKeyPath)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			r.fail("GIT_SERVER_SSH_KEY_PATH %s does not exist and %s cannot be created: %v", config.SSHKeyPath, dir, err)
+		}
+		return
+	}
+	if err != nil {
+		r.fail("GIT_SERVER_SSH_KEY_PATH %s is not readable: %v", config.SSHKeyPath, err)
+		return
+	}
+	if _, err := gossh.ParsePrivateKey(data); err != nil {
+		r.fail("GIT_SERVER_SSH_KEY_PATH %s is not a usable private key: %v", config.SSHKeyPath, err)
+	}
+}
+
+// checkAuthBackend only warns: the backend may come up after the server,
+// and until it does every key is denied.
+func checkAuthBackend(r *selfCheckResult) {
+	switch config.AuthBackend {
+	case "http":
+		if checkHTTPURL(config.InternalServer) != nil {
+			return
+		}
+		client := newHTTPClient(egressAuth, config.HTTPTimeout)
+		resp, err := client.Get(config.InternalServer)
+		if err != nil {
+			r.warn("authorization server %s is unreachable: %v; all keys are denied until it answers", config.InternalServer, err)
+			return
+		}
+		resp.Body.Close()
+	case "ldap":
+		if config.LDAPURL == "" {
+			return
+		}
+		conn, err := ldap.DialURL(config.LDAPURL, ldap.DialWithDialer(&net.Dialer{Timeout: config.HTTPTimeout}))
+		if err != nil {
+			r.warn("LDAP server %s is unreachable: %v; all keys are denied until it answers", config.LDAPURL, err)
+			return
+		}
+		defer conn.Close()
+		if config.LDAPBindDN != "" {
+			if err := conn.Bind(config.LDAPBindDN, config.LDAPBindPassword); err != nil {
+				r.warn("LDAP bind as %s failed: %v; all keys are denied until it succeeds", config.LDAPBindDN, err)
+			}
+		}
+	}
+}
+
+func checkTenantAuthServers(r *selfCheckResult) {
+	for _, t := range tenants {
+		resp, err := newHTTPClient(egressAuth, config.HTTPTimeout).Get(t.AuthServer)
+		if err != nil {
+			r.warn("authorization server %s of tenant %s is unreachable: %v; its keys are denied until it answers", t.AuthServer, t.Name, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var activeSessionsGauge = newGaugeVec("git_server_active_sessions", "SSH sessions currently open.")
+
+type activeSession struct {
+	ID          uint64
+	User        string
+	Fingerprint string
+	RemoteAddr  string
+	Command     string
+	Started     time.Time
+
+	sess ssh.Session
+}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*activeSession
+}
+
+var sessions = &sessionRegistry{sessions: map[uint64]*activeSession{}}
+
+func sessionMiddleware(next ssh.Handler) ssh.Handler {
+	return func(sess ssh.Session) {
+		id := sessions.add(sess)
+		defer sessions.remove(id)
+		next(sess)
+	}
+}
+
+func (r *sessionRegistry) add(sess ssh.Session) uint64 {
+	fingerprint := ""
+	if key := sess.PublicKey(); key != nil {
+		fingerprint = gossh.FingerprintSHA256(key)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	r.sessions[r.nextID] = &activeSession{
+		ID:          r.nextID,
+		User:        sess.User(),
+		Fingerprint: fingerprint,
+		RemoteAddr:  sess.RemoteAddr().String(),
+		Command:     strings.Join(sess.Command(), " "),
+		Started:     time.Now(),
+		sess:        sess,
+	}
+	activeSessionsGauge.Set(float64(len(r.sessions)))
+	return r.nextID
+}
+
+func (r *sessionRegistry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+	activeSessionsGauge.Set(float64(len(r.sessions)))
+}
+
+func (r *sessionRegistry) List() []activeSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]activeSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// KillKey closes every session authenticated with the key, and the
+// connections they came over so that no new session can be opened on them.
+// It returns how many sessions there were.
+func (r *sessionRegistry) KillKey(fingerprint string) int {
+	r.mu.Lock()
+	var matched []*activeSession
+	for _, s := range r.sessions {
+		if s.Fingerprint == fingerprint {
+			matched = append(matched, s)
+		}
+	}
+	r.mu.Unlock()
+	for _, s := range matched {
+		s.sess.Close()
+		if conn, ok := s.sess.Context().Value(ssh.ContextKeyConn).(gossh.Conn); ok {
+			conn.Close()
+		}
+	}
+	return len(matched)
+}
+
+// Kill closes the session's channel, which makes git exit and the client
+// disconnect.
+func (r *sessionRegistry) Kill(id uint64) bool {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	s.sess.Close()
+	return true
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	transfersTotal   = newCounterVec("git_server_transfers_total", "Git transfers by operation and result.", "op", "status")
+	transferBytes    = newCounterVec("git_server_transfer_bytes_total", "Bytes transferred over the wire by git operations.", "op", "direction")
+	transferObjects  = newCounterVec("git_server_transfer_objects_total", "Objects contained in transferred packfiles.", "op")
+	refsUpdatedTotal = newCounterVec("git_server_refs_updated_total", "Refs created, updated or deleted by pushes.")
+	transferDuration = newHistogramVec("git_server_transfer_duration_seconds", "Duration of git transfers.", durationBuckets, "op")
+)
+
+const recentTransferLimit = 50
+
+var (
+	recentTransfersMu sync.Mutex
+	recentTransfers   []transferStats
+)
+
+type transferStats struct {
+	Time        time.Time
+	Op          string
+	Repo        string
+	Fingerprint string
+	KeyID       string
+	RefsUpdated int
+	Objects     int64
+	BytesIn     int64
+	BytesOut    int64
+	Duration    time.Duration
+	Error       string
+}
+
+func recordTransfer(stats transferStats, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+		stats.Error = err.Error()
+	}
+	transfersTotal.Inc(stats.Op, status)
+	transferBytes.Add(float64(stats.BytesIn), stats.Op, "in")
+	transferBytes.Add(float64(stats.BytesOut), stats.Op, "out")
+	transferObjects.Add(float64(stats.Objects), stats.Op)
+	refsUpdatedTotal.Add(float64(stats.RefsUpdated))
+	transferDuration.Observe(stats.Duration.Seconds(), stats.Op)
+
+	stats.Time = time.Now()
+	recentTransfersMu.Lock()
+	recentTransfers = append(recentTransfers, stats)
+	if len(recentTransfers) > recentTransferLimit {
+		recentTransfers = recentTransfers[len(recentTransfers)-recentTransferLimit:]
+	}
+	recentTransfersMu.Unlock()
+	recordTraffic(stats)
+
+	sshLog.Info("Transfer finished",
+		"op", stats.Op,
+		"repo", stats.Repo,
+		"status", status,
+		"refs_updated", stats.RefsUpdated,
+		"objects", stats.Objects,
+		"bytes_in", stats.BytesIn,
+		"bytes_out", stats.BytesOut,
+		"duration", stats.Duration,
+	)
+}
+
+type meteredReader struct {
+	r    io.Reader
+	n    int64
+	pack packScanner
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	m.pack.scan(p[:n])
+	return n, err
+}
+
+type meteredWriter struct {
+	w    io.Writer
+	n    int64
+	pack packScanner
+}
+
+func (m *meteredWriter) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+	m.n += int64(n)
+	m.pack.scan(p[:n])
+	return n, err
+}
+
+var packSignature = []byte("PACK\x00\x00\x00")
+
+// packScanner looks for the packfile header in a protocol stream and reads the
+// object count from it. The header is "PACK", a 4-byte version and a 4-byte
+// object count, and may be split across writes.
+type packScanner struct {
+	tail    []byte
+	objects int64
+	found   bool
+}
+
+func (s *packScanner) scan(p []byte) {
+	if s.found || len(p) == 0 {
+		return
+	}
+	buf := append(s.tail, p...)
+	for offset := 0; ; {
+		i := bytes.Index(buf[offset:], packSignature)
+		if i < 0 {
+			break
+		}
+		i += offset
+		if len(buf) < i+12 {
+			s.tail = append([]byte(nil), buf[i:]...)
+			return
+		}
+		if version := buf[i+7]; version == 2 || version == 3 {
+			s.objects = int64(binary.BigEndian.Uint32(buf[i+8 : i+12]))
+			s.found = true
+			s.tail = nil
+			return
+		}
+		offset = i + 1
+	}
+	keep := min(len(buf), len(packSignature)-1)
+	s.tail = append([]byte(nil), buf[len(buf)-keep:]...)
+}
+
+// recentPushes returns the latest pushes, newest first.
+func recentPushes() []transferStats {
+	recentTransfersMu.Lock()
+	defer recentTransfersMu.Unlock()
+	var pushes []transferStats
+	for i := len(recentTransfers) - 1; i >= 0; i-- {
+		if recentTransfers[i].Op == "push" {
+			pushes = append(pushes, recentTransfers[i])
+		}
+	}
+	return pushes
+}
+
+func refSnapshot(path string) map[string]string {
+	refs := map[string]string{}
+	out, err := exec.Command("git", "-C", path, "for-each-ref", "--format=%(refname) %(objectname)").Output()
+	if err != nil {
+		return refs
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if ref, sha, ok := strings.Cut(line, " "); ok && !strings.HasPrefix(ref, refBackupPrefix) {
+			refs[ref] = sha
+		}
+	}
+	return refs
+}
+
+func changedRefs(before, after map[string]string) int {
+	changed := 0
+	for ref, sha := range after {
+		if before[ref] != sha {
+			changed++
+		}
+	}
+	for ref := range before {
+		if _, ok := after[ref]; !ok {
+			changed++
+		}
+	}
+	return changed
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+)
+
+// looseObjectThreshold is the number of loose objects above which a
+// repository is worth repacking.
+const looseObjectThreshold = 1000
+
+type repoStorage struct {
+	Repo          string   `json:"repo"`
+	LooseObjects  int64    `json:"loose_objects"`
+	LooseBytes    int64    `json:"loose_bytes"`
+	PackedObjects int64    `json:"packed_objects"`
+	Packs         int64    `json:"packs"`
+	PackBytes     int64    `json:"pack_bytes"`
+	PrunePackable int64    `json:"prune_packable"`
+	Garbage       int64    `json:"garbage"`
+	Bitmap        bool     `json:"bitmap"`
+	CommitGraph   bool     `json:"commit_graph"`
+	Score         float64  `json:"score"`
+	Advice        []string `json:"advice"`
+}
+
+// forkGroup is a set of repositories that share a root commit, with the
+// storage their common objects take up more than once.
+type forkGroup struct {
+	Repos            []string `json:"repos"`
+	DuplicateObjects int64    `json:"duplicate_objects"`
+	DuplicateBytes   int64    `json:"duplicate_bytes"`
+	Advice           string   `json:"advice"`
+}
+
+type storageReport struct {
+	GeneratedAt time.Time     `json:"generated_at"`
+	Repos       []repoStorage `json:"repos"`
+	Forks       []forkGroup   `json:"forks"`
+}
+
+// buildStorageReport inspects every repository, most in need of a repack
+// first. Comparing forks lists every object of the repositories involved, so
+// it can be skipped on very large servers.
+func buildStorageReport(forks bool) (storageReport, error) {
+	report := storageReport{GeneratedAt: time.Now().UTC(), Repos: []repoStorage{}, Forks: []forkGroup{}}
+	repos, err := listRepos()
+	if err != nil {
+		return report, fmt.Errorf("failed to list repositories: %w", err)
+	}
+	for _, repo := range repos {
+		s, err := inspectRepoStorage(repo)
+		if err != nil {
+			log.Warn("Failed to inspect repository storage", "repo", repo, "error", err)
+			continue
+		}
+		report.Repos = append(report.Repos, s)
+	}
+	sort.SliceStable(report.Repos, func(i, j int) bool {
+		return report.Repos[i].Score > report.Repos[j].Score
+	})
+	if forks {
+		if report.Forks, err = findForkDuplicates(repos); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func inspectRepoStorage(repo string) (repoStorage, error) {
+	s := repoStorage{Repo: repo, Advice: []string{}}
+	dir := repoDirPath(repo)
+	out, err := exec.Command("git", "-C", dir, "count-objects", "-v").Output()
+	if err != nil {
+		return s, fmt.Errorf("git count-objects failed: %w", err)
+	}
+	counts := map[string]int64{}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		counts[key], _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	}
+	s.LooseObjects = counts["count"]
+	s.LooseBytes = counts["size"] * 1024
+	s.PackedObjects = counts["in-pack"]
+	s.Packs = counts["packs"]
+	s.PackBytes = counts["size-pack"] * 1024
+	s.PrunePackable = counts["prune-packable"]
+	s.Garbage = counts["garbage"]
+	bitmaps, _ := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.bitmap"))
+	s.Bitmap = len(bitmaps) > 0
+	if _, err := os.Stat(filepath.Join(dir, "objects", "info", "commit-graph")); err == nil {
+		s.CommitGraph = true
+	} else if _, err := os.Stat(filepath.Join(dir, "objects", "info", "commit-graphs")); err == nil {
+		s.CommitGraph = true
+	}
+
+	// One point for each reason to repack, scaled by how far past it the
+	// repository is.
+	if s.LooseObjects >= looseObjectThreshold {
+		s.Score += float64(s.LooseObjects) / looseObjectThreshold
+		s.Advice = append(s.Advice, fmt.Sprintf("%d loose objects (%s); repack to pack them", s.LooseObjects, formatBytes(s.LooseBytes)))
+	}
+	if s.Packs > 1 {
+		s.Score += float64(s.Packs - 1)
+		s.Advice = append(s.Advice, fmt.Sprintf("%d packs; repack into one", s.Packs))
+	}
+	if s.PrunePackable > 0 {
+		s.Score += 1 + float64(s.PrunePackable)/looseObjectThreshold
+		s.Advice = append(s.Advice, fmt.Sprintf("%d loose objects are also packed; prune them", s.PrunePackable))
+	}
+	if s.Garbage > 0 {
+		s.Score += float64(s.Garbage)
+		s.Advice = append(s.Advice, fmt.Sprintf("%d unexpected files in objects/", s.Garbage))
+	}
+	if s.Packs > 0 && !s.Bitmap {
+		s.Score++
+		s.Advice = append(s.Advice, "no bitmap index; a repack writes one and speeds up clones")
+	}
+	if s.PackedObjects > 0 && !s.CommitGraph {
+		s.Advice = append(s.Advice, "no commit-graph; git commit-graph write speeds up history walks")
+	}
+	s.Score = math.Round(s.Score*100) / 100
+	return s, nil
+}
+
+// findForkDuplicates groups repositories that share a root commit and counts
+// the objects they store more than once.
+func findForkDuplicates(repos []string) ([]forkGroup, error) {
+	parent := map[string]string{}
+	var find func(string) string
+	find = func(r string) string {
+		if parent[r] != r {
+			parent[r] = find(parent[r])
+		}
+		return parent[r]
+	}
+	rootOwner := map[string]string{}
+	for _, repo := range repos {
+		parent[repo] = repo
+		out, err := exec.Command("git", "-C", repoDirPath(repo), "rev-list", "--max-parents=0", "--all").Output()
+		if err != nil {
+			// Empty repositories have no commits.
+			continue
+		}
+		for _, root := range strings.Fields(string(out)) {
+			if other, ok := rootOwner[root]; ok {
+				parent[find(repo)] = find(other)
+			} else {
+				rootOwner[root] = repo
+			}
+		}
+	}
+	members := map[string][]string{}
+	for _, repo := range repos {
+		members[find(repo)] = append(members[find(repo)], repo)
+	}
+
+	groups := []forkGroup{}
+	for _, group := range members {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Strings(group)
+		g, err := measureDuplicates(group)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].DuplicateBytes > groups[j].DuplicateBytes
+	})
+	return groups, nil
+}
+
+func measureDuplicates(repos []string) (forkGroup, error) {
+	g := forkGroup{Repos: repos}
+	type object struct {
+		copies int64
+		size   int64
+	}
+	objects := map[string]*object{}
+	for _, repo := range repos {
+		out, err := exec.Command("git", "-C", repoDirPath(repo), "cat-file", "--batch-all-objects", "--batch-check=%(objectname) %(objectsize:disk)").Output()
+		if err != nil {
+			return g, fmt.Errorf("failed to list objects of %s: %w", repo, err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			oid, size, ok := strings.Cut(scanner.Text(), " ")
+			if !ok {
+				continue
+			}
+			o := objects[oid]
+			if o == nil {
+				o = &object{}
+				objects[oid] = o
+			}
+			o.copies++
+			o.size, _ = strconv.ParseInt(size, 10, 64)
+		}
+	}
+	for _, o := range objects {
+		if o.copies > 1 {
+			g.DuplicateObjects += o.copies - 1
+			g.DuplicateBytes += (o.copies - 1) * o.size
+		}
+	}
+	g.Advice = fmt.Sprintf("%s is stored more than once; pooling these repositories with git alternates would save it", formatBytes(g.DuplicateBytes))
+	if g.DuplicateBytes == 0 {
+		g.Advice = "no duplicate objects"
+	}
+	return g, nil
+}
+
+// storageReportHandler serves the report. forks=false skips the comparison
+// of forks.
+func storageReportHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := buildStorageReport(r.URL.Query().Get("forks") != "false")
+	if err != nil {
+		log.Error("Failed to build storage report", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to build storage report")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func storageCommand(sess ssh.Session, args []string) {
+	if !isAdminKey(sess.PublicKey()) {
+		wish.Fatalln(sess, "storage is restricted to admin keys")
+		return
+	}
+	if len(args) > 1 || (len(args) == 1 && args[0] != "--no-forks") {
+		wish.Fatalln(sess, "usage: storage [--no-forks]")
+		return
+	}
+	report, err := buildStorageReport(len(args) == 0)
+	if err != nil {
+		sshLog.Error("Failed to build storage report", "error", err)
+		wish.Fatalln(sess, "failed to build storage report")
+		return
+	}
+	fmt.Fprintf(sess, "%-30s %-7s %-8s %-6s %-10s %s\n", "REPO", "SCORE", "LOOSE", "PACKS", "SIZE", "ADVICE")
+	for _, s := range report.Repos {
+		advice := strings.Join(s.Advice, "; ")
+		if advice == "" {
+			advice = "-"
+		}
+		fmt.Fprintf(sess, "%-30s %-7.2f %-8d %-6d %-10s %s\n", s.Repo, s.Score, s.LooseObjects, s.Packs, formatBytes(s.LooseBytes+s.PackBytes), advice)
+	}
+	if len(report.Forks) > 0 {
+		fmt.Fprintln(sess, "\nForks sharing history:")
+		for _, g := range report.Forks {
+			fmt.Fprintf(sess, "%s: %d duplicate objects; %s\n", strings.Join(g.Repos, ", "), g.DuplicateObjects, g.Advice)
+		}
+	}
+}
@@ -0,0 +1,1637 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var errNotFound = errors.New("not found")
+
+// migrations are applied in order and recorded in schema_migrations. Never
+// edit an entry once released; append a new one instead. {{serial}} expands to
+// an auto-incrementing primary key for the active driver.
+var migrations = []string{
+	`CREATE TABLE repos (
+		name TEXT PRIMARY KEY,
+		owner TEXT NOT NULL DEFAULT '',
+		visibility TEXT NOT NULL DEFAULT 'private',
+		quota_bytes BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE TABLE aliases (
+		alias TEXT PRIMARY KEY,
+		repo TEXT NOT NULL REFERENCES repos (name) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+	CREATE TABLE webhooks (
+		id {{serial}},
+		repo TEXT NOT NULL REFERENCES repos (name) ON DELETE CASCADE ON UPDATE CASCADE,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE TABLE tokens (
+		id {{serial}},
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		read_only BOOLEAN NOT NULL DEFAULT FALSE,
+		expires_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE TABLE audit_log (
+		id {{serial}},
+		time TIMESTAMP NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		repo TEXT NOT NULL DEFAULT '',
+		details TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX audit_log_repo ON audit_log (repo, id);`,
+	`CREATE TABLE activity (
+		id {{serial}},
+		time TIMESTAMP NOT NULL,
+		repo TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		type TEXT NOT NULL,
+		ref TEXT NOT NULL DEFAULT '',
+		old_rev TEXT NOT NULL DEFAULT '',
+		new_rev TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX activity_repo ON activity (repo, id);
+	CREATE INDEX activity_time ON activity (time);`,
+	`CREATE TABLE commit_statuses (
+		id {{serial}},
+		repo TEXT NOT NULL REFERENCES repos (name) ON DELETE CASCADE ON UPDATE CASCADE,
+		sha TEXT NOT NULL,
+		context TEXT NOT NULL,
+		state TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		target_url TEXT NOT NULL DEFAULT '',
+		actor TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX commit_statuses_sha ON commit_statuses (repo, sha, id);
+	CREATE TABLE protected_branches (
+		repo TEXT NOT NULL REFERENCES repos (name) ON DELETE CASCADE ON UPDATE CASCADE,
+		pattern TEXT NOT NULL,
+		require_status BOOLEAN NOT NULL DEFAULT FALSE,
+		required_contexts TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (repo, pattern)
+	);`,
+	`CREATE TABLE maintenance (
+		repo TEXT PRIMARY KEY,
+		message TEXT NOT NULL DEFAULT '',
+		eta TIMESTAMP,
+		block_fetch BOOLEAN NOT NULL DEFAULT FALSE,
+		actor TEXT NOT NULL DEFAULT '',
+		started_at TIMESTAMP NOT NULL
+	);`,
+	`CREATE TABLE traffic (
+		hour TIMESTAMP NOT NULL,
+		fingerprint TEXT NOT NULL,
+		key_id TEXT NOT NULL DEFAULT '',
+		repo TEXT NOT NULL,
+		op TEXT NOT NULL,
+		operations BIGINT NOT NULL DEFAULT 0,
+		bytes_in BIGINT NOT NULL DEFAULT 0,
+		bytes_out BIGINT NOT NULL DEFAULT 0,
+		objects BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (hour, fingerprint, repo, op)
+	);
+	CREATE INDEX traffic_repo ON traffic (repo, hour);`,
+	`CREATE TABLE repo_requests (
+		name TEXT PRIMARY KEY,
+		owner TEXT NOT NULL DEFAULT '',
+		requested_by TEXT NOT NULL,
+		requested_at TIMESTAMP NOT NULL
+	);`,
+	`ALTER TABLE audit_log ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+	CREATE TABLE audit_signatures (
+		id {{serial}},
+		last_id BIGINT NOT NULL,
+		hash TEXT NOT NULL,
+		key TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		signed_at TIMESTAMP NOT NULL
+	);`,
+	`CREATE TABLE guest_grants (
+		id {{serial}},
+		repo TEXT NOT NULL REFERENCES repos (name) ON DELETE CASCADE ON UPDATE CASCADE,
+		fingerprint TEXT NOT NULL,
+		public_key TEXT NOT NULL,
+		read_write BOOLEAN NOT NULL DEFAULT FALSE,
+		note TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);`,
+	`CREATE INDEX guest_grants_fingerprint ON guest_grants (repo, fingerprint);`,
+	`CREATE TABLE key_revocations (
+		fingerprint TEXT PRIMARY KEY,
+		revoke_at TIMESTAMP NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	);`,
+	`CREATE TABLE search_commits (
+		repo TEXT NOT NULL REFERENCES repos (name) ON DELETE CASCADE ON UPDATE CASCADE,
+		sha TEXT NOT NULL,
+		author TEXT NOT NULL DEFAULT '',
+		committed_at TIMESTAMP NOT NULL,
+		message TEXT NOT NULL,
+		PRIMARY KEY (repo, sha)
+	);
+	CREATE TABLE search_refs (
+		repo TEXT NOT NULL REFERENCES repos (name) ON DELETE CASCADE ON UPDATE CASCADE,
+		ref TEXT NOT NULL,
+		sha TEXT NOT NULL,
+		PRIMARY KEY (repo, ref)
+	);
+	CREATE TABLE search_paths (
+		repo TEXT NOT NULL REFERENCES repos (name) ON DELETE CASCADE ON UPDATE CASCADE,
+		path TEXT NOT NULL,
+		PRIMARY KEY (repo, path)
+	);`,
+	`CREATE TABLE mirrors (
+		id {{serial}},
+		repo TEXT NOT NULL REFERENCES repos (name) ON DELETE CASCADE ON UPDATE CASCADE,
+		url TEXT NOT NULL,
+		direction TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		last_sync_at TIMESTAMP,
+		last_success_at TIMESTAMP,
+		last_error TEXT NOT NULL DEFAULT '',
+		checked_at TIMESTAMP,
+		diverged_refs INTEGER NOT NULL DEFAULT 0
+	);`,
+	`CREATE INDEX repos_lower_name ON repos (LOWER(name));`,
+}
+
+type metadataStore struct {
+	db     *sql.DB
+	driver string
+}
+
+var store *metadataStore
+
+func openStore(driver, dsn string) (*metadataStore, error) {
+	var db *sql.DB
+	var err error
+	switch driver {
+	case "sqlite":
+		if dsn == "" {
+			if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create data directory: %w", err)
+			}
+			// Immediate transactions take the write lock up front, so a
+			// transaction that reads before writing, like AddAudit, waits
+			// for the hook or server process instead of failing with
+			// SQLITE_BUSY_SNAPSHOT.
+			dsn = "file:" + filepath.Join(config.DataDir, "git-server.db") + "?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+		}
+		db, err = sql.Open("sqlite3", dsn)
+		if err == nil {
+			// SQLite only allows one writer; serializing avoids SQLITE_BUSY
+			// under concurrent pushes.
+			db.SetMaxOpenConns(1)
+		}
+	case "postgres":
+		if dsn == "" {
+			return nil, errors.New("GIT_SERVER_DB_DSN is required for the postgres driver")
+		}
+		db, err = sql.Open("pgx", dsn)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q, expected sqlite or postgres", driver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	s := &metadataStore{db: db, driver: driver}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *metadataStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *metadataStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	var current int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this server supports (%d)", current, len(migrations))
+	}
+
+	serial := "INTEGER PRIMARY KEY AUTOINCREMENT"
+	if s.driver == "postgres" {
+		serial = "BIGSERIAL PRIMARY KEY"
+	}
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(strings.ReplaceAll(migrations[i], "{{serial}}", serial)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(s.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), version, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+		log.Info("Applied database migration", "version", version)
+	}
+	return nil
+}
+
+// rebind rewrites ? placeholders into the $n form Postgres expects.
+func (s *metadataStore) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *metadataStore) exec(query string, args ...any) (sql.Result, error) {
+	return s.db.Exec(s.rebind(query), args...)
+}
+
+func (s *metadataStore) query(query string, args ...any) (*sql.Rows, error) {
+	return s.db.Query(s.rebind(query), args...)
+}
+
+func (s *metadataStore) queryRow(query string, args ...any) *sql.Row {
+	return s.db.QueryRow(s.rebind(query), args...)
+}
+
+type repoRecord struct {
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner"`
+	Visibility string    `json:"visibility"`
+	QuotaBytes int64     `json:"quota_bytes"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+const (
+	visibilityPrivate = "private"
+	visibilityPublic  = "public"
+)
+
+// AddRepo records a repository, leaving an existing row untouched.
+func (s *metadataStore) AddRepo(name, owner string) error {
+	_, err := s.exec(`INSERT INTO repos (name, owner, visibility, quota_bytes, created_at)
+		VALUES (?, ?, ?, 0, ?) ON CONFLICT (name) DO NOTHING`,
+		name, owner, visibilityPrivate, time.Now().UTC())
+	return err
+}
+
+// ImportRepo inserts or overwrites a repository record, keeping its creation
+// time.
+func (s *metadataStore) ImportRepo(r repoRecord) error {
+	_, err := s.exec(`INSERT INTO repos (name, owner, visibility, quota_bytes, created_at)
+		VALUES (?, ?, ?, ?, ?) ON CONFLICT (name) DO UPDATE SET
+		owner = excluded.owner, visibility = excluded.visibility, quota_bytes = excluded.quota_bytes, created_at = excluded.created_at`,
+		r.Name, r.Owner, r.Visibility, r.QuotaBytes, r.CreatedAt.UTC())
+	return err
+}
+
+func (s *metadataStore) Repo(name string) (repoRecord, error) {
+	var r repoRecord
+	err := s.queryRow(`SELECT name, owner, visibility, quota_bytes, created_at FROM repos WHERE name = ?`, name).
+		Scan(&r.Name, &r.Owner, &r.Visibility, &r.QuotaBytes, &r.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, errNotFound
+	}
+	return r, err
+}
+
+func (s *metadataStore) Repos(owner, visibility string) ([]repoRecord, error) {
+	rows, err := s.query(`SELECT name, owner, visibility, quota_bytes, created_at FROM repos
+		WHERE (? = '' OR owner = ?) AND (? = '' OR visibility = ?) ORDER BY name`,
+		owner, owner, visibility, visibility)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	repos := []repoRecord{}
+	for rows.Next() {
+		var r repoRecord
+		if err := rows.Scan(&r.Name, &r.Owner, &r.Visibility, &r.QuotaBytes, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		repos = append(repos, r)
+	}
+	return repos, rows.Err()
+}
+
+// RepoNames returns up to limit repository names after the given name, in
+// order, optionally only those containing search. It lets listings page
+// through large servers without reading every name.
+func (s *metadataStore) RepoNames(after, search string, limit int) ([]string, error) {
+	pattern := ""
+	if search != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(search))
+		pattern = "%" + escaped + "%"
+	}
+	rows, err := s.query(`SELECT name FROM repos WHERE name > ? AND (? = '' OR LOWER(name) LIKE ? ESCAPE '\')
+		ORDER BY name LIMIT ?`, after, pattern, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make([]string, 0, limit)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// ReposByFoldedName returns the recorded repositories whose name equals name
+// regardless of case.
+func (s *metadataStore) ReposByFoldedName(name string) ([]string, error) {
+	rows, err := s.query(`SELECT name FROM repos WHERE LOWER(name) = ? ORDER BY name`, strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (s *metadataStore) UpdateRepo(r repoRecord) error {
+	res, err := s.exec(`UPDATE repos SET owner = ?, visibility = ?, quota_bytes = ? WHERE name = ?`,
+		r.Owner, r.Visibility, r.QuotaBytes, r.Name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// TransferRepo renames a repository and changes its owner in one
+// transaction. Aliases, webhooks, statuses and branch protection follow the
+// rename through ON UPDATE CASCADE; the activity feed, maintenance windows and
+// traffic history are moved explicitly and alias is left pointing at the new
+// name.
+func (s *metadataStore) TransferRepo(from, to, owner, alias string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if from != to {
+		// An alias left by an earlier transfer may hold the new name.
+		if _, err := tx.Exec(s.rebind(`DELETE FROM aliases WHERE alias = ? AND repo = ?`), to, from); err != nil {
+			return err
+		}
+	}
+	res, err := tx.Exec(s.rebind(`UPDATE repos SET name = ?, owner = ? WHERE name = ?`), to, owner, from)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	if from != to {
+		if _, err := tx.Exec(s.rebind(`UPDATE activity SET repo = ? WHERE repo = ?`), to, from); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(s.rebind(`UPDATE maintenance SET repo = ? WHERE repo = ?`), to, from); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(s.rebind(`UPDATE traffic SET repo = ? WHERE repo = ?`), to, from); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(s.rebind(`INSERT INTO aliases (alias, repo) VALUES (?, ?)
+			ON CONFLICT (alias) DO UPDATE SET repo = excluded.repo`), alias, to); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *metadataStore) DeleteRepo(name string) error {
+	if _, err := s.exec(`DELETE FROM maintenance WHERE repo = ?`, name); err != nil {
+		return err
+	}
+	_, err := s.exec(`DELETE FROM repos WHERE name = ?`, name)
+	return err
+}
+
+// syncRepos backfills rows for repositories that exist on disk but not in the
+// database, e.g. on first start after upgrading. Rows for repositories that
+// are missing on disk are kept, since deleting them would also drop their
+// aliases, webhooks, protection and history; they are logged and can be
+// pruned through the admin API.
+func (s *metadataStore) syncRepos() error {
+	onDisk, err := listRepos()
+	if err != nil {
+		return fmt.Errorf("failed to list repositories: %w", err)
+	}
+	known, err := s.Repos("", "")
+	if err != nil {
+		return fmt.Errorf("failed to list repository records: %w", err)
+	}
+	seen := make(map[string]bool, len(known))
+	for _, r := range known {
+		seen[r.Name] = true
+	}
+	for _, name := range onDisk {
+		if seen[name] {
+			continue
+		}
+		if err := s.AddRepo(name, ""); err != nil {
+			return fmt.Errorf("failed to record repository %s: %w", name, err)
+		}
+		log.Info("Recorded existing repository", "repo", name)
+	}
+	orphans, err := s.orphanedRepos()
+	if err != nil {
+		return err
+	}
+	for _, name := range orphans {
+		log.Warn("Repository missing on disk, keeping its record", "repo", name, "prune", "DELETE /api/repos/orphans")
+	}
+	return nil
+}
+
+// orphanedRepos lists recorded repositories that have no directory on disk.
+func (s *metadataStore) orphanedRepos() ([]string, error) {
+	known, err := s.Repos("", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repository records: %w", err)
+	}
+	var orphans []string
+	for _, r := range known {
+		if !repoExists(r.Name) {
+			orphans = append(orphans, r.Name)
+		}
+	}
+	return orphans, nil
+}
+
+// checkRepoRoots fails if a repository directory that did not exist at
+// startup has repositories recorded in it, e.g. because its volume is not
+// mounted. A missing directory without records is a fresh install.
+func (s *metadataStore) checkRepoRoots(missing []string) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	known, err := s.Repos("", "")
+	if err != nil {
+		return fmt.Errorf("failed to list repository records: %w", err)
+	}
+	for _, root := range missing {
+		for _, r := range known {
+			if filepath.Dir(repoDirPath(r.Name)) == filepath.Clean(root) {
+				return fmt.Errorf("repository directory %s does not exist but repository %s is recorded in it", root, r.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *metadataStore) Aliases() (map[string]string, error) {
+	rows, err := s.query(`SELECT alias, repo FROM aliases`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := map[string]string{}
+	for rows.Next() {
+		var alias, repo string
+		if err := rows.Scan(&alias, &repo); err != nil {
+			return nil, err
+		}
+		list[alias] = repo
+	}
+	return list, rows.Err()
+}
+
+func (s *metadataStore) SetAlias(alias, repo string) error {
+	_, err := s.exec(`INSERT INTO aliases (alias, repo) VALUES (?, ?)
+		ON CONFLICT (alias) DO UPDATE SET repo = excluded.repo`, alias, repo)
+	return err
+}
+
+func (s *metadataStore) DeleteAlias(alias string) error {
+	_, err := s.exec(`DELETE FROM aliases WHERE alias = ?`, alias)
+	return err
+}
+
+type webhook struct {
+	ID        int64     `json:"id"`
+	Repo      string    `json:"repo"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Webhooks lists the webhooks of one repository, or of all repositories when
+// repo is empty.
+func (s *metadataStore) Webhooks(repo string) ([]webhook, error) {
+	rows, err := s.query(`SELECT id, repo, url, secret, created_at FROM webhooks WHERE ? = '' OR repo = ? ORDER BY id`, repo, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []webhook{}
+	for rows.Next() {
+		var h webhook
+		if err := rows.Scan(&h.ID, &h.Repo, &h.URL, &h.Secret, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *metadataStore) AddWebhook(repo, url, secret string) (webhook, error) {
+	h := webhook{Repo: repo, URL: url, Secret: secret, CreatedAt: time.Now().UTC()}
+	err := s.queryRow(`INSERT INTO webhooks (repo, url, secret, created_at) VALUES (?, ?, ?, ?) RETURNING id`,
+		h.Repo, h.URL, h.Secret, h.CreatedAt).Scan(&h.ID)
+	return h, err
+}
+
+func (s *metadataStore) ImportWebhook(h webhook) error {
+	var exists bool
+	err := s.queryRow(`SELECT EXISTS (SELECT 1 FROM webhooks WHERE repo = ? AND url = ?)`, h.Repo, h.URL).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = s.exec(`INSERT INTO webhooks (repo, url, secret, created_at) VALUES (?, ?, ?, ?)`,
+		h.Repo, h.URL, h.Secret, h.CreatedAt.UTC())
+	return err
+}
+
+func (s *metadataStore) DeleteWebhook(repo string, id int64) error {
+	res, err := s.exec(`DELETE FROM webhooks WHERE repo = ? AND id = ?`, repo, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// mirror is a push or pull mirror of a repository together with its health:
+// the last sync attempt and success, and how many branches and tags differed
+// from the mirror when they were last compared.
+type mirror struct {
+	ID            int64      `json:"id"`
+	Repo          string     `json:"repo"`
+	URL           string     `json:"url"`
+	Direction     string     `json:"direction"`
+	CreatedAt     time.Time  `json:"created_at"`
+	LastSyncAt    *time.Time `json:"last_sync_at,omitempty"`
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CheckedAt     *time.Time `json:"checked_at,omitempty"`
+	DivergedRefs  int        `json:"diverged_refs"`
+}
+
+// Mirrors lists the mirrors of one repository, or of all repositories when
+// repo is empty.
+func (s *metadataStore) Mirrors(repo string) ([]mirror, error) {
+	rows, err := s.query(`SELECT id, repo, url, direction, created_at, last_sync_at, last_success_at, last_error, checked_at, diverged_refs
+		FROM mirrors WHERE ? = '' OR repo = ? ORDER BY id`, repo, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	mirrors := []mirror{}
+	for rows.Next() {
+		var m mirror
+		if err := rows.Scan(&m.ID, &m.Repo, &m.URL, &m.Direction, &m.CreatedAt, &m.LastSyncAt, &m.LastSuccessAt, &m.LastError, &m.CheckedAt, &m.DivergedRefs); err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, m)
+	}
+	return mirrors, rows.Err()
+}
+
+func (s *metadataStore) AddMirror(repo, url, direction string) (mirror, error) {
+	m := mirror{Repo: repo, URL: url, Direction: direction, CreatedAt: time.Now().UTC()}
+	err := s.queryRow(`INSERT INTO mirrors (repo, url, direction, created_at) VALUES (?, ?, ?, ?) RETURNING id`,
+		m.Repo, m.URL, m.Direction, m.CreatedAt).Scan(&m.ID)
+	return m, err
+}
+
+// ImportMirror adds a mirror with its original creation time unless the
+// repository already has it. Its health starts over.
+func (s *metadataStore) ImportMirror(m mirror) error {
+	var exists bool
+	err := s.queryRow(`SELECT EXISTS (SELECT 1 FROM mirrors WHERE repo = ? AND url = ? AND direction = ?)`, m.Repo, m.URL, m.Direction).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = s.exec(`INSERT INTO mirrors (repo, url, direction, created_at) VALUES (?, ?, ?, ?)`,
+		m.Repo, m.URL, m.Direction, m.CreatedAt.UTC())
+	return err
+}
+
+func (s *metadataStore) DeleteMirror(repo string, id int64) error {
+	res, err := s.exec(`DELETE FROM mirrors WHERE repo = ? AND id = ?`, repo, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// UpdateMirrorHealth stores the result of a sync and comparison.
+func (s *metadataStore) UpdateMirrorHealth(m mirror) error {
+	_, err := s.exec(`UPDATE mirrors SET last_sync_at = ?, last_success_at = ?, last_error = ?, checked_at = ?, diverged_refs = ? WHERE id = ?`,
+		m.LastSyncAt, m.LastSuccessAt, m.LastError, m.CheckedAt, m.DivergedRefs, m.ID)
+	return err
+}
+
+type apiToken struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	ReadOnly  bool       `json:"read_only"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (s *metadataStore) Tokens() ([]apiToken, error) {
+	tokens, _, err := s.tokensWithHashes()
+	return tokens, err
+}
+
+func (s *metadataStore) tokensWithHashes() ([]apiToken, []string, error) {
+	rows, err := s.query(`SELECT id, name, read_only, expires_at, created_at, token_hash FROM tokens ORDER BY id`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	tokens := []apiToken{}
+	var hashes []string
+	for rows.Next() {
+		var t apiToken
+		var hash string
+		if err := rows.Scan(&t.ID, &t.Name, &t.ReadOnly, &t.ExpiresAt, &t.CreatedAt, &hash); err != nil {
+			return nil, nil, err
+		}
+		tokens = append(tokens, t)
+		hashes = append(hashes, hash)
+	}
+	return tokens, hashes, rows.Err()
+}
+
+func (s *metadataStore) AddToken(t apiToken, hash string) (apiToken, error) {
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now().UTC()
+	}
+	err := s.queryRow(`INSERT INTO tokens (name, token_hash, read_only, expires_at, created_at) VALUES (?, ?, ?, ?, ?) RETURNING id`,
+		t.Name, hash, t.ReadOnly, t.ExpiresAt, t.CreatedAt).Scan(&t.ID)
+	return t, err
+}
+
+func (s *metadataStore) ImportToken(t apiToken, hash string) error {
+	var exists bool
+	err := s.queryRow(`SELECT EXISTS (SELECT 1 FROM tokens WHERE token_hash = ?)`, hash).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = s.AddToken(t, hash)
+	return err
+}
+
+// TokenByHash returns the unexpired token with the given hash.
+func (s *metadataStore) TokenByHash(hash string) (apiToken, error) {
+	var t apiToken
+	err := s.queryRow(`SELECT id, name, read_only, expires_at, created_at FROM tokens WHERE token_hash = ?`, hash).
+		Scan(&t.ID, &t.Name, &t.ReadOnly, &t.ExpiresAt, &t.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)) {
+		return t, errNotFound
+	}
+	return t, err
+}
+
+func (s *metadataStore) DeleteToken(id int64) error {
+	res, err := s.exec(`DELETE FROM tokens WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+type auditEntry struct {
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	Repo    string    `json:"repo,omitempty"`
+	Details string    `json:"details,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// AddAudit appends e to the audit log, chaining its hash to the hash of the
+// previous entry.
+func (s *metadataStore) AddAudit(e auditEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if s.driver == "postgres" {
+		// Concurrent writers must not chain to the same previous entry.
+		if _, err := tx.Exec(`LOCK TABLE audit_log IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+	}
+	var prev string
+	err = tx.QueryRow(`SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`).Scan(&prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	// Postgres keeps microseconds; the hash must match what is read back.
+	e.Time = e.Time.UTC().Truncate(time.Microsecond)
+	e.Hash = auditHash(prev, e)
+	if _, err := tx.Exec(s.rebind(`INSERT INTO audit_log (time, actor, action, repo, details, hash) VALUES (?, ?, ?, ?, ?, ?)`),
+		e.Time, e.Actor, e.Action, e.Repo, e.Details, e.Hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AuditChain calls fn for every audit entry in insertion order.
+func (s *metadataStore) AuditChain(fn func(auditEntry) error) error {
+	rows, err := s.query(`SELECT id, time, actor, action, repo, details, hash FROM audit_log ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e auditEntry
+		if err := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.Action, &e.Repo, &e.Details, &e.Hash); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// LastAudit returns the newest audit entry.
+func (s *metadataStore) LastAudit() (auditEntry, error) {
+	var e auditEntry
+	err := s.queryRow(`SELECT id, time, actor, action, repo, details, hash FROM audit_log ORDER BY id DESC LIMIT 1`).
+		Scan(&e.ID, &e.Time, &e.Actor, &e.Action, &e.Repo, &e.Details, &e.Hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return e, errNotFound
+	}
+	return e, err
+}
+
+// auditSignature signs the audit chain up to and including LastID.
+type auditSignature struct {
+	ID        int64     `json:"id"`
+	LastID    int64     `json:"last_id"`
+	Hash      string    `json:"hash"`
+	Key       string    `json:"key"`
+	Signature string    `json:"signature"`
+	SignedAt  time.Time `json:"signed_at"`
+}
+
+func (s *metadataStore) AddAuditSignature(sig auditSignature) error {
+	_, err := s.exec(`INSERT INTO audit_signatures (last_id, hash, key, signature, signed_at) VALUES (?, ?, ?, ?, ?)`,
+		sig.LastID, sig.Hash, sig.Key, sig.Signature, sig.SignedAt.UTC())
+	return err
+}
+
+func (s *metadataStore) AuditSignatures() ([]auditSignature, error) {
+	rows, err := s.query(`SELECT id, last_id, hash, key, signature, signed_at FROM audit_signatures ORDER BY last_id, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sigs := []auditSignature{}
+	for rows.Next() {
+		var sig auditSignature
+		if err := rows.Scan(&sig.ID, &sig.LastID, &sig.Hash, &sig.Key, &sig.Signature, &sig.SignedAt); err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, rows.Err()
+}
+
+// LastAuditSignedID returns the newest entry covered by a signature, or 0.
+func (s *metadataStore) LastAuditSignedID() (int64, error) {
+	var id int64
+	err := s.queryRow(`SELECT COALESCE(MAX(last_id), 0) FROM audit_signatures`).Scan(&id)
+	return id, err
+}
+
+// AuditEntries returns the newest entries first, optionally limited to one
+// repository and to entries older than the before id for paging.
+func (s *metadataStore) AuditEntries(repo, action string, before int64, limit int) ([]auditEntry, error) {
+	rows, err := s.query(`SELECT id, time, actor, action, repo, details, hash FROM audit_log
+		WHERE (? = '' OR repo = ?) AND (? = '' OR action = ?) AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?`,
+		repo, repo, action, action, before, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		if err := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.Action, &e.Repo, &e.Details, &e.Hash); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *metadataStore) AddActivity(events []activityEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert := s.rebind(`INSERT INTO activity (time, repo, actor, type, ref, old_rev, new_rev) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	for _, e := range events {
+		if _, err := tx.Exec(insert, e.Time.UTC(), e.Repo, e.Actor, e.Type, e.Ref, e.OldRev, e.NewRev); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Activity returns the newest events first, optionally limited to one
+// repository, to events at or after since and to events older than the before
+// id for paging.
+func (s *metadataStore) Activity(repo string, since time.Time, before int64, limit int) ([]activityEvent, error) {
+	rows, err := s.query(`SELECT id, time, repo, actor, type, ref, old_rev, new_rev FROM activity
+		WHERE (? = '' OR repo = ?) AND time >= ? AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?`,
+		repo, repo, since.UTC(), before, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []activityEvent{}
+	for rows.Next() {
+		var e activityEvent
+		if err := rows.Scan(&e.ID, &e.Time, &e.Repo, &e.Actor, &e.Type, &e.Ref, &e.OldRev, &e.NewRev); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *metadataStore) ProtectedBranches(repo string) ([]protectedBranch, error) {
+	rows, err := s.query(`SELECT repo, pattern, require_status, required_contexts FROM protected_branches WHERE repo = ? ORDER BY pattern`, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []protectedBranch{}
+	for rows.Next() {
+		var rule protectedBranch
+		var contexts string
+		if err := rows.Scan(&rule.Repo, &rule.Pattern, &rule.RequireStatus, &contexts); err != nil {
+			return nil, err
+		}
+		rule.RequiredContexts = splitList(contexts)
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (s *metadataStore) SetProtectedBranch(rule protectedBranch) error {
+	_, err := s.exec(`INSERT INTO protected_branches (repo, pattern, require_status, required_contexts) VALUES (?, ?, ?, ?)
+		ON CONFLICT (repo, pattern) DO UPDATE SET require_status = excluded.require_status, required_contexts = excluded.required_contexts`,
+		rule.Repo, rule.Pattern, rule.RequireStatus, strings.Join(rule.RequiredContexts, ","))
+	return err
+}
+
+func (s *metadataStore) DeleteProtectedBranch(repo, pattern string) error {
+	res, err := s.exec(`DELETE FROM protected_branches WHERE repo = ? AND pattern = ?`, repo, pattern)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *metadataStore) AddCommitStatus(cs commitStatus) (commitStatus, error) {
+	cs.CreatedAt = time.Now().UTC()
+	err := s.queryRow(`INSERT INTO commit_statuses (repo, sha, context, state, description, target_url, actor, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		cs.Repo, cs.SHA, cs.Context, cs.State, cs.Description, cs.TargetURL, cs.Actor, cs.CreatedAt).Scan(&cs.ID)
+	return cs, err
+}
+
+// CommitStatuses returns every status reported for a commit, newest first.
+func (s *metadataStore) CommitStatuses(repo, sha string) ([]commitStatus, error) {
+	rows, err := s.query(`SELECT id, repo, sha, context, state, description, target_url, actor, created_at
+		FROM commit_statuses WHERE repo = ? AND sha = ? ORDER BY id DESC`, repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	statuses := []commitStatus{}
+	for rows.Next() {
+		var cs commitStatus
+		if err := rows.Scan(&cs.ID, &cs.Repo, &cs.SHA, &cs.Context, &cs.State, &cs.Description, &cs.TargetURL, &cs.Actor, &cs.CreatedAt); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, cs)
+	}
+	return statuses, rows.Err()
+}
+
+// RepoCommitStatuses returns every status reported in one repository, or in
+// all repositories when repo is empty, oldest first.
+func (s *metadataStore) RepoCommitStatuses(repo string) ([]commitStatus, error) {
+	rows, err := s.query(`SELECT id, repo, sha, context, state, description, target_url, actor, created_at
+		FROM commit_statuses WHERE ? = '' OR repo = ? ORDER BY id`, repo, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	statuses := []commitStatus{}
+	for rows.Next() {
+		var cs commitStatus
+		if err := rows.Scan(&cs.ID, &cs.Repo, &cs.SHA, &cs.Context, &cs.State, &cs.Description, &cs.TargetURL, &cs.Actor, &cs.CreatedAt); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, cs)
+	}
+	return statuses, rows.Err()
+}
+
+// ImportCommitStatus adds a status with its original time unless the same
+// report is already recorded.
+func (s *metadataStore) ImportCommitStatus(cs commitStatus) error {
+	var exists bool
+	err := s.queryRow(`SELECT EXISTS (SELECT 1 FROM commit_statuses WHERE repo = ? AND sha = ? AND context = ? AND created_at = ?)`,
+		cs.Repo, cs.SHA, cs.Context, cs.CreatedAt.UTC()).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = s.exec(`INSERT INTO commit_statuses (repo, sha, context, state, description, target_url, actor, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		cs.Repo, cs.SHA, cs.Context, cs.State, cs.Description, cs.TargetURL, cs.Actor, cs.CreatedAt.UTC())
+	return err
+}
+
+// maintenanceWindow is a period during which git operations are refused. An
+// empty Repo applies to the whole server.
+type maintenanceWindow struct {
+	Repo       string     `json:"repo,omitempty"`
+	Message    string     `json:"message"`
+	ETA        *time.Time `json:"eta,omitempty"`
+	BlockFetch bool       `json:"block_fetch"`
+	Actor      string     `json:"actor"`
+	StartedAt  time.Time  `json:"started_at"`
+}
+
+func (s *metadataStore) Maintenance(repo string) (maintenanceWindow, error) {
+	var m maintenanceWindow
+	err := s.queryRow(`SELECT repo, message, eta, block_fetch, actor, started_at FROM maintenance WHERE repo = ?`, repo).
+		Scan(&m.Repo, &m.Message, &m.ETA, &m.BlockFetch, &m.Actor, &m.StartedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, errNotFound
+	}
+	return m, err
+}
+
+func (s *metadataStore) MaintenanceWindows() ([]maintenanceWindow, error) {
+	rows, err := s.query(`SELECT repo, message, eta, block_fetch, actor, started_at FROM maintenance ORDER BY repo`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	windows := []maintenanceWindow{}
+	for rows.Next() {
+		var m maintenanceWindow
+		if err := rows.Scan(&m.Repo, &m.Message, &m.ETA, &m.BlockFetch, &m.Actor, &m.StartedAt); err != nil {
+			return nil, err
+		}
+		windows = append(windows, m)
+	}
+	return windows, rows.Err()
+}
+
+// SetMaintenance starts a maintenance window or updates the running one,
+// keeping its start time.
+func (s *metadataStore) SetMaintenance(m maintenanceWindow) error {
+	_, err := s.exec(`INSERT INTO maintenance (repo, message, eta, block_fetch, actor, started_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (repo) DO UPDATE SET message = excluded.message, eta = excluded.eta, block_fetch = excluded.block_fetch, actor = excluded.actor`,
+		m.Repo, m.Message, m.ETA, m.BlockFetch, m.Actor, m.StartedAt.UTC())
+	return err
+}
+
+func (s *metadataStore) ClearMaintenance(repo string) error {
+	res, err := s.exec(`DELETE FROM maintenance WHERE repo = ?`, repo)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// trafficRow holds git traffic totals. Rows are stored per hour, key,
+// repository and operation; queries leave the fields they don't group by
+// empty.
+type trafficRow struct {
+	Hour        *time.Time `json:"hour,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	KeyID       string     `json:"key_id,omitempty"`
+	Repo        string     `json:"repo,omitempty"`
+	Op          string     `json:"op,omitempty"`
+	Operations  int64      `json:"operations"`
+	BytesIn     int64      `json:"bytes_in"`
+	BytesOut    int64      `json:"bytes_out"`
+	Objects     int64      `json:"objects"`
+}
+
+type trafficQuery struct {
+	Since, Until time.Time
+	Key          string // key ID or fingerprint
+	Repo         string
+	Op           string
+	By           []string // any of key, repo, op and hour
+	Limit        int
+}
+
+// trafficColumns maps the grouping names of trafficQuery to columns.
+var trafficColumns = map[string]string{
+	"key":  "fingerprint, MAX(key_id)",
+	"repo": "repo",
+	"op":   "op",
+	"hour": "hour",
+}
+
+func (s *metadataStore) AddTraffic(t trafficRow) error {
+	_, err := s.exec(`INSERT INTO traffic (hour, fingerprint, key_id, repo, op, operations, bytes_in, bytes_out, objects)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (hour, fingerprint, repo, op) DO UPDATE SET
+		key_id = CASE WHEN excluded.key_id = '' THEN traffic.key_id ELSE excluded.key_id END,
+		operations = traffic.operations + excluded.operations,
+		bytes_in = traffic.bytes_in + excluded.bytes_in,
+		bytes_out = traffic.bytes_out + excluded.bytes_out,
+		objects = traffic.objects + excluded.objects`,
+		t.Hour.UTC(), t.Fingerprint, t.KeyID, t.Repo, t.Op, t.Operations, t.BytesIn, t.BytesOut, t.Objects)
+	return err
+}
+
+// Traffic sums the hourly rows matching q, grouped by q.By. Rows are ordered
+// by bytes served, or chronologically when grouped by hour.
+func (s *metadataStore) Traffic(q trafficQuery) ([]trafficRow, error) {
+	var groups, selects []string
+	for _, by := range q.By {
+		selects = append(selects, trafficColumns[by])
+		groups = append(groups, strings.TrimSuffix(trafficColumns[by], ", MAX(key_id)"))
+	}
+	sums := "SUM(operations), SUM(bytes_in), SUM(bytes_out), SUM(objects)"
+	query := "SELECT " + strings.Join(append(selects, sums), ", ") + ` FROM traffic
+		WHERE hour >= ? AND hour < ? AND (? = '' OR fingerprint = ? OR key_id = ?) AND (? = '' OR repo = ?) AND (? = '' OR op = ?)`
+	if len(groups) > 0 {
+		query += " GROUP BY " + strings.Join(groups, ", ")
+	}
+	if slices.Contains(q.By, "hour") {
+		query += " ORDER BY hour"
+	} else {
+		query += " ORDER BY SUM(bytes_out) DESC"
+	}
+	query += " LIMIT ?"
+	rows, err := s.query(query, q.Since.UTC(), q.Until.UTC(), q.Key, q.Key, q.Key, q.Repo, q.Repo, q.Op, q.Op, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []trafficRow{}
+	for rows.Next() {
+		var t trafficRow
+		var hour time.Time
+		var dest []any
+		for _, by := range q.By {
+			switch by {
+			case "key":
+				dest = append(dest, &t.Fingerprint, &t.KeyID)
+			case "repo":
+				dest = append(dest, &t.Repo)
+			case "op":
+				dest = append(dest, &t.Op)
+			case "hour":
+				dest = append(dest, &hour)
+				t.Hour = &hour
+			}
+		}
+		// SUM over no rows is NULL.
+		var ops, in, out, objects sql.NullInt64
+		if err := rows.Scan(append(dest, &ops, &in, &out, &objects)...); err != nil {
+			return nil, err
+		}
+		if !ops.Valid {
+			continue
+		}
+		t.Operations, t.BytesIn, t.BytesOut, t.Objects = ops.Int64, in.Int64, out.Int64, objects.Int64
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+func (s *metadataStore) PruneTraffic(before time.Time) (int64, error) {
+	res, err := s.exec(`DELETE FROM traffic WHERE hour < ?`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// repoRequest is a repository creation waiting for an admin's approval.
+type repoRequest struct {
+	Name        string    `json:"name"`
+	Owner       string    `json:"owner"`
+	RequestedBy string    `json:"requested_by"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// AddRepoRequest records a creation request and reports whether it is new;
+// repeated pushes keep the first request.
+func (s *metadataStore) AddRepoRequest(req repoRequest) (bool, error) {
+	res, err := s.exec(`INSERT INTO repo_requests (name, owner, requested_by, requested_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO NOTHING`, req.Name, req.Owner, req.RequestedBy, req.RequestedAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *metadataStore) RepoRequest(name string) (repoRequest, error) {
+	var req repoRequest
+	err := s.queryRow(`SELECT name, owner, requested_by, requested_at FROM repo_requests WHERE name = ?`, name).
+		Scan(&req.Name, &req.Owner, &req.RequestedBy, &req.RequestedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return req, errNotFound
+	}
+	return req, err
+}
+
+func (s *metadataStore) RepoRequests() ([]repoRequest, error) {
+	rows, err := s.query(`SELECT name, owner, requested_by, requested_at FROM repo_requests ORDER BY requested_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	requests := []repoRequest{}
+	for rows.Next() {
+		var req repoRequest
+		if err := rows.Scan(&req.Name, &req.Owner, &req.RequestedBy, &req.RequestedAt); err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+func (s *metadataStore) DeleteRepoRequest(name string) error {
+	res, err := s.exec(`DELETE FROM repo_requests WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// guestGrant lets one SSH key access one repository until it expires.
+type guestGrant struct {
+	ID          int64     `json:"id"`
+	Repo        string    `json:"repo"`
+	Fingerprint string    `json:"fingerprint"`
+	PublicKey   string    `json:"public_key"`
+	ReadWrite   bool      `json:"read_write"`
+	Note        string    `json:"note,omitempty"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+const guestGrantColumns = `id, repo, fingerprint, public_key, read_write, note, created_by, created_at, expires_at`
+
+func scanGuestGrant(row interface{ Scan(...any) error }) (guestGrant, error) {
+	var g guestGrant
+	err := row.Scan(&g.ID, &g.Repo, &g.Fingerprint, &g.PublicKey, &g.ReadWrite, &g.Note, &g.CreatedBy, &g.CreatedAt, &g.ExpiresAt)
+	return g, err
+}
+
+func (s *metadataStore) AddGuestGrant(g guestGrant) (guestGrant, error) {
+	err := s.queryRow(`INSERT INTO guest_grants (repo, fingerprint, public_key, read_write, note, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		g.Repo, g.Fingerprint, g.PublicKey, g.ReadWrite, g.Note, g.CreatedBy, g.CreatedAt.UTC(), g.ExpiresAt.UTC()).Scan(&g.ID)
+	return g, err
+}
+
+// ImportGuestGrant adds a grant unless the same grant is already recorded.
+func (s *metadataStore) ImportGuestGrant(g guestGrant) error {
+	var exists bool
+	err := s.queryRow(`SELECT EXISTS (SELECT 1 FROM guest_grants WHERE repo = ? AND fingerprint = ? AND created_at = ?)`,
+		g.Repo, g.Fingerprint, g.CreatedAt.UTC()).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = s.AddGuestGrant(g)
+	return err
+}
+
+// ActiveGuestGrant returns the unexpired grant for the key on repo that
+// lasts longest.
+func (s *metadataStore) ActiveGuestGrant(repo, fingerprint string) (guestGrant, error) {
+	g, err := scanGuestGrant(s.queryRow(`SELECT `+guestGrantColumns+` FROM guest_grants
+		WHERE repo = ? AND fingerprint = ? AND expires_at > ? ORDER BY expires_at DESC LIMIT 1`, repo, fingerprint, time.Now().UTC()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return g, errNotFound
+	}
+	return g, err
+}
+
+// GuestGrants lists the grants of one repository, or of all repositories
+// when repo is empty, including expired ones not yet removed.
+func (s *metadataStore) GuestGrants(repo string) ([]guestGrant, error) {
+	rows, err := s.query(`SELECT `+guestGrantColumns+` FROM guest_grants WHERE (? = '' OR repo = ?) ORDER BY id`, repo, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grants := []guestGrant{}
+	for rows.Next() {
+		g, err := scanGuestGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+func (s *metadataStore) DeleteGuestGrant(repo string, id int64) error {
+	res, err := s.exec(`DELETE FROM guest_grants WHERE repo = ? AND id = ?`, repo, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// keyRevocation stops a key from authenticating from RevokeAt on: at once
+// for a revocation, or at a set date for an expiring key.
+type keyRevocation struct {
+	Fingerprint string    `json:"fingerprint"`
+	RevokeAt    time.Time `json:"revoke_at"`
+	Reason      string    `json:"reason,omitempty"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+const keyRevocationColumns = `fingerprint, revoke_at, reason, created_by, created_at`
+
+func scanKeyRevocation(row interface{ Scan(...any) error }) (keyRevocation, error) {
+	var k keyRevocation
+	err := row.Scan(&k.Fingerprint, &k.RevokeAt, &k.Reason, &k.CreatedBy, &k.CreatedAt)
+	return k, err
+}
+
+// PutKeyRevocation revokes a key or sets its expiry, replacing any earlier
+// entry for it.
+func (s *metadataStore) PutKeyRevocation(k keyRevocation) error {
+	_, err := s.exec(`INSERT INTO key_revocations (fingerprint, revoke_at, reason, created_by, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (fingerprint) DO UPDATE SET revoke_at = excluded.revoke_at, reason = excluded.reason,
+			created_by = excluded.created_by, created_at = excluded.created_at`,
+		k.Fingerprint, k.RevokeAt.UTC(), k.Reason, k.CreatedBy, k.CreatedAt.UTC())
+	return err
+}
+
+// ImportKeyRevocation adds a revocation unless the key already has one,
+// which is kept.
+func (s *metadataStore) ImportKeyRevocation(k keyRevocation) error {
+	_, err := s.exec(`INSERT INTO key_revocations (fingerprint, revoke_at, reason, created_by, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (fingerprint) DO NOTHING`,
+		k.Fingerprint, k.RevokeAt.UTC(), k.Reason, k.CreatedBy, k.CreatedAt.UTC())
+	return err
+}
+
+func (s *metadataStore) KeyRevocation(fingerprint string) (keyRevocation, error) {
+	k, err := scanKeyRevocation(s.queryRow(`SELECT `+keyRevocationColumns+` FROM key_revocations WHERE fingerprint = ?`, fingerprint))
+	if errors.Is(err, sql.ErrNoRows) {
+		return k, errNotFound
+	}
+	return k, err
+}
+
+func (s *metadataStore) KeyRevocations() ([]keyRevocation, error) {
+	rows, err := s.query(`SELECT ` + keyRevocationColumns + ` FROM key_revocations ORDER BY revoke_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revocations := []keyRevocation{}
+	for rows.Next() {
+		k, err := scanKeyRevocation(rows)
+		if err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, k)
+	}
+	return revocations, rows.Err()
+}
+
+func (s *metadataStore) DeleteKeyRevocation(fingerprint string) error {
+	res, err := s.exec(`DELETE FROM key_revocations WHERE fingerprint = ?`, fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+type searchCommit struct {
+	SHA         string
+	Author      string
+	CommittedAt time.Time
+	Message     string
+}
+
+type searchRef struct {
+	Ref string
+	SHA string
+}
+
+// searchHit is one match. Commits fill SHA, Author, Time and Message; refs
+// fill Ref and SHA; paths fill Path.
+type searchHit struct {
+	Repo    string     `json:"repo"`
+	Kind    string     `json:"kind"`
+	SHA     string     `json:"sha,omitempty"`
+	Ref     string     `json:"ref,omitempty"`
+	Path    string     `json:"path,omitempty"`
+	Author  string     `json:"author,omitempty"`
+	Time    *time.Time `json:"time,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+// AddSearchCommits indexes commits, skipping those already indexed.
+func (s *metadataStore) AddSearchCommits(repo string, commits []searchCommit) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert := s.rebind(`INSERT INTO search_commits (repo, sha, author, committed_at, message) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (repo, sha) DO NOTHING`)
+	for _, c := range commits {
+		if _, err := tx.Exec(insert, repo, c.SHA, c.Author, c.CommittedAt.UTC(), c.Message); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetSearchRefs replaces the indexed refs and, unless paths is nil, the
+// indexed file paths of a repository.
+func (s *metadataStore) SetSearchRefs(repo string, refs []searchRef, paths []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.rebind(`DELETE FROM search_refs WHERE repo = ?`), repo); err != nil {
+		return err
+	}
+	insert := s.rebind(`INSERT INTO search_refs (repo, ref, sha) VALUES (?, ?, ?)`)
+	for _, r := range refs {
+		if _, err := tx.Exec(insert, repo, r.Ref, r.SHA); err != nil {
+			return err
+		}
+	}
+	if paths != nil {
+		if _, err := tx.Exec(s.rebind(`DELETE FROM search_paths WHERE repo = ?`), repo); err != nil {
+			return err
+		}
+		insert := s.rebind(`INSERT INTO search_paths (repo, path) VALUES (?, ?)`)
+		for _, p := range paths {
+			if _, err := tx.Exec(insert, repo, p); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *metadataStore) ClearSearchIndex(repo string) error {
+	for _, table := range []string{"search_commits", "search_refs", "search_paths"} {
+		if _, err := s.exec(`DELETE FROM `+table+` WHERE repo = ?`, repo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchIndexed reports whether any refs of the repository are indexed.
+func (s *metadataStore) SearchIndexed(repo string) (bool, error) {
+	var n int
+	err := s.queryRow(`SELECT COUNT(*) FROM search_refs WHERE repo = ?`, repo).Scan(&n)
+	return n > 0, err
+}
+
+// SearchRepos returns up to limit repositories after the given name with a
+// match for term, in order, so that callers only check access to
+// repositories that matter.
+func (s *metadataStore) SearchRepos(term, kind, after string, limit int) ([]string, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(term)) + "%"
+	var parts []string
+	var args []any
+	if kind == "" || kind == "commit" {
+		parts = append(parts, `SELECT repo FROM search_commits WHERE LOWER(message) LIKE ? ESCAPE '\' OR LOWER(sha) LIKE ? ESCAPE '\'`)
+		args = append(args, pattern, pattern)
+	}
+	if kind == "" || kind == "ref" {
+		parts = append(parts, `SELECT repo FROM search_refs WHERE LOWER(ref) LIKE ? ESCAPE '\'`)
+		args = append(args, pattern)
+	}
+	if kind == "" || kind == "path" {
+		parts = append(parts, `SELECT repo FROM search_paths WHERE LOWER(path) LIKE ? ESCAPE '\'`)
+		args = append(args, pattern)
+	}
+	rows, err := s.query(`SELECT repo FROM (`+strings.Join(parts, " UNION ")+`) matches WHERE repo > ? ORDER BY repo LIMIT ?`, append(args, after, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	repos := []string{}
+	for rows.Next() {
+		var repo string
+		if err := rows.Scan(&repo); err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	return repos, rows.Err()
+}
+
+// Search returns up to limit matches of each kind whose text contains term,
+// without regard to case. A nil repos searches every repository.
+func (s *metadataStore) Search(term, kind string, repos []string, limit int) ([]searchHit, error) {
+	hits := []searchHit{}
+	if repos != nil && len(repos) == 0 {
+		return hits, nil
+	}
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(term)) + "%"
+	args := []any{pattern}
+	repoFilter := ""
+	if repos != nil {
+		repoFilter = " AND repo IN (?" + strings.Repeat(", ?", len(repos)-1) + ")"
+		for _, r := range repos {
+			args = append(args, r)
+		}
+	}
+	args = append(args, limit)
+
+	if kind == "" || kind == "commit" {
+		rows, err := s.query(`SELECT repo, sha, author, committed_at, message FROM search_commits
+			WHERE (LOWER(message) LIKE ? ESCAPE '\' OR LOWER(sha) LIKE ? ESCAPE '\')`+repoFilter+`
+			ORDER BY committed_at DESC LIMIT ?`, append([]any{pattern}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			h := searchHit{Kind: "commit"}
+			var t time.Time
+			if err := rows.Scan(&h.Repo, &h.SHA, &h.Author, &t, &h.Message); err != nil {
+				return nil, err
+			}
+			h.Time = &t
+			hits = append(hits, h)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if kind == "" || kind == "ref" {
+		rows, err := s.query(`SELECT repo, ref, sha FROM search_refs
+			WHERE LOWER(ref) LIKE ? ESCAPE '\'`+repoFilter+` ORDER BY repo, ref LIMIT ?`, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			h := searchHit{Kind: "ref"}
+			if err := rows.Scan(&h.Repo, &h.Ref, &h.SHA); err != nil {
+				return nil, err
+			}
+			hits = append(hits, h)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if kind == "" || kind == "path" {
+		rows, err := s.query(`SELECT repo, path FROM search_paths
+			WHERE LOWER(path) LIKE ? ESCAPE '\'`+repoFilter+` ORDER BY repo, path LIMIT ?`, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			h := searchHit{Kind: "path"}
+			if err := rows.Scan(&h.Repo, &h.Path); err != nil {
+				return nil, err
+			}
+			hits = append(hits, h)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return hits, nil
+}
+
+// audit records an action in the audit log. Failures are logged rather than
+// returned so that a database hiccup never fails the operation itself.
+func audit(actor, action, repo, details string) {
+	if store == nil {
+		return
+	}
+	err := store.AddAudit(auditEntry{Time: time.Now(), Actor: actor, Action: action, Repo: repo, Details: details})
+	if err != nil {
+		log.Error("Failed to write audit entry", "action", action, "repo", repo, "error", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// builtinTemplate is used for the "default" template unless the template
+// directory provides its own.
+var builtinTemplate = map[string]string{
+	"README.md": "# {{repo}}\n",
+	".gitignore": `.DS_Store
+Thumbs.db
+*.swp
+*~
+.idea/
+.vscode/
+`,
+}
+
+const defaultTemplate = "default"
+
+var errUnknownTemplate = errors.New("unknown repository template")
+
+type templateFile struct {
+	content    []byte
+	executable bool
+}
+
+// templateFiles returns the files of a template set: every file below
+// GIT_SERVER_TEMPLATE_DIR/<name>, with {{repo}} and {{owner}} replaced.
+func templateFiles(name, repo, owner string) (map[string]templateFile, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return nil, errUnknownTemplate
+	}
+	expand := func(s string) []byte {
+		return []byte(strings.NewReplacer("{{repo}}", repo, "{{owner}}", owner).Replace(s))
+	}
+
+	root := filepath.Join(config.TemplateDir, name)
+	info, err := os.Stat(root)
+	if errors.Is(err, fs.ErrNotExist) && name == defaultTemplate {
+		files := map[string]templateFile{}
+		for path, content := range builtinTemplate {
+			files[path] = templateFile{content: expand(content)}
+		}
+		return files, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return nil, errUnknownTemplate
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]templateFile{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		files[filepath.ToSlash(rel)] = templateFile{content: expand(string(data)), executable: info.Mode()&0111 != 0}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template %s: %w", name, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("template %s has no files", name)
+	}
+	return files, nil
+}
+
+// seedRepo gives an empty repository an initial commit on its default branch
+// made from a template set. It never touches a branch that already exists.
+func seedRepo(repo, template, owner string) error {
+	files, err := templateFiles(template, repo, owner)
+	if err != nil {
+		return err
+	}
+	path := repoDirPath(repo)
+	index, err := os.CreateTemp("", "git-server-index-*")
+	if err != nil {
+		return err
+	}
+	index.Close()
+	os.Remove(index.Name())
+	defer os.Remove(index.Name())
+
+	git := func(stdin string, args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-C", path}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_INDEX_FILE="+index.Name(),
+			"GIT_AUTHOR_NAME=git-server", "GIT_AUTHOR_EMAIL=git-server@localhost",
+			"GIT_COMMITTER_NAME=git-server", "GIT_COMMITTER_EMAIL=git-server@localhost",
+		)
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	for name, f := range files {
+		blob, err := git(string(f.content), "hash-object", "-w", "--stdin")
+		if err != nil {
+			return err
+		}
+		mode := "100644"
+		if f.executable {
+			mode = "100755"
+		}
+		if _, err := git("", "update-index", "--add", "--cacheinfo", mode+","+blob+","+name); err != nil {
+			return err
+		}
+	}
+	tree, err := git("", "write-tree")
+	if err != nil {
+		return err
+	}
+	commit, err := git("", "commit-tree", tree, "-m", "Initial commit")
+	if err != nil {
+		return err
+	}
+	// The empty old value makes this fail if anything was pushed meanwhile.
+	if _, err := git("", "update-ref", "HEAD", commit, ""); err != nil {
+		return err
+	}
+	if err := exec.Command("git", "-C", path, "update-server-info").Run(); err != nil {
+		return err
+	}
+	log.Info("Seeded repository from template", "repo", repo, "template", template, "commit", commit)
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish/git"
+)
+
+// With GIT_SERVER_TENANTS_FILE set, repositories whose names start with a
+// tenant's prefix belong to that tenant: they live in the tenant's own
+// directory, are authorized by its authorization server and are backed up to
+// its backup server. Other repositories are served as before.
+
+// tenant is one entry of the tenants file.
+type tenant struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	// RepoDir defaults to tenants/<name>.
+	RepoDir    string `json:"repo_dir"`
+	AuthServer string `json:"auth_server"`
+	// BackupServer receives backup uploads at /upload, like the default
+	// authorization server does. It defaults to AuthServer.
+	BackupServer string `json:"backup_server"`
+}
+
+var tenants []tenant
+
+func loadTenants(path string) ([]tenant, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+	var list []tenant
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+	repoDir, _ := filepath.Abs(config.RepoDir)
+	dirs := map[string]string{}
+	for i := range list {
+		t := &list[i]
+		if !isValidRepoName(t.Name) {
+			return nil, fmt.Errorf("tenant %d: invalid name %q", i+1, t.Name)
+		}
+		if !isValidRepoName(t.Prefix) {
+			return nil, fmt.Errorf("tenant %s: prefix %q must be a valid start of a repository name", t.Name, t.Prefix)
+		}
+		for _, other := range list[:i] {
+			if other.Name == t.Name {
+				return nil, fmt.Errorf("tenant %s is listed twice", t.Name)
+			}
+			if hasRepoPrefix(t.Prefix, other.Prefix) || hasRepoPrefix(other.Prefix, t.Prefix) {
+				return nil, fmt.Errorf("tenant %s: prefix %q overlaps the prefix %q of tenant %s", t.Name, t.Prefix, other.Prefix, other.Name)
+			}
+		}
+		if t.RepoDir == "" {
+			t.RepoDir = filepath.Join("tenants", t.Name)
+		}
+		dir, err := filepath.Abs(t.RepoDir)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		if within(dir, repoDir) || within(repoDir, dir) {
+			return nil, fmt.Errorf("tenant %s: repo_dir %s overlaps GIT_SERVER_REPO_DIR", t.Name, t.RepoDir)
+		}
+		for other, otherDir := range dirs {
+			if within(dir, otherDir) || within(otherDir, dir) {
+				return nil, fmt.Errorf("tenant %s: repo_dir %s overlaps that of tenant %s", t.Name, t.RepoDir, other)
+			}
+		}
+		dirs[t.Name] = dir
+		if err := checkHTTPURL(t.AuthServer); err != nil {
+			return nil, fmt.Errorf("tenant %s: auth_server: %w", t.Name, err)
+		}
+		if t.BackupServer == "" {
+			t.BackupServer = t.AuthServer
+		}
+		if err := checkHTTPURL(t.BackupServer); err != nil {
+			return nil, fmt.Errorf("tenant %s: backup_server: %w", t.Name, err)
+		}
+	}
+	if err := checkTenantRepos(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// checkTenantRepos refuses prefixes that would hide existing repositories:
+// those in GIT_SERVER_REPO_DIR that a prefix now claims, and those in a
+// tenant's repo_dir that no longer match its prefix. Such repositories have
+// to be moved first.
+func checkTenantRepos(list []tenant) error {
+	names, err := repoDirNames(config.RepoDir)
+	if err != nil {
+		return fmt.Errorf("failed to list GIT_SERVER_REPO_DIR: %w", err)
+	}
+	for _, name := range names {
+		for _, t := range list {
+			if hasRepoPrefix(name, t.Prefix) {
+				return fmt.Errorf("tenant %s: prefix %q matches repository %s in GIT_SERVER_REPO_DIR, move it to %s first", t.Name, t.Prefix, name, t.RepoDir)
+			}
+		}
+	}
+	for _, t := range list {
+		names, err := repoDirNames(t.RepoDir)
+		if err != nil {
+			return fmt.Errorf("tenant %s: failed to list repo_dir: %w", t.Name, err)
+		}
+		for _, name := range names {
+			if !hasRepoPrefix(name, t.Prefix) {
+				return fmt.Errorf("tenant %s: repository %s in repo_dir %s does not match prefix %q", t.Name, name, t.RepoDir, t.Prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// repoDirNames lists the directories in dir, which may not exist yet.
+func repoDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// within reports whether dir is base or inside it.
+func within(dir, base string) bool {
+	rel, err := filepath.Rel(base, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// hasRepoPrefix compares like repository names do: without case in
+// case-insensitive mode.
+func hasRepoPrefix(name, prefix string) bool {
+	if config.RepoNameCase == repoNameCaseInsensitive {
+		return strings.HasPrefix(strings.ToLower(name), strings.ToLower(prefix))
+	}
+	return strings.HasPrefix(name, prefix)
+}
+
+// tenantFor returns the tenant the repository belongs to, or nil.
+func tenantFor(repo string) *tenant {
+	for i := range tenants {
+		if hasRepoPrefix(repo, tenants[i].Prefix) {
+			return &tenants[i]
+		}
+	}
+	return nil
+}
+
+// repoRoots lists the directories repositories are kept in.
+func repoRoots() []string {
+	roots := []string{config.RepoDir}
+	for _, t := range tenants {
+		roots = append(roots, t.RepoDir)
+	}
+	return roots
+}
+
+// backupServer is where the repository's backups are uploaded.
+func backupServer(repo string) string {
+	if t := tenantFor(repo); t != nil {
+		return t.BackupServer
+	}
+	return config.InternalServer
+}
+
+// tenantAuthorizer sends tenant repositories to their tenant's authorization
+// server and everything else to the configured backend.
+type tenantAuthorizer struct {
+	fallback Authorizer
+}
+
+func (a tenantAuthorizer) Authorize(repo string, key ssh.PublicKey) (authorizedKey, git.AccessLevel) {
+	if t := tenantFor(repo); t != nil {
+		return httpAuthorizer{backend: "tenant:" + t.Name, url: t.AuthServer}.Authorize(repo, key)
+	}
+	return a.fallback.Authorize(repo, key)
+}
+
+type tenantInfo struct {
+	tenant
+	Repos int `json:"repos"`
+}
+
+func listTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	infos := make([]tenantInfo, 0, len(tenants))
+	for _, t := range tenants {
+		entries, err := os.ReadDir(t.RepoDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			writeError(w, http.StatusInternalServerError, "failed to list tenant repositories")
+			return
+		}
+		info := tenantInfo{tenant: t}
+		for _, e := range entries {
+			if e.IsDir() && hasRepoPrefix(e.Name(), t.Prefix) {
+				info.Repos++
+			}
+		}
+		infos = append(infos, info)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// throttleChunk bounds how much a single read or write may consume at once so
+// that concurrent transfers sharing a limiter interleave fairly.
+const throttleChunk = 32 * 1024
+
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, sleeping for as long as it takes to
+// refill any deficit. The bucket holds at most one second worth of bytes.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var globalLimiter = newRateLimiter(config.BandwidthLimit)
+
+type sharedLimiter struct {
+	limiter  *rateLimiter
+	sessions int
+}
+
+var (
+	keyLimitersMu sync.Mutex
+	keyLimiters   = map[string]*sharedLimiter{}
+)
+
+// acquireLimiters returns the limiters that apply to a transfer by key: the
+// global one and one shared by all sessions of the same key.
+func acquireLimiters(key ssh.PublicKey) ([]*rateLimiter, func()) {
+	var limiters []*rateLimiter
+	if globalLimiter != nil {
+		limiters = append(limiters, globalLimiter)
+	}
+	if config.KeyBandwidthLimit <= 0 || key == nil {
+		return limiters, func() {}
+	}
+
+	fingerprint := gossh.FingerprintSHA256(key)
+	keyLimitersMu.Lock()
+	shared, ok := keyLimiters[fingerprint]
+	if !ok {
+		shared = &sharedLimiter{limiter: newRateLimiter(config.KeyBandwidthLimit)}
+		keyLimiters[fingerprint] = shared
+	}
+	shared.sessions++
+	keyLimitersMu.Unlock()
+
+	release := func() {
+		keyLimitersMu.Lock()
+		defer keyLimitersMu.Unlock()
+		shared.sessions--
+		if shared.sessions == 0 {
+			delete(keyLimiters, fingerprint)
+		}
+	}
+	return append(limiters, shared.limiter), release
+}
+
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	for _, l := range t.limiters {
+		if werr := l.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*rateLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		for _, l := range t.limiters {
+			if err := l.wait(t.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func throttle(ctx context.Context, r io.Reader, w io.Writer, limiters []*rateLimiter) (io.Reader, io.Writer) {
+	if len(limiters) == 0 {
+		return r, w
+	}
+	return &throttledReader{ctx: ctx, r: r, limiters: limiters}, &throttledWriter{ctx: ctx, w: w, limiters: limiters}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// keyIDs remembers the key ID the authorization backend last reported for
+// each fingerprint, so transfers can be attributed without asking it again.
+var keyIDs sync.Map
+
+func rememberKeyID(fingerprint, id string) {
+	if id != "" {
+		keyIDs.Store(fingerprint, id)
+	}
+}
+
+func keyIDFor(fingerprint string) string {
+	id, _ := keyIDs.Load(fingerprint)
+	s, _ := id.(string)
+	return s
+}
+
+var (
+	trafficPruneMu   sync.Mutex
+	trafficLastPrune time.Time
+)
+
+// recordTraffic adds a finished transfer to the hourly per-key accounting.
+func recordTraffic(stats transferStats) {
+	if store == nil {
+		return
+	}
+	hour := stats.Time.UTC().Truncate(time.Hour)
+	err := store.AddTraffic(trafficRow{
+		Hour:        &hour,
+		Fingerprint: stats.Fingerprint,
+		KeyID:       stats.KeyID,
+		Repo:        stats.Repo,
+		Op:          stats.Op,
+		Operations:  1,
+		BytesIn:     stats.BytesIn,
+		BytesOut:    stats.BytesOut,
+		Objects:     stats.Objects,
+	})
+	if err != nil {
+		sshLog.Error("Failed to record traffic", "repo", stats.Repo, "error", err)
+	}
+
+	if config.TrafficRetention <= 0 {
+		return
+	}
+	trafficPruneMu.Lock()
+	due := time.Since(trafficLastPrune) >= time.Hour
+	if due {
+		trafficLastPrune = time.Now()
+	}
+	trafficPruneMu.Unlock()
+	if due {
+		if n, err := store.PruneTraffic(time.Now().Add(-config.TrafficRetention)); err != nil {
+			sshLog.Error("Failed to prune traffic history", "error", err)
+		} else if n > 0 {
+			sshLog.Debug("Pruned traffic history", "rows", n)
+		}
+	}
+}
+
+// trafficHandler serves traffic totals. since and until take an RFC 3339
+// timestamp or a duration before now; by lists the fields to group by.
+func trafficHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	now := time.Now()
+	q := trafficQuery{
+		Since: now.Add(-24 * time.Hour),
+		Until: now,
+		Key:   params.Get("key"),
+		Repo:  params.Get("repo"),
+		Op:    params.Get("op"),
+		By:    []string{"key", "repo"},
+		Limit: 100,
+	}
+	if q.Repo != "" {
+		q.Repo = resolveRepo(q.Repo)
+	}
+	for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		v := params.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := parseTrafficTime(v, now)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, name+" must be an RFC 3339 timestamp or a duration such as 24h")
+			return
+		}
+		*dst = t
+	}
+	if v := params.Get("by"); v != "" {
+		q.By = nil
+		for _, by := range strings.Split(v, ",") {
+			if _, ok := trafficColumns[by]; !ok {
+				writeError(w, http.StatusBadRequest, "by must list key, repo, op or hour")
+				return
+			}
+			q.By = append(q.By, by)
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		q.Limit = n
+	}
+
+	rows, err := store.Traffic(q)
+	if err != nil {
+		log.Error("Failed to query traffic", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to query traffic")
+		return
+	}
+	writeJSON(w, http.StatusOK, rows)
+}
+
+func parseTrafficTime(v string, now time.Time) (time.Time, error) {
+	if d, err := parseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Deleted repositories are moved to GIT_SERVER_TRASH_DIR/<repo>-<unix time>/
+// together with their backups and a manifest of the database records that
+// the deletion removed, so that undelete can put everything back.
+const (
+	trashManifest        = "trash.json"
+	trashRepoDir         = "repo"
+	trashBackupsDir      = "backups"
+	trashJanitorInterval = time.Hour
+)
+
+var errTrashNotFound = errors.New("no deleted repository with that name or id")
+
+type trashEntry struct {
+	ID          string            `json:"id"`
+	Repo        repoRecord        `json:"repo"`
+	Aliases     []string          `json:"aliases,omitempty"`
+	Webhooks    []exportedWebhook `json:"webhooks,omitempty"`
+	Protected   []protectedBranch `json:"protected_branches,omitempty"`
+	Statuses    []commitStatus    `json:"commit_statuses,omitempty"`
+	GuestGrants []guestGrant      `json:"guest_grants,omitempty"`
+	Mirrors     []exportedMirror  `json:"mirrors,omitempty"`
+	DeletedAt   time.Time         `json:"deleted_at"`
+	DeletedBy   string            `json:"deleted_by"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+}
+
+func (e *trashEntry) setExpiry() {
+	if config.TrashRetention > 0 {
+		expires := e.DeletedAt.Add(config.TrashRetention)
+		e.ExpiresAt = &expires
+	}
+}
+
+// redacted is the entry as shown to admins. The manifest on disk keeps the
+// mirrors' credentials for undelete.
+func (e trashEntry) redacted() trashEntry {
+	mirrors := make([]exportedMirror, len(e.Mirrors))
+	for i, m := range e.Mirrors {
+		m.URL = redactURL(m.URL)
+		mirrors[i] = m
+	}
+	e.Mirrors = mirrors
+	return e
+}
+
+func trashPath(id string) string {
+	return filepath.Join(config.TrashDir, id)
+}
+
+// deleteRepo moves a repository to the trash and removes its records.
+func deleteRepo(name, actor string) (trashEntry, error) {
+	repo := resolveRepo(name)
+	record, err := store.Repo(repo)
+	if err != nil {
+		return trashEntry{}, err
+	}
+	entry := trashEntry{
+		ID:        fmt.Sprintf("%s-%d", repo, time.Now().Unix()),
+		Repo:      record,
+		DeletedAt: time.Now().UTC(),
+		DeletedBy: actor,
+	}
+	entry.setExpiry()
+	all, err := store.Aliases()
+	if err != nil {
+		return entry, fmt.Errorf("failed to list aliases: %w", err)
+	}
+	for alias, target := range all {
+		if target == repo {
+			entry.Aliases = append(entry.Aliases, alias)
+		}
+	}
+	sort.Strings(entry.Aliases)
+	hooks, err := store.Webhooks(repo)
+	if err != nil {
+		return entry, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	for _, h := range hooks {
+		entry.Webhooks = append(entry.Webhooks, exportedWebhook{Repo: h.Repo, URL: h.URL, Secret: h.Secret, CreatedAt: h.CreatedAt})
+	}
+	if entry.Protected, err = store.ProtectedBranches(repo); err != nil {
+		return entry, fmt.Errorf("failed to list protected branches: %w", err)
+	}
+	if entry.Statuses, err = store.RepoCommitStatuses(repo); err != nil {
+		return entry, fmt.Errorf("failed to list commit statuses: %w", err)
+	}
+	if entry.GuestGrants, err = store.GuestGrants(repo); err != nil {
+		return entry, fmt.Errorf("failed to list guest grants: %w", err)
+	}
+	mirrors, err := store.Mirrors(repo)
+	if err != nil {
+		return entry, fmt.Errorf("failed to list mirrors: %w", err)
+	}
+	for _, m := range mirrors {
+		entry.Mirrors = append(entry.Mirrors, exportedMirror{Repo: m.Repo, URL: m.URL, Direction: m.Direction, CreatedAt: m.CreatedAt})
+	}
+
+	repoMutex.Lock()
+	defer repoMutex.Unlock()
+
+	dir := trashPath(entry.ID)
+	if err := os.MkdirAll(config.TrashDir, 0755); err != nil {
+		return entry, fmt.Errorf("failed to create trash directory: %w", err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return entry, fmt.Errorf("failed to create trash entry: %w", err)
+	}
+	manifest, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return entry, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, trashManifest), manifest, 0600); err != nil {
+		os.RemoveAll(dir)
+		return entry, fmt.Errorf("failed to write trash manifest: %w", err)
+	}
+	if err := os.Rename(repoDirPath(repo), filepath.Join(dir, trashRepoDir)); err != nil {
+		os.RemoveAll(dir)
+		return entry, fmt.Errorf("failed to move repository to the trash: %w", err)
+	}
+	if err := store.DeleteRepo(repo); err != nil {
+		if rerr := os.Rename(filepath.Join(dir, trashRepoDir), repoDirPath(repo)); rerr != nil {
+			log.Error("Failed to move repository back after a failed delete", "repo", repo, "path", dir, "error", rerr)
+		} else {
+			os.RemoveAll(dir)
+		}
+		return entry, fmt.Errorf("failed to remove repository record: %w", err)
+	}
+	backups := filepath.Join(config.BackupDir, repo)
+	if _, err := os.Stat(backups); err == nil {
+		if err := os.Rename(backups, filepath.Join(dir, trashBackupsDir)); err != nil {
+			log.Warn("Failed to move backups to the trash", "repo", repo, "error", err)
+		}
+	}
+	if err := aliases.reload(); err != nil {
+		log.Error("Failed to reload aliases", "error", err)
+	}
+	for _, m := range mirrors {
+		forgetMirrorMetrics(m)
+	}
+
+	log.Info("Repository moved to the trash", "repo", repo, "id", entry.ID)
+	audit(actor, "repo.delete", repo, "trash="+entry.ID)
+	recordActivity(repoActivity(repo, actor, activityRepoDelete))
+	return entry, nil
+}
+
+func readTrashEntry(id string) (trashEntry, error) {
+	var entry trashEntry
+	if id == "" || filepath.Base(id) != id {
+		return entry, errTrashNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(trashPath(id), trashManifest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return entry, errTrashNotFound
+	}
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, fmt.Errorf("failed to parse %s: %w", trashManifest, err)
+	}
+	return entry, nil
+}
+
+// listTrash returns the deleted repositories, newest first.
+func listTrash() ([]trashEntry, error) {
+	dirs, err := os.ReadDir(config.TrashDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []trashEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []trashEntry{}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		entry, err := readTrashEntry(d.Name())
+		if err != nil {
+			log.Warn("Skipping unreadable trash entry", "id", d.Name(), "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	return entries, nil
+}
+
+// findTrashEntry accepts a trash ID or a repository name, which selects its
+// most recent deletion.
+func findTrashEntry(name string) (trashEntry, error) {
+	if entry, err := readTrashEntry(name); !errors.Is(err, errTrashNotFound) {
+		return entry, err
+	}
+	entries, err := listTrash()
+	if err != nil {
+		return trashEntry{}, err
+	}
+	for _, entry := range entries {
+		if entry.Repo.Name == normalizeRepoName(name) {
+			return entry, nil
+		}
+	}
+	return trashEntry{}, errTrashNotFound
+}
+
+// undeleteRepo restores a repository from the trash, under its original name
+// unless newName is given. Aliases that were taken in the meantime are
+// dropped.
+func undeleteRepo(name, newName, actor string) (repoRecord, error) {
+	entry, err := findTrashEntry(name)
+	if err != nil {
+		return repoRecord{}, err
+	}
+	record := entry.Repo
+	if newName != "" {
+		record.Name = normalizeRepoName(newName)
+		if !isValidRepoName(record.Name) {
+			return record, errInvalidRepo
+		}
+	}
+	if _, ok := aliases.Lookup(record.Name); ok || repoExists(record.Name) {
+		return record, errRepoExists
+	}
+
+	repoMutex.Lock()
+	defer repoMutex.Unlock()
+
+	dir := trashPath(entry.ID)
+	if err := os.Rename(filepath.Join(dir, trashRepoDir), repoDirPath(record.Name)); err != nil {
+		return record, fmt.Errorf("failed to move repository out of the trash: %w", err)
+	}
+	if err := store.ImportRepo(record); err != nil {
+		if rerr := os.Rename(repoDirPath(record.Name), filepath.Join(dir, trashRepoDir)); rerr != nil {
+			log.Error("Failed to move repository back to the trash", "repo", record.Name, "error", rerr)
+		}
+		return record, fmt.Errorf("failed to record repository: %w", err)
+	}
+	for _, h := range entry.Webhooks {
+		if err := store.ImportWebhook(webhook{Repo: record.Name, URL: h.URL, Secret: h.Secret, CreatedAt: h.CreatedAt}); err != nil {
+			log.Warn("Failed to restore webhook", "repo", record.Name, "url", h.URL, "error", err)
+		}
+	}
+	for _, rule := range entry.Protected {
+		rule.Repo = record.Name
+		if err := store.SetProtectedBranch(rule); err != nil {
+			log.Warn("Failed to restore branch protection", "repo", record.Name, "pattern", rule.Pattern, "error", err)
+		}
+	}
+	for _, cs := range entry.Statuses {
+		cs.Repo = record.Name
+		if err := store.ImportCommitStatus(cs); err != nil {
+			log.Warn("Failed to restore commit status", "repo", record.Name, "sha", cs.SHA, "context", cs.Context, "error", err)
+		}
+	}
+	for _, g := range entry.GuestGrants {
+		if time.Now().After(g.ExpiresAt) {
+			continue
+		}
+		g.Repo = record.Name
+		if err := store.ImportGuestGrant(g); err != nil {
+			log.Warn("Failed to restore guest grant", "repo", record.Name, "fingerprint", g.Fingerprint, "error", err)
+		}
+	}
+	for _, m := range entry.Mirrors {
+		if err := store.ImportMirror(mirror{Repo: record.Name, URL: m.URL, Direction: m.Direction, CreatedAt: m.CreatedAt}); err != nil {
+			log.Warn("Failed to restore mirror", "repo", record.Name, "url", redactURL(m.URL), "error", err)
+		}
+	}
+	for _, alias := range entry.Aliases {
+		if _, taken := aliases.Lookup(alias); taken || repoExists(alias) || alias == record.Name {
+			log.Warn("Not restoring alias that is now in use", "repo", record.Name, "alias", alias)
+			continue
+		}
+		if err := store.SetAlias(alias, record.Name); err != nil {
+			log.Warn("Failed to restore alias", "repo", record.Name, "alias", alias, "error", err)
+		}
+	}
+	if err := aliases.reload(); err != nil {
+		log.Error("Failed to reload aliases", "error", err)
+	}
+	if err := installHooks(repoDirPath(record.Name), record.Name); err != nil {
+		hooksLog.Error("Failed to update hooks", "repo", record.Name, "error", err)
+	}
+	if config.SearchIndex {
+		if err := reindexRepo(record.Name); err != nil {
+			log.Warn("Failed to index restored repository for search", "repo", record.Name, "error", err)
+		}
+	}
+	backups := filepath.Join(dir, trashBackupsDir)
+	if _, err := os.Stat(backups); err == nil {
+		if err := os.Rename(backups, filepath.Join(config.BackupDir, record.Name)); err != nil {
+			log.Warn("Failed to restore backups", "repo", record.Name, "error", err)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Warn("Failed to remove trash entry", "id", entry.ID, "error", err)
+	}
+
+	log.Info("Repository restored from the trash", "repo", record.Name, "id", entry.ID)
+	audit(actor, "repo.undelete", record.Name, fmt.Sprintf("trash=%s original=%s", entry.ID, entry.Repo.Name))
+	recordActivity(repoActivity(record.Name, actor, activityRepoUndelete))
+	return store.Repo(record.Name)
+}
+
+func purgeTrashEntry(id, actor string) error {
+	entry, err := readTrashEntry(id)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(trashPath(entry.ID)); err != nil {
+		return fmt.Errorf("failed to remove trash entry: %w", err)
+	}
+	log.Info("Purged deleted repository", "repo", entry.Repo.Name, "id", entry.ID)
+	audit(actor, "repo.purge", entry.Repo.Name, "trash="+entry.ID)
+	return nil
+}
+
+// purgeExpiredTrash permanently removes deletions older than
+// GIT_SERVER_TRASH_RETENTION.
+func purgeExpiredTrash() {
+	entries, err := listTrash()
+	if err != nil {
+		log.Error("Failed to list the trash", "error", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.ExpiresAt == nil || time.Now().Before(*entry.ExpiresAt) {
+			continue
+		}
+		if err := purgeTrashEntry(entry.ID, "janitor"); err != nil {
+			log.Error("Failed to purge deleted repository", "id", entry.ID, "error", err)
+		}
+	}
+}
+
+func runTrashJanitor(ctx context.Context, interval time.Duration) {
+	purgeExpiredTrash()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purgeExpiredTrash()
+		}
+	}
+}
+
+func deleteCommand(sess ssh.Session, args []string) {
+	if !isAdminKey(sess.PublicKey()) {
+		wish.Fatalln(sess, "delete is restricted to admin keys")
+		return
+	}
+	if len(args) != 1 {
+		wish.Fatalln(sess, "usage: delete <repo>")
+		return
+	}
+	entry, err := deleteRepo(args[0], gossh.FingerprintSHA256(sess.PublicKey()))
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			err = errors.New("repository not found")
+		} else {
+			sshLog.Error("Repository deletion failed", "repo", args[0], "error", err)
+			err = errors.New("failed to delete repository")
+		}
+		wish.Fatalln(sess, err)
+		return
+	}
+	fmt.Fprintf(sess, "Moved %s to the trash as %s\n", entry.Repo.Name, entry.ID)
+	if entry.ExpiresAt != nil {
+		fmt.Fprintf(sess, "It can be restored until %s with: undelete %s\n", entry.ExpiresAt.Format(time.RFC3339), entry.ID)
+	} else {
+		fmt.Fprintf(sess, "Restore it with: undelete %s\n", entry.ID)
+	}
+}
+
+func undeleteCommand(sess ssh.Session, args []string) {
+	if !isAdminKey(sess.PublicKey()) {
+		wish.Fatalln(sess, "undelete is restricted to admin keys")
+		return
+	}
+	if len(args) > 2 {
+		wish.Fatalln(sess, "usage: undelete [<repo>|<trash-id> [new-name]]")
+		return
+	}
+	if len(args) == 0 {
+		entries, err := listTrash()
+		if err != nil {
+			sshLog.Error("Failed to list the trash", "error", err)
+			wish.Fatalln(sess, "failed to list the trash")
+			return
+		}
+		if len(entries) == 0 {
+			fmt.Fprintln(sess, "The trash is empty")
+			return
+		}
+		for _, e := range entries {
+			expires := "never"
+			if e.ExpiresAt != nil {
+				expires = e.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(sess, "%-40s deleted %s by %s, purged %s\n", e.ID, e.DeletedAt.Format(time.RFC3339), e.DeletedBy, expires)
+		}
+		return
+	}
+	newName := ""
+	if len(args) == 2 {
+		newName = args[1]
+	}
+	repo, err := undeleteRepo(args[0], newName, gossh.FingerprintSHA256(sess.PublicKey()))
+	if err != nil {
+		if !errors.Is(err, errTrashNotFound) && !errors.Is(err, errInvalidRepo) && !errors.Is(err, errRepoExists) {
+			sshLog.Error("Repository undelete failed", "repo", args[0], "error", err)
+			err = errors.New("failed to restore repository")
+		}
+		wish.Fatalln(sess, err)
+		return
+	}
+	fmt.Fprintf(sess, "Restored %s\ngit clone ssh://%s/%s\n", repo.Name, cloneHost(), repo.Name)
+}
+
+func deleteRepoHandler(w http.ResponseWriter, r *http.Request) {
+	entry, err := deleteRepo(r.PathValue("name"), adminActor(r))
+	switch {
+	case errors.Is(err, errNotFound):
+		writeError(w, http.StatusNotFound, "repository not found")
+	case err != nil:
+		log.Error("Repository deletion failed", "repo", r.PathValue("name"), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete repository")
+	default:
+		writeJSON(w, http.StatusOK, entry.redacted())
+	}
+}
+
+func listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := listTrash()
+	if err != nil {
+		log.Error("Failed to list the trash", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list the trash")
+		return
+	}
+	for i := range entries {
+		entries[i] = entries[i].redacted()
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func restoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	repo, err := undeleteRepo(r.PathValue("id"), body.Name, adminActor(r))
+	switch {
+	case errors.Is(err, errTrashNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errInvalidRepo):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errRepoExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		log.Error("Repository undelete failed", "id", r.PathValue("id"), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to restore repository")
+	default:
+		writeJSON(w, http.StatusOK, repo)
+	}
+}
+
+func purgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	err := purgeTrashEntry(r.PathValue("id"), adminActor(r))
+	switch {
+	case errors.Is(err, errTrashNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		log.Error("Failed to purge deleted repository", "id", r.PathValue("id"), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to purge deleted repository")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func setUmask(mask int) error {
+	return errors.New("GIT_SERVER_UMASK is not supported on this platform")
+}
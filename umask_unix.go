@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// setUmask sets the umask of the server and of the git processes it runs.
+func setUmask(mask int) error {
+	syscall.Umask(mask)
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var webhookDeliveriesTotal = newCounterVec("git_server_webhook_deliveries_total", "Webhook deliveries by result.", "status")
+
+const webhookFailureLimit = 50
+
+var (
+	webhookFailuresMu sync.Mutex
+	webhookFailures   []webhookFailure
+)
+
+// webhookFailure is a failed delivery, kept for the dashboard.
+type webhookFailure struct {
+	Time  time.Time
+	Repo  string
+	URL   string
+	Event string
+	Error string
+}
+
+type webhookPayload struct {
+	Event       string    `json:"event"`
+	Repo        string    `json:"repo"`
+	Fingerprint string    `json:"fingerprint"`
+	RefsUpdated int       `json:"refs_updated"`
+	Objects     int64     `json:"objects"`
+	Time        time.Time `json:"time"`
+}
+
+// deliverWebhooks posts the event to every webhook registered for the
+// repository in the background. Payloads are signed with HMAC-SHA256 when the
+// webhook has a secret.
+func deliverWebhooks(repo, event string, stats transferStats) {
+	hooks, err := store.Webhooks(repo)
+	if err != nil {
+		webhooksLog.Error("Failed to load webhooks", "repo", repo, "error", err)
+		return
+	}
+	for _, h := range repoSettings(repo).Webhooks {
+		hooks = append(hooks, webhook{Repo: repo, URL: h.URL, Secret: h.Secret})
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(webhookPayload{
+		Event:       event,
+		Repo:        repo,
+		Fingerprint: stats.Fingerprint,
+		RefsUpdated: stats.RefsUpdated,
+		Objects:     stats.Objects,
+		Time:        time.Now().UTC(),
+	})
+	if err != nil {
+		webhooksLog.Error("Failed to encode webhook payload", "repo", repo, "error", err)
+		return
+	}
+	for _, hook := range hooks {
+		go func() {
+			if err := sendWebhook(hook, event, body); err != nil {
+				webhookDeliveriesTotal.Inc("failed")
+				webhooksLog.Warn("Webhook delivery failed", "repo", repo, "url", hook.URL, "error", err)
+				recordWebhookFailure(webhookFailure{Time: time.Now(), Repo: repo, URL: hook.URL, Event: event, Error: err.Error()})
+				return
+			}
+			webhookDeliveriesTotal.Inc("ok")
+		}()
+	}
+}
+
+func recordWebhookFailure(f webhookFailure) {
+	webhookFailuresMu.Lock()
+	defer webhookFailuresMu.Unlock()
+	webhookFailures = append(webhookFailures, f)
+	if len(webhookFailures) > webhookFailureLimit {
+		webhookFailures = webhookFailures[len(webhookFailures)-webhookFailureLimit:]
+	}
+}
+
+// recentWebhookFailures returns the latest failed deliveries, newest first.
+func recentWebhookFailures() []webhookFailure {
+	webhookFailuresMu.Lock()
+	defer webhookFailuresMu.Unlock()
+	failures := make([]webhookFailure, 0, len(webhookFailures))
+	for i := len(webhookFailures) - 1; i >= 0; i-- {
+		failures = append(failures, webhookFailures[i])
+	}
+	return failures
+}
+
+func sendWebhook(hook webhook, event string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Git-Server-Event", event)
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Git-Server-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := newHTTPClient(egressWebhook, config.HTTPTimeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}